@@ -2,88 +2,71 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/go-gl/mathgl/mgl64"
 
+	"rikencau/abart-manager/auth"
 	"rikencau/abart-manager/dockerhandler"
 )
 
 //- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
-func getBaseWorkingDir() string {
-	const defaultDataWorkingDir = "/datawd"
+const okletters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
-	baseWorkDir := strings.Trim(os.Getenv("ABART_BASE_WORKDIR"), " ")
-	if baseWorkDir != "" {
-		if dirExists(baseWorkDir) {
-			return baseWorkDir
-		} else {
-			fmt.Fprintf(os.Stderr, "Invalid specified ABART_BASE_WORKDIR: '%s'\n", baseWorkDir)
-			return defaultDataWorkingDir
-		}
-	} else {
-		return defaultDataWorkingDir
-	}
-}
+//length of generated task IDs (about 143 bits of entropy), so that they can not be guessed
+const taskIdLength = 24
 
-func getListenedPort() string {
-	const defaultListeningPort = "10000"
+//random sequence drawn from a cryptographically secure source
+func randSeq(n int) (string, error) {
+	//bytes beyond the largest multiple of the alphabet size are discarded to avoid modulo bias
+	const maxByte = 256 - 256%len(okletters)
 
-	listenPort := strings.Trim(os.Getenv("ABART_MGR_LSTN_PORT"), " ")
-	if listenPort != "" {
-		if _, err := strconv.Atoi(listenPort); err == nil {
-			return listenPort
-		} else {
-			fmt.Fprintf(os.Stderr, "Invalid specified ABART_MGR_LSTN_PORT: '%s'\n", listenPort)
-			return defaultListeningPort
+	b := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(b) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
 		}
-	} else {
-		return defaultListeningPort
-	}
-}
-
-func getWorkerNum() int {
-	const defaultWorkerNum = 1
-
-	workerNumStr := strings.Trim(os.Getenv("ABART_WORKER_MAXNUM"), " ")
-	if workerNumStr != "" {
-		if workerNum, err := strconv.Atoi(workerNumStr); err == nil {
-			return workerNum
-		} else {
-			fmt.Fprintf(os.Stderr, "Invalid specified ABART_WORKQUEUE_SIZE: '%d'\n", workerNum)
-			return defaultWorkerNum
+		for _, r := range buf {
+			if int(r) < maxByte && len(b) < n {
+				b = append(b, okletters[int(r)%len(okletters)])
+			}
 		}
-	} else {
-		return defaultWorkerNum
 	}
+	return string(b), nil
 }
 
-//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
-const okletters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-
-var letters = []rune(okletters)
-
-func randSeq(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+//whether the string is a well-formed task ID (IDs of previous versions being shorter)
+func isValidTaskId(taskId string) bool {
+	if taskId == "" || len(taskId) > taskIdLength {
+		return false
+	}
+	for _, c := range taskId {
+		if !strings.ContainsRune(okletters, c) {
+			return false
+		}
 	}
-	return string(b)
+	return true
 }
 
 func getSafeFileName(fileName string) string {
@@ -115,17 +98,19 @@ func dirExists(path string) bool {
 
 type TaskParams struct {
 	Rotation []float64 `json:"rotation"`
+	//name of the worker settings preset to use (deployment defaults if empty)
+	Preset string `json:"preset,omitempty"`
 }
 
-func makeTransformMatrix(paramsJson string, matrixFilePath string) bool {
+func makeTransformMatrix(paramsJson string, matrixFilePath string, logger *log.Entry) bool {
 	var p TaskParams
 	err := json.Unmarshal([]byte(paramsJson), &p)
 	if err != nil {
-		fmt.Println("error while retrieving rotation params:", err)
+		logger.WithError(err).Warn("Could not retrieve rotation params")
 		return false
 
 	} else if len(p.Rotation) != 3 {
-		fmt.Println("invalid provided rotation params: %v", p)
+		logger.WithField("rotation", p.Rotation).Warn("Invalid rotation params")
 		return false
 
 	} else {
@@ -134,7 +119,7 @@ func makeTransformMatrix(paramsJson string, matrixFilePath string) bool {
 		yroll := p.Rotation[1]
 		zroll := p.Rotation[2]
 		if xroll == 0 && yroll == 0 && zroll == 0 {
-			fmt.Println("Null transform - skipping pre-transform matrix:")
+			logger.Debug("Null transform - skipping pre-transform matrix")
 			return false
 		}
 
@@ -160,7 +145,7 @@ func makeTransformMatrix(paramsJson string, matrixFilePath string) bool {
 
 		if err != nil {
 			//could not create file
-			fmt.Println("error while create pre-transform matrix:", err)
+			logger.WithError(err).Error("Could not create pre-transform matrix")
 			return false
 		}
 
@@ -171,7 +156,15 @@ func makeTransformMatrix(paramsJson string, matrixFilePath string) bool {
 //- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
 
 func getTaskDir(taskId string) string {
-	return path.Join(getBaseWorkingDir(), taskId)
+	return path.Join(config.BaseWorkDir, taskId)
+}
+
+//directory holding, for each task, the state persisted by the manager (status, metadata):
+//workers may write anywhere in their task directory, so this state is kept out of their reach
+const taskStateDirName = ".tasks"
+
+func getTaskStateDir(taskId string) string {
+	return path.Join(config.BaseWorkDir, taskStateDirName, taskId)
 }
 
 func getTaskExistingTaskDir(taskId string) string {
@@ -183,83 +176,275 @@ func getTaskExistingTaskDir(taskId string) string {
 	}
 }
 
-func getTaskExistingStatus(taskFullDir string, defaultStatus string) string {
-	statusPath := path.Join(taskFullDir, "STATUS")
+const taskStatusFileName = "STATUS"
+
+//name of the file in which the worker writes its exit code when it completes
+const workerFinishedFileName = "finished"
+
+//final status of the task according to the exit code reported by the worker
+func getWorkerExitStatus(taskFullDir string) (TaskStatus, FailureReason, string) {
+	exitCode, err := ioutil.ReadFile(path.Join(taskFullDir, workerFinishedFileName))
+	if err != nil {
+		return StatusFailed, ReasonWorkerError, "Worker ended without reporting completion"
+	} else if code := strings.TrimSpace(string(exitCode)); code != "0" {
+		return StatusFailed, ReasonWorkerError, "Worker ended with exit code " + code
+	} else {
+		return StatusFinished, ReasonNone, ""
+	}
+}
+
+//retrieve persisted status, failure reason and last message of the task
+func getTaskExistingStatus(taskStateDir string, defaultStatus TaskStatus) (TaskStatus, FailureReason, string) {
+	statusPath := path.Join(taskStateDir, taskStatusFileName)
 	if fileExists(statusPath) {
 		//if the file exists, at least the task was created
 		f, err := os.Open(statusPath)
 		if err != nil {
 			//could not read the file for some reason, can not say more than task was created...
-			return "created"
+			return StatusCreated, ReasonNone, ""
 		}
 		defer f.Close()
 
 		scanner := bufio.NewScanner(f)
 		if scanner.Scan() {
 			//actual status indicated on first line
-			return scanner.Text()
+			status := parseTaskStatus(scanner.Text())
+			//optional message on second line, and failure reason on third one
+			message := ""
+			reason := ReasonNone
+			if scanner.Scan() {
+				message = scanner.Text()
+			}
+			if scanner.Scan() {
+				reason = FailureReason(scanner.Text())
+			}
+			return status, reason, message
 		} else {
 			//could not read the file for some reason, can not say more than task was created...
-			return "created"
+			return StatusCreated, ReasonNone, ""
 		}
 	} else {
-		return defaultStatus
+		return defaultStatus, ReasonNone, ""
 	}
 }
 
 type TaskConfig struct {
 	MovingImage  string `json:"moving_image"`
 	PreTransform string `json:"pre_transform"`
+	//transforms of a previous registration to apply to additional images, instead of registering (derived tasks)
+	ApplyTransforms *ApplyTransformsConfig `json:"apply_transforms,omitempty"`
 }
 
 type TaskId string
 
 type Task struct {
-	id          TaskId
-	workdir     string
-	status      string
-	lastMessage string
-	inputFile   string
-	params      string
-	config      TaskConfig
+	id      TaskId
+	workdir string
+	//manager-only directory where status and metadata are persisted
+	statedir      string
+	status        TaskStatus
+	failureReason FailureReason
+	lastMessage   string
+	inputFile     string
+	params        string
+	config        TaskConfig
+	//worker settings preset, and corresponding configuration applied to the worker container
+	preset  string
+	profile WorkerProfile
+	//user who created the task (also recorded in metadata)
+	owner string
+	//whether an executor has picked the task for processing (guarded by TaskHandler.mu)
+	dispatched bool
+	//whether the worker container was started by a previous run of the manager, and must be re-attached
+	reattach bool
+	//how the task was processed
+	metadata TaskMetadata
+
+	//guards status, failureReason, lastMessage and metadata, which are updated from executor routines
+	mu sync.Mutex
+
+	//canceled when the task is canceled, to abort any pending call to the Docker daemon
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewTask() Task {
-	taskId := TaskId(randSeq(12))
+func NewTask(owner string) (*Task, error) {
+	seq, err := randSeq(taskIdLength)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate task ID: %w", err)
+	}
+	taskId := TaskId(seq)
 
 	//create a new directory for the task
 	taskFullDir := getTaskDir(string(taskId))
-	err := os.Mkdir(taskFullDir, 0755)
+	err = os.Mkdir(taskFullDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create task directory: %w", err)
+	}
+	taskStateDir := getTaskStateDir(string(taskId))
+	err = os.Mkdir(taskStateDir, 0700)
 	if err != nil {
-		fmt.Println(err)
+		return nil, fmt.Errorf("could not create task state directory: %w", err)
 	}
 
-	return Task{
-		id:      taskId,
-		workdir: taskFullDir,
-		status:  "created",
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Task{
+		id:       taskId,
+		workdir:  taskFullDir,
+		statedir: taskStateDir,
+		owner:    owner,
+		cancel:   cancel,
 	}
+	//calls to the Docker daemon made on behalf of the task are logged with its ID
+	t.ctx = dockerhandler.WithLogger(ctx, t.logger())
+	t.setStatus(StatusCreated, "")
+	t.updateMetadata(func(m *TaskMetadata) {
+		m.TaskId = taskId
+		m.Owner = owner
+		m.CreatedAt = time.Now()
+	})
+	return t, nil
 }
 
-func TaskFromID(taskId string, active bool) Task {
-	taskFullDir := getTaskExistingTaskDir(taskId)
-	var status string
+//rebuild a (non active) task from its persisted state
+func TaskFromID(taskId string) *Task {
+	taskFullDir := ""
+	taskStateDir := ""
+	//ID comes from the request path, it must not designate any other directory
+	if isValidTaskId(taskId) {
+		taskFullDir = getTaskExistingTaskDir(taskId)
+		taskStateDir = getTaskStateDir(taskId)
+	}
+	var status TaskStatus
+	var reason FailureReason
+	var message string
 	if taskFullDir == "" {
-		status = "unknown"
+		status = StatusUnknown
+	} else if fileExists(path.Join(taskStateDir, taskStatusFileName)) {
+		status, reason, message = getTaskExistingStatus(taskStateDir, StatusCreated)
+	} else if fileExists(path.Join(taskFullDir, workerFinishedFileName)) {
+		//task processed before status was persisted, rely on worker report
+		status, reason, message = getWorkerExitStatus(taskFullDir)
 	} else {
-		status = getTaskExistingStatus(taskFullDir, "created")
+		status = StatusCreated
+	}
+
+	//task is not handled anymore, so if stored status is an ongoing one, it means it was interrupted
+	if status.IsOngoing() {
+		status = StatusInterrupted
+	}
+
+	//metadata may not exist for tasks created by previous versions (which are then only accessible to admins)
+	var metadata TaskMetadata
+	if taskFullDir != "" {
+		metadata, _ = loadTaskMetadata(taskStateDir)
+	}
+
+	return &Task{
+		id:            TaskId(taskId),
+		workdir:       taskFullDir,
+		statedir:      taskStateDir,
+		owner:         metadata.Owner,
+		status:        status,
+		failureReason: reason,
+		lastMessage:   message,
+		metadata:      metadata,
+	}
+}
+
+//logger of entries related to the task
+func (t *Task) logger() *log.Entry {
+	return log.WithField("task", t.id)
+}
+
+//rebuild a task which was active when the manager stopped, so that it can be processed again
+func (th *TaskHandler) recoverTask(taskId string, status TaskStatus) (*Task, error) {
+	taskFullDir := getTaskDir(taskId)
+	taskStateDir := getTaskStateDir(taskId)
+	metadata, err := loadTaskMetadata(taskStateDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not load task metadata: %w", err)
+	}
+	profile, err := th.profiles.getProfile(metadata.Preset)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Task{
+		id:       TaskId(taskId),
+		workdir:  taskFullDir,
+		statedir: taskStateDir,
+		status:   status,
+		preset:   metadata.Preset,
+		profile:  profile,
+		owner:    metadata.Owner,
+		reattach: status == StatusRunning,
+		metadata: metadata,
+		cancel:   cancel,
+	}
+	t.ctx = dockerhandler.WithLogger(ctx, t.logger())
+	return t, nil
+}
+
+//update the status of the task, and persist it in its state directory
+func (t *Task) setStatus(status TaskStatus, message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.setStateLocked(status, ReasonNone, message)
+}
+
+func (t *Task) setStatusLocked(status TaskStatus, message string) {
+	t.setStateLocked(status, ReasonNone, message)
+}
+
+//mark the task as failed for the specified reason
+func (t *Task) setFailure(reason FailureReason, message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.setStateLocked(StatusFailed, reason, message)
+}
+
+func (t *Task) setStateLocked(status TaskStatus, reason FailureReason, message string) {
+	if t.status.IsOngoing() && !status.IsOngoing() {
+		observeTaskEnded(status, reason)
 	}
+	t.status = status
+	t.failureReason = reason
+	t.lastMessage = message
 
-	//if stored status is "started", need to confirm the container is still running, otherwise it means it was interrupted
-	if status == "started" && !active {
-		status = "interrupted"
+	logger := t.logger().WithField("status", status)
+	if reason != ReasonNone {
+		logger = logger.WithField("reason", reason)
 	}
+	if message != "" {
+		logger = logger.WithField("message", message)
+	}
+	logger.Info("Task status changed")
 
-	return Task{
-		id:      TaskId(taskId),
-		workdir: taskFullDir,
-		status:  status,
+	content := string(status) + "\n"
+	if message != "" || reason != ReasonNone {
+		content += message + "\n"
+	}
+	if reason != ReasonNone {
+		content += string(reason) + "\n"
 	}
+	err := os.WriteFile(path.Join(t.statedir, taskStatusFileName), []byte(content), 0644)
+	if err != nil {
+		t.logger().WithError(err).Error("Could not persist task status")
+	}
+}
+
+func (t *Task) getStatus() (TaskStatus, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status, t.lastMessage
+}
+
+func (t *Task) getFailureReason() FailureReason {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failureReason
 }
 
 func (t *Task) getWorkerContainerName() string {
@@ -270,47 +455,150 @@ func (t *Task) prepare() {
 
 	jsonData, err := json.Marshal(t.config)
 	if err != nil {
-		t.status = "failed"
-		t.lastMessage = "Error generating config file"
-		fmt.Println(t.lastMessage)
-		fmt.Println(err)
+		t.logger().WithError(err).Error("Could not generate config file")
+		t.setFailure(ReasonPreparation, "Error generating config file")
 		return
 	}
 
 	err = ioutil.WriteFile(path.Join(t.workdir, "config.json"), jsonData, 0644)
 	if err != nil {
-		t.status = "failed"
-		t.lastMessage = "Error writing config file"
-		fmt.Println(t.lastMessage)
-		fmt.Println(err)
+		t.logger().WithError(err).Error("Could not write config file")
+		t.setFailure(ReasonPreparation, "Error writing config file")
+		return
+	}
+
+	//worker running as a non-root user must be able to write its results in the task directory
+	if err := grantWorkdirAccess(t.workdir, t.profile.Limits.User); err != nil {
+		t.logger().WithError(err).Error("Could not grant worker access to task directory")
+		t.setFailure(ReasonPreparation, "Error granting worker access to task directory")
 		return
 	}
-	t.status = "prepared"
+	t.setStatus(StatusPrepared, "")
 }
 
-func (t *Task) run() {
-	dockerhandler.RunContainer(
-		os.Getenv("ABART_WORKER_IMAGE"),
-		os.Getenv("ABART_WORK_VOL"),
-		os.Getenv("ABART_PRIVATE_NET"),
-		getBaseWorkingDir(),
-		t.workdir,
-		t.getWorkerContainerName(),
-		func() { t.status = "running" },
-	)
-	t.status = "finished"
+func (t *Task) run(th *TaskHandler) {
+	timeout := th.taskTimeout
+	ctx := t.ctx
+	if timeout > 0 {
+		deadline := time.Now().Add(timeout)
+		if startedAt := t.getMetadata().StartedAt; t.reattach && startedAt != nil {
+			//time already spent before the manager restarted counts as well
+			deadline = startedAt.Add(timeout)
+		}
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithDeadline(t.ctx, deadline)
+		defer cancelTimeout()
+	}
+
+	defer func() {
+		endedAt := time.Now()
+		t.updateMetadata(func(m *TaskMetadata) {
+			m.EndedAt = &endedAt
+		})
+		if startedAt := t.getMetadata().StartedAt; startedAt != nil {
+			status, _ := t.getStatus()
+			if status == StatusStopping {
+				//being canceled
+				status = StatusCanceled
+			}
+			taskDurationSeconds.WithLabelValues(string(status)).Observe(endedAt.Sub(*startedAt).Seconds())
+		}
+		//results of a completed worker (even unsuccessfully) are described for reproducibility
+		if status, _ := t.getStatus(); (status == StatusFinished || status == StatusFailed) && fileExists(path.Join(t.workdir, workerFinishedFileName)) {
+			if err := t.writeResultsManifest(th.atlasDir); err != nil {
+				t.logger().WithError(err).Error("Could not write results manifest")
+			}
+		}
+		if status, _ := t.getStatus(); status == StatusFinished && t.getMetadata().ParentTaskId == "" {
+			//not delaying the processing of next task
+			go t.computeQualityMetrics(th.quality)
+		}
+	}()
+
+	var err error
+	if t.reattach {
+		//worker was started before the manager restarted
+		err = th.docker.ReattachContainer(ctx, t.getWorkerContainerName(), t.profile.Limits)
+	} else if image, imageErr := th.resolveWorkerImage(ctx); imageErr != nil {
+		err = fmt.Errorf("worker image is not available: %w", imageErr)
+	} else {
+		//exact image used is recorded for reproducibility
+		t.updateMetadata(func(m *TaskMetadata) {
+			m.WorkerImage = &image
+		})
+
+		err = th.docker.RunContainer(
+			ctx,
+			dockerhandler.WorkerSpec{
+				ImageName:          image.Pinned(),
+				VolumeName:         config.WorkVolume,
+				NetworkName:        config.PrivateNetwork,
+				WorkingDirBasePath: config.BaseWorkDir,
+				WorkingDir:         t.workdir,
+				ContainerName:      t.getWorkerContainerName(),
+				Limits:             t.profile.Limits,
+				Env:                makeWorkerEnv(t.id, t.workdir, t.preset, t.profile, th.atlasDir),
+				ExtraMounts:        th.extraMounts,
+			},
+			func() {
+				t.updateMetadata(func(m *TaskMetadata) {
+					startedAt := time.Now()
+					m.StartedAt = &startedAt
+					taskQueueWaitSeconds.Observe(startedAt.Sub(m.CreatedAt).Seconds())
+				})
+				t.setStatus(StatusRunning, "")
+			},
+		)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.status == StatusStopping || t.status == StatusCanceled {
+		//container ended because the task was canceled
+		return
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.logger().WithField("timeout", timeout.String()).Warn("Task timed-out")
+		t.setStatusLocked(StatusTimedOut, "Task exceeded maximum duration of "+timeout.String())
+		return
+	}
+
+	if errors.Is(err, dockerhandler.ErrOOMKilled) {
+		t.logger().WithError(err).Error("Task failed")
+		t.setStateLocked(StatusFailed, ReasonOOMKilled, "Registration worker was killed: "+err.Error())
+		return
+	}
+
+	if err != nil {
+		t.logger().WithError(err).Error("Task failed")
+		t.setStateLocked(StatusFailed, ReasonExecution, "Could not run registration worker: "+err.Error())
+		return
+	}
+
+	t.setStateLocked(getWorkerExitStatus(t.workdir))
 }
 
-func (t *Task) stop() {
-	t.status = "stopping"
-	dockerhandler.StopNRemoveContainer(
+func (t *Task) stop(docker *dockerhandler.Handler) {
+	t.setStatus(StatusStopping, "")
+	//abort any pending call to Docker daemon (and waiting for the container to stop) made on behalf of the task,
+	//the container itself is only stopped here
+	t.cancel()
+	err := docker.StopNRemoveContainer(
+		dockerhandler.WithLogger(context.Background(), t.logger()),
 		t.getWorkerContainerName(),
 	)
-	t.status = "canceled"
+	if err != nil {
+		t.logger().WithError(err).Error("Task could not be stopped")
+		t.setStatus(StatusCanceled, "Worker could not be stopped: "+err.Error())
+		return
+	}
+	t.setStatus(StatusCanceled, "")
 }
 
-func (t *Task) getLogsReader() io.ReadCloser {
-	return dockerhandler.FollowContainerLogs(
+func (t *Task) getLogsReader(ctx context.Context, docker *dockerhandler.Handler) (io.ReadCloser, error) {
+	return docker.FollowContainerLogs(
+		ctx,
 		t.getWorkerContainerName(),
 	)
 }
@@ -322,8 +610,217 @@ while allowing unlimited task submission
 type TaskHandler struct {
 	//channel used as task queue
 	c chan TaskId
-	//map containing definition of tasks to run
-	m map[TaskId]*Task
+	//map containing definition of tasks to run (guarded by mu)
+	m  map[TaskId]*Task
+	mu sync.Mutex
+	//no new task is accepted nor started while draining (guarded by mu)
+	draining bool
+	//tasks put aside because their owner has as many tasks running as allowed or the manager is draining,
+	//by quota user in submission order (guarded by mu)
+	deferred map[string][]*Task
+	//per-user limits
+	quotas *QuotaManager
+	//shared client to Docker daemon
+	docker *dockerhandler.Handler
+	//maximum wall-clock duration of a task execution (0 means unlimited)
+	taskTimeout time.Duration
+	//resource limits of worker containers
+	profiles WorkerProfiles
+	//atlas location within worker containers (image default if empty)
+	atlasDir string
+	//additional read-only mounts of worker containers
+	extraMounts []dockerhandler.Mount
+	//files needed to compute registration quality metrics
+	quality QualityConfig
+
+	//worker image reference as specified, and when it should be pulled
+	workerImage string
+	pullPolicy  dockerhandler.PullPolicy
+	//worker image resolved to its digest (guarded by imageMu)
+	pinnedImage dockerhandler.ImageInfo
+	imageMu     sync.Mutex
+}
+
+//resolve the exact worker image to be used for a run, pulling it if needed according to pull policy
+func (th *TaskHandler) resolveWorkerImage(ctx context.Context) (dockerhandler.ImageInfo, error) {
+	th.imageMu.Lock()
+	defer th.imageMu.Unlock()
+
+	if th.pullPolicy != dockerhandler.PullAlways && th.pinnedImage.Id != "" {
+		//keep using the image pinned previously, as long as it is still present
+		info, err := th.docker.EnsureImage(ctx, th.pinnedImage.Pinned(), dockerhandler.PullNever)
+		if err == nil {
+			info.Reference = th.pinnedImage.Reference
+			return info, nil
+		}
+		log.WithError(err).WithField("image", th.pinnedImage.Pinned()).Warn("Pinned worker image not available anymore")
+	}
+
+	info, err := th.docker.EnsureImage(ctx, th.workerImage, th.pullPolicy)
+	if err != nil {
+		return info, err
+	}
+	if info.Id != th.pinnedImage.Id {
+		log.WithFields(log.Fields{"image": th.workerImage, "pinned": info.Pinned()}).Info("Worker image pinned")
+	}
+	th.pinnedImage = info
+	return info, nil
+}
+
+//delay after which clients may submit again while the manager is draining
+const drainRetryAfter = 10 * time.Second
+
+func (th *TaskHandler) getActiveTask(taskId TaskId) (*Task, bool) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	t, ok := th.m[taskId]
+	return t, ok
+}
+
+//forget the task (ended or canceled), a deferred task of the same user may then be processed
+func (th *TaskHandler) removeActiveTask(taskId TaskId) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	t, ok := th.m[taskId]
+	if !ok {
+		return
+	}
+	delete(th.m, taskId)
+	user := quotaUser(t.owner)
+	if t.dispatched {
+		th.releaseDeferredLocked(user)
+		return
+	}
+	deferred := th.deferred[user]
+	for i, other := range deferred {
+		if other == t {
+			th.setDeferredLocked(user, append(deferred[:i:i], deferred[i+1:]...))
+			break
+		}
+	}
+}
+
+func (th *TaskHandler) setDeferredLocked(user string, deferred []*Task) {
+	if len(deferred) > 0 {
+		th.deferred[user] = deferred
+	} else {
+		delete(th.deferred, user)
+	}
+}
+
+//put the task aside until it may be processed, keeping the order of submissions of its owner
+func (th *TaskHandler) deferTaskLocked(t *Task) {
+	user := quotaUser(t.owner)
+	deferred := th.deferred[user]
+	createdAt := t.getMetadata().CreatedAt
+	i := sort.Search(len(deferred), func(i int) bool {
+		return deferred[i].getMetadata().CreatedAt.After(createdAt)
+	})
+	deferred = append(deferred, nil)
+	copy(deferred[i+1:], deferred[i:])
+	deferred[i] = t
+	th.setDeferredLocked(user, deferred)
+}
+
+//enqueue again as many deferred tasks of the user as it may run
+func (th *TaskHandler) releaseDeferredLocked(user string) {
+	deferred := th.deferred[user]
+	if th.draining || len(deferred) == 0 {
+		return
+	}
+	count := len(deferred)
+	if maxRunning := th.quotas.maxRunning(user); maxRunning > 0 {
+		running, _ := th.countActiveTasksLocked(user)
+		if count > maxRunning-running {
+			count = maxRunning - running
+		}
+	}
+	if count <= 0 {
+		return
+	}
+	released := make([]TaskId, count)
+	for i, t := range deferred[:count] {
+		released[i] = t.id
+	}
+	th.setDeferredLocked(user, deferred[count:])
+	//enqueuing might be blocking
+	go func() {
+		for _, taskId := range released {
+			th.c <- taskId
+		}
+	}()
+}
+
+//enqueue again deferred tasks of the user, e.g. once its limits have changed
+func (th *TaskHandler) releaseDeferred(user string) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.releaseDeferredLocked(user)
+}
+
+//number of active tasks of the user, being processed or waiting to be
+func (th *TaskHandler) countActiveTasks(user string) (running int, queued int) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	return th.countActiveTasksLocked(user)
+}
+
+func (th *TaskHandler) countActiveTasksLocked(user string) (running int, queued int) {
+	for _, t := range th.m {
+		if quotaUser(t.owner) == user {
+			if t.dispatched {
+				running++
+			} else {
+				queued++
+			}
+		}
+	}
+	return running, queued
+}
+
+//number of active tasks of all users, being processed or waiting to be
+func (th *TaskHandler) countAllActiveTasks() (running int, queued int) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	for _, t := range th.m {
+		if t.dispatched {
+			running++
+		} else {
+			queued++
+		}
+	}
+	return running, queued
+}
+
+//pick the task for processing, unless it has already been canceled (not ok), or its owner
+//already has as many tasks running as allowed or the manager is draining (deferred until a task
+//of the owner ends, its limits change, or the drain ends)
+func (th *TaskHandler) dispatchTask(taskId TaskId) (t *Task, ok bool, deferred bool) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+
+	t, ok = th.m[taskId]
+	if !ok {
+		return nil, false, false
+	}
+	if t.reattach {
+		//worker is already running
+		t.dispatched = true
+		return t, true, false
+	}
+	if th.draining {
+		th.deferTaskLocked(t)
+		return t, true, true
+	}
+	user := quotaUser(t.owner)
+	if maxRunning := th.quotas.maxRunning(user); maxRunning > 0 {
+		if running, _ := th.countActiveTasksLocked(user); running >= maxRunning {
+			th.deferTaskLocked(t)
+			return t, true, true
+		}
+	}
+	t.dispatched = true
+	return t, true, false
 }
 
 //endlessly wait for a new task enqueued in the channel, and process it
@@ -333,22 +830,26 @@ func (th *TaskHandler) consumeQueue() {
 		taskId := <-th.c
 
 		//retrieve actual task (unless it has already been canceled)
-		t, ok := th.m[taskId]
-		if ok {
+		t, ok, deferred := th.dispatchTask(taskId)
+		if ok && !deferred {
 			//process the task in current routine
-			t.run()
+			t.run(th)
+			//release resources associated with task context
+			t.cancel()
 			//remove task definition
-			delete(th.m, t.id)
+			th.removeActiveTask(t.id)
 		}
 
 	}
 }
 
-func (th *TaskHandler) StartTask(t Task) {
+func (th *TaskHandler) StartTask(t *Task) {
 	t.prepare()
-	if t.status == "prepared" {
+	if status, _ := t.getStatus(); status == StatusPrepared {
 		//store task definition
-		th.m[t.id] = &t
+		th.mu.Lock()
+		th.m[t.id] = t
+		th.mu.Unlock()
 	}
 	//process in a go routine since enqueuing might be blocking
 	go func() {
@@ -357,51 +858,104 @@ func (th *TaskHandler) StartTask(t Task) {
 	}()
 }
 
-func initTaskHandler() TaskHandler {
+func initTaskHandler(docker *dockerhandler.Handler, cfg Config) (*TaskHandler, error) {
+
+	//max number of task executed at same time
+	workerNum := cfg.WorkerMaxNum
 
-	//retrieve max number of task executed at same time
-	workerNum := getWorkerNum()
+	//worker settings have already been validated with the configuration
+	profiles, err := initWorkerProfiles(cfg.Worker)
+	if err != nil {
+		return nil, err
+	}
+	atlasDir, err := cfg.Worker.atlasDir()
+	if err != nil {
+		return nil, err
+	}
+	extraMounts, err := cfg.Worker.extraMounts()
+	if err != nil {
+		return nil, err
+	}
+	//created before any worker may run, so that it is only accessible to the manager
+	if err := os.MkdirAll(path.Join(cfg.BaseWorkDir, taskStateDirName), 0700); err != nil {
+		return nil, fmt.Errorf("could not create task state directory: %w", err)
+	}
 
-	th := TaskHandler{
+	th := &TaskHandler{
 		//task queue must be at least the size of max worker number
-		make(chan TaskId, workerNum),
-		make(map[TaskId]*Task),
+		c:           make(chan TaskId, workerNum),
+		m:           make(map[TaskId]*Task),
+		deferred:    make(map[string][]*Task),
+		quotas:      newQuotaManager(cfg.Quotas, cfg.BaseWorkDir),
+		docker:      docker,
+		taskTimeout: cfg.TaskTimeout,
+		profiles:    profiles,
+		workerImage: cfg.Worker.Image,
+		pullPolicy:  cfg.Worker.PullPolicy,
+		atlasDir:    atlasDir,
+		extraMounts: extraMounts,
+		quality:     cfg.Quality,
+	}
+
+	//worker image must be available before accepting any task
+	if _, err := th.resolveWorkerImage(context.Background()); err != nil {
+		return nil, err
 	}
 
+	//resume tasks which were active when the manager stopped
+	th.recoverTasks(cfg.BaseWorkDir)
+
 	//create enough executor go routines to be able to conccurently process as much tasks as specified
 	for i := 0; i < workerNum; i++ {
 		go th.consumeQueue()
 	}
 
-	return th
+	return th, nil
 }
 
 func (th *TaskHandler) CancelTask(taskId TaskId) {
 
 	//retrieve actual t (won't find any if it has already been canceled)
-	t, ok := th.m[taskId]
+	t, ok := th.getActiveTask(taskId)
 	if ok {
 
-		t.stop()
+		t.stop(th.docker)
 
-		delete(th.m, t.id)
+		th.removeActiveTask(t.id)
 	}
 
 }
 
-func (th *TaskHandler) followTaskLogs(taskId TaskId) io.ReadCloser {
+//follow logs of the running task until it ends or the context is canceled
+func (th *TaskHandler) followTaskLogs(ctx context.Context, taskId TaskId) io.ReadCloser {
 
 	//retrieve actual t (unless it has already been canceled)
-	t, ok := th.m[taskId]
+	t, ok := th.getActiveTask(taskId)
+	if !ok {
+		return nil
+	}
 
-	if ok && t.status == "running" {
-		return t.getLogsReader()
+	if status, _ := t.getStatus(); status == StatusRunning {
+		rc, err := t.getLogsReader(ctx, th.docker)
+		if err != nil {
+			t.logger().WithError(err).Error("Could not follow logs")
+			return nil
+		}
+		return rc
 	} else {
 		return nil
 	}
 
 }
 
+//retrieve the task, either active (i.e. pending or running) or from its persisted state
+func (th *TaskHandler) getTask(taskId string) *Task {
+	if t, active := th.getActiveTask(TaskId(taskId)); active {
+		return t
+	}
+	return TaskFromID(taskId)
+}
+
 //- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
 
 type TaskAPI interface {
@@ -409,25 +963,109 @@ type TaskAPI interface {
 	createTask(w http.ResponseWriter, r *http.Request)
 	cancelTask(w http.ResponseWriter, r *http.Request)
 	getTaskStatus(w http.ResponseWriter, r *http.Request)
+	getTaskMetadata(w http.ResponseWriter, r *http.Request)
 	followTaskLog(w http.ResponseWriter, r *http.Request)
 }
 
 type TaskApiImpl struct {
-	th TaskHandler
+	th *TaskHandler
+	//cross-origin policy, also applied to websocket endpoints
+	origins *OriginPolicy
+	//role of users allowed to access all tasks
+	adminRole string
+	//open websockets, closed on shutdown
+	sockets *socketRegistry
+	//labels of atlases
+	atlases *atlasCatalog
+}
+
+//whether the caller may access the task: its owner or an admin (anyone when authentication is disabled)
+func (api *TaskApiImpl) canAccess(r *http.Request, task *Task) bool {
+	id := auth.FromContext(r.Context())
+	if id == nil {
+		return true
+	}
+	if id.HasRole(api.adminRole) {
+		return true
+	}
+	//tasks created before ownership was recorded are only accessible to admins
+	owner := task.getMetadata().Owner
+	return owner != "" && owner == id.Subject
+}
+
+//task targeted by the request, provided it exists and the caller may access it
+//(inaccessible tasks are reported as not found, not to disclose their existence)
+func (api *TaskApiImpl) getRequestedTask(r *http.Request) (*Task, bool) {
+	vars := mux.Vars(r)
+	taskId := vars["taskId"]
+
+	task := api.th.getTask(taskId)
+	if status, _ := task.getStatus(); status == StatusUnknown {
+		return task, false
+	}
+	if !api.canAccess(r, task) {
+		requestLogger(r).WithField("task", task.id).Warn("Access denied to task")
+		return task, false
+	}
+	return task, true
 }
 
 func (api *TaskApiImpl) getApiVersion(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Endpoint Hit: version")
 	fmt.Fprintf(w, "ABART_Service: v0.1\n")
 }
 
+//check that a new task can be submitted (i.e. manager is not draining, and within the quotas of the user),
+//returns its owner, and a function to be called once the submission is complete
+func (api *TaskApiImpl) admitSubmission(w http.ResponseWriter, r *http.Request) (owner string, release func(), ok bool) {
+	logger := requestLogger(r)
+
+	if api.th.isDraining() {
+		logger.Warn("Submission rejected: manager is draining")
+		w.Header().Set("Retry-After", strconv.Itoa(int(drainRetryAfter.Seconds())))
+		http.Error(w, "Manager is not accepting new tasks for now, please retry later", http.StatusServiceUnavailable)
+		return "", nil, false
+	}
+
+	if id := auth.FromContext(r.Context()); id != nil {
+		owner = id.Subject
+	}
+
+	//submission must be within the quotas of the user
+	user := quotaUser(owner)
+	_, queued := api.th.countActiveTasks(user)
+	incomingBytes := r.ContentLength
+	if incomingBytes < 0 {
+		incomingBytes = 0
+	}
+	release, quotaErr := api.th.quotas.admit(user, queued, incomingBytes)
+	if quotaErr != nil {
+		logger.WithFields(log.Fields{"quota_user": user, "limit": quotaErr.Limit}).Warn("Submission rejected: " + quotaErr.Message)
+		writeQuotaExceeded(w, quotaErr)
+		return "", nil, false
+	}
+	return owner, release, true
+}
+
 //Create a task for the uploaded file and parameters, and start registration process
 func (api *TaskApiImpl) createTask(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("🟢🟢🟢🟢🟢 Endpoint Hit: Create Task/File Upload ")
+	logger := requestLogger(r)
 
-	task := NewTask()
-	fmt.Println("\tTaskID: " + task.id)
+	owner, release, ok := api.admitSubmission(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	task, err := NewTask(owner)
+	if err != nil {
+		logger.WithError(err).Error("Could not create task")
+		http.Error(w, "Could not create task", http.StatusInternalServerError)
+		return
+	}
+	logger = logger.WithField("task", task.id)
+	logger.Info("Task created")
 
+	uploadStart := time.Now()
 	// Parse the multipart form, (10 MB max in memory at a time)
 	r.ParseMultipartForm(10 << 20)
 
@@ -436,14 +1074,15 @@ func (api *TaskApiImpl) createTask(w http.ResponseWriter, r *http.Request) {
 	// the Header and the size of the file
 	file, handler, err := r.FormFile("inputDataFile")
 	if err != nil {
-		fmt.Println("Error Retrieving the File")
-		fmt.Println(err)
+		logger.WithError(err).Error("Could not retrieve uploaded file")
 		return
 	}
 	defer file.Close()
-	fmt.Printf("Uploaded File: %+v\n", handler.Filename)
-	fmt.Printf("File Size: %+v\n", handler.Size)
-	fmt.Printf("MIME Header: %+v\n", handler.Header)
+	logger.WithFields(log.Fields{
+		"filename": handler.Filename,
+		"size":     handler.Size,
+	}).Info("Input file uploaded")
+	logger.WithField("mime_header", handler.Header).Debug("Input file MIME header")
 
 	//provided file name might be unsafe
 	safeFileName := getSafeFileName(handler.Filename)
@@ -456,25 +1095,45 @@ func (api *TaskApiImpl) createTask(w http.ResponseWriter, r *http.Request) {
 	// read all of the contents of our uploaded file into a byte array
 	fileBytes, err := ioutil.ReadAll(file)
 	if err != nil {
-		fmt.Println(err)
+		logger.WithError(err).Error("Could not read uploaded file")
 	}
 	// write this byte array to file
 	tempFile.Write(fileBytes)
+	uploadBytes.Observe(float64(len(fileBytes)))
+	uploadDurationSeconds.Observe(time.Since(uploadStart).Seconds())
 	task.inputFile = fullFilePath
 	task.config.MovingImage = fullFilePath
 
 	//retreive task parameters sent along with the file
 	paramsJson := r.PostFormValue("params")
 	if paramsJson == "" {
-		fmt.Println("Error Retrieving parameters")
-		fmt.Println(err)
+		logger.Error("Could not retrieve task parameters")
 		return
 	}
 
-	fmt.Printf("Parameters : %+v\n", paramsJson)
+	logger.WithField("params", paramsJson).Info("Task parameters")
 	task.params = paramsJson
+
+	//resource limits of the worker depends on the selected preset
+	var params TaskParams
+	json.Unmarshal([]byte(paramsJson), &params)
+	profile, err := api.th.profiles.getProfile(params.Preset)
+	if err != nil {
+		task.setFailure(ReasonPreparation, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	task.preset = params.Preset
+	task.profile = profile
+	task.updateMetadata(func(m *TaskMetadata) {
+		m.Preset = params.Preset
+		if json.Valid([]byte(paramsJson)) {
+			m.Params = json.RawMessage(paramsJson)
+		}
+	})
+
 	matrixFileName := "initialTransform.tfm"
-	if makeTransformMatrix(paramsJson, path.Join(task.workdir, matrixFileName)) {
+	if makeTransformMatrix(paramsJson, path.Join(task.workdir, matrixFileName), logger) {
 		task.config.PreTransform = matrixFileName
 	}
 
@@ -490,86 +1149,78 @@ func (api *TaskApiImpl) createTask(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *TaskApiImpl) cancelTask(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("🔴🔴🔴🔴🔴 Endpoint Hit: cancel")
-
-	vars := mux.Vars(r)
-	taskId := vars["taskId"]
-	//Check is task is active (i.e. pending or running)
-	_, active := api.th.m[TaskId(taskId)]
-	task := TaskFromID(taskId, active)
+	apiVersion, ok := withApiVersion(w, r)
+	if !ok {
+		return
+	}
 
-	if task.status == "unknown" {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 	} else {
 		//cancel task
 		api.th.CancelTask(task.id)
-		fmt.Fprintf(w, "{\"taskId\": \"%s\", \"status\":\"%s\"}", taskId, "canceling")
+		writeTaskStatus(w, task, apiVersion)
 	}
 }
 
-func (api *TaskApiImpl) getTaskStatus(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("🔵🔵🔵🔵🔵 Endpoint Hit: status")
+type TaskStatusResponse struct {
+	TaskId  TaskId        `json:"taskId"`
+	Status  string        `json:"status"`
+	Reason  FailureReason `json:"reason,omitempty"`
+	Message string        `json:"message,omitempty"`
+}
 
-	vars := mux.Vars(r)
-	taskId := vars["taskId"]
+func writeTaskStatus(w http.ResponseWriter, t *Task, apiVersion int) {
+	status, message := t.getStatus()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TaskStatusResponse{
+		TaskId:  t.id,
+		Status:  status.ForApiVersion(apiVersion),
+		Reason:  t.getFailureReason(),
+		Message: message,
+	})
+}
 
-	//Check is task is active (i.e. pending or running)
-	_, active := api.th.m[TaskId(taskId)]
-	task := TaskFromID(taskId, active)
+func (api *TaskApiImpl) getTaskStatus(w http.ResponseWriter, r *http.Request) {
+	apiVersion, ok := withApiVersion(w, r)
+	if !ok {
+		return
+	}
 
-	if task.status == "unknown" {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 	} else {
-		fmt.Fprintf(w, "{\"taskId\": \"%s\", \"status\":\"%s\"}", taskId, task.status)
+		writeTaskStatus(w, task, apiVersion)
 	}
 }
 
-func (api *TaskApiImpl) downloadResult(w http.ResponseWriter, r *http.Request, Filename string) {
-
-	fmt.Println("🟡🟡🟡🟡🟡 Endpoint Hit: download")
-	vars := mux.Vars(r)
-	taskId := vars["taskId"]
-
-	//Check is task is active (i.e. pending or running)
-	_, active := api.th.m[TaskId(taskId)]
-	task := TaskFromID(taskId, active)
-	if task.status == "unknown" {
+func (api *TaskApiImpl) getTaskMetadata(w http.ResponseWriter, r *http.Request) {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(task.getMetadata())
+	}
+}
 
-		Openfile, err := os.Open(path.Join(task.workdir, Filename))
-		//Close after function return
-		defer Openfile.Close()
-
-		if err != nil {
-			http.Error(w, "File not found.", 404) //return 404 if file is not found
-			return
-		}
-
-		tempBuffer := make([]byte, 512)                       //Create a byte array to read the file later
-		Openfile.Read(tempBuffer)                             //Read the file into  byte
-		FileContentType := http.DetectContentType(tempBuffer) //Get file header
-
-		FileStat, _ := Openfile.Stat()                     //Get info from file
-		FileSize := strconv.FormatInt(FileStat.Size(), 10) //Get file size as a string
-
-		//set the headers
-		w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition")
-		w.Header().Set("Content-Disposition", "attachment; filename="+path.Base(Filename))
-		w.Header().Set("Content-Type", FileContentType)
-		w.Header().Set("Content-Length", FileSize)
-
-		Openfile.Seek(0, 0)  //reset the offset back to 0 since 1 buffer length bytes have been read from the file already
-		io.Copy(w, Openfile) //'Copy' the file to the client
+func (api *TaskApiImpl) downloadResult(w http.ResponseWriter, r *http.Request, Filename string) {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		serveResultFile(w, r, path.Join(task.workdir, Filename))
 	}
 }
 
 func (api *TaskApiImpl) downloadResultsZip(w http.ResponseWriter, r *http.Request) {
-	api.downloadResult(w, r, "abartResults.zip")
+	api.downloadResult(w, r, resultsZipFileName)
 }
 
 func (api *TaskApiImpl) downloadResultsRegistered(w http.ResponseWriter, r *http.Request) {
-	api.downloadResult(w, r, "results/registered/UserToAtlas_Warped.nii.gz")
+	api.downloadResult(w, r, path.Join(resultsDirName, registeredVolumePath))
 }
 
 func (api *TaskApiImpl) downloadResultsColorLUT(w http.ResponseWriter, r *http.Request) {
@@ -577,74 +1228,78 @@ func (api *TaskApiImpl) downloadResultsColorLUT(w http.ResponseWriter, r *http.R
 }
 
 func (api *TaskApiImpl) downloadResultsLabels(w http.ResponseWriter, r *http.Request) {
-	api.downloadResult(w, r, "results/labels/AtlasToUser_labels.nii.gz")
+	api.downloadResult(w, r, path.Join(resultsDirName, labelsVolumePath))
 }
 
 func (api *TaskApiImpl) followTaskLogs(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
 
-	sendMessage := func(conn *websocket.Conn, message string) {
+	sendMessage := func(conn *websocket.Conn, message string) error {
 		w, err := conn.NextWriter(websocket.TextMessage)
-		defer w.Close()
-
 		if err != nil {
-			fmt.Println("\n🔺🔻Could not get NextWriter : ", err)
-		} else {
-			io.Copy(w, strings.NewReader(message))
+			logger.WithError(err).Warn("Could not get websocket writer")
+			return err
 		}
+		io.Copy(w, strings.NewReader(message))
+		return w.Close()
 	}
 
-	fmt.Println("🟣🟣🟣🟣🟣 Endpoint Hit: logs")
-
-	vars := mux.Vars(r)
-	taskId := vars["taskId"]
+	apiVersion, ok := withApiVersion(w, r)
+	if !ok {
+		return
+	}
 
-	//Check is task is active (i.e. pending or running)
-	_, active := api.th.m[TaskId(taskId)]
-	task := TaskFromID(taskId, active)
-	if task.status == "unknown" {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 	} else {
+		logger = logger.WithField("task", task.id)
 
 		//get actual task
-		t, ok := api.th.m[task.id]
+		t, ok := api.th.getActiveTask(task.id)
 		if ok {
 
 			var upgrader = websocket.Upgrader{
 				ReadBufferSize:  1024,
 				WriteBufferSize: 1024,
-				CheckOrigin: func(r *http.Request) bool {
-					origin := r.Header.Get("Origin")
-					//origin when debugging or when running in Desktop mode
-					return origin == "http://localhost:9000" ||
-						origin == "http://localhost:9090"
-				},
+				//same cross-origin policy as REST endpoints
+				CheckOrigin: api.origins.checkWebsocketOrigin,
 			}
 
 			conn, err := upgrader.Upgrade(w, r, nil)
 			if err != nil {
-				fmt.Println("\n🔺🔻Error during upgrade:", err)
+				logger.WithError(err).Warn("Could not upgrade to websocket")
 				return
 			}
-			fmt.Println("🟪🟪🟪 Upgraded to Websockets 🟪🟪🟪")
+			logger.Debug("Upgraded to websocket")
 			defer conn.Close()
+			api.sockets.add(conn)
+			defer api.sockets.remove(conn)
+			websocketConnections.Inc()
+			defer websocketConnections.Dec()
 
 			//FIXME if task no yet executed, wait for it to be instead of returning immediately with an empty response
 			var rc io.ReadCloser
-			if t.status == "finished" {
+			status, _ := t.getStatus()
+			if status == StatusFinished {
 				sendMessage(conn, "Task already finished\n")
-			} else if t.status == "prepared" {
+			} else if status == StatusPrepared {
 				sendMessage(conn, "Task not yet started...\n")
 				//wait until task change status (either becomes running or canceled)
 				sendMessage(conn, "waiting for an execution slot.\n")
-				for t.status == "prepared" {
-					sendMessage(conn, ".")
+				for status == StatusPrepared {
+					if err := sendMessage(conn, "."); err != nil {
+						//client is gone (or manager shutting down)
+						return
+					}
 					time.Sleep(2 * time.Second)
+					status, _ = t.getStatus()
 				}
-				sendMessage(conn, "Task is now "+t.status+"\n")
+				sendMessage(conn, "Task is now "+status.ForApiVersion(apiVersion)+"\n")
 			}
 
-			if t.status == "running" {
-				rc = api.th.followTaskLogs(t.id)
+			if status == StatusRunning {
+				rc = api.th.followTaskLogs(dockerhandler.WithLogger(r.Context(), logger), t.id)
 			}
 
 			if rc != nil {
@@ -663,7 +1318,7 @@ func (api *TaskApiImpl) followTaskLogs(w http.ResponseWriter, r *http.Request) {
 					//get websocket NextWriter for next message
 					w, err := conn.NextWriter(websocket.TextMessage)
 					if err != nil {
-						fmt.Println("\n🔺🔻Could not get NextWriter : ", err)
+						logger.WithError(err).Warn("Could not get websocket writer")
 						break
 					}
 
@@ -675,7 +1330,7 @@ func (api *TaskApiImpl) followTaskLogs(w http.ResponseWriter, r *http.Request) {
 						if nw < 0 || nr < nw {
 							nw = 0
 							if ew == nil {
-								fmt.Println("\n🔺🔻Could not write to websocket : ", err)
+								logger.Warn("Could not write to websocket")
 							}
 						}
 						written = nw
@@ -684,7 +1339,7 @@ func (api *TaskApiImpl) followTaskLogs(w http.ResponseWriter, r *http.Request) {
 							break
 						}
 						if nr != nw {
-							fmt.Println("\n🔺🔻Could not write all to websocket : ", err)
+							logger.Warn("Could not write all to websocket")
 							break
 						}
 					} else {
@@ -693,14 +1348,14 @@ func (api *TaskApiImpl) followTaskLogs(w http.ResponseWriter, r *http.Request) {
 					}
 					if er != nil {
 						if er != io.EOF {
-							fmt.Println("\n🔺🔻Could not read logs : ", err)
+							logger.WithError(er).Warn("Could not read logs")
 							err = er
 						}
 					}
 					//
 
 					if err != nil {
-						fmt.Println("end of streams : ", taskId)
+						logger.Debug("End of logs")
 						moreToCome = false
 					} else {
 						//stop sending when there's no more to read
@@ -709,7 +1364,7 @@ func (api *TaskApiImpl) followTaskLogs(w http.ResponseWriter, r *http.Request) {
 
 					//close write to send message through websocket
 					if err := w.Close(); err != nil {
-						fmt.Println("\n🔺🔻Could not close Writer : ", err)
+						logger.WithError(err).Debug("Could not close websocket writer")
 						//It means that the client closed the connection (we assume it will be reconnecting eventually, so we don't interrupt the running task)
 						break
 					}
@@ -726,68 +1381,143 @@ func (api *TaskApiImpl) followTaskLogs(w http.ResponseWriter, r *http.Request) {
 }
 
 //. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
-func handleRequests() {
+func handleRequests(cfg Config) {
 
-	fmt.Printf("ABART_WORK_VOL: '%s'\n", os.Getenv("ABART_WORK_VOL"))
-	fmt.Printf("ABART_WORKER_IMAGE: '%s'\n", os.Getenv("ABART_WORKER_IMAGE"))
-	fmt.Printf("ABART_PRIVATE_NET: '%s'\n", os.Getenv("ABART_PRIVATE_NET"))
-	fmt.Printf("ABART_WORKER_MAXNUM: '%s'\n", os.Getenv("ABART_WORKER_MAXNUM"))
+	//client to Docker daemon shared by all tasks
+	docker, err := dockerhandler.NewHandler(cfg.DockerCallTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer docker.Close()
+	docker.SetCallObserver(observeDockerCall)
 
-	fmt.Printf("---\n")
+	th, err := initTaskHandler(docker, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registerMetrics(th, cfg.BaseWorkDir)
+
+	//cross-origin policy, already validated with the configuration
+	origins, err := newOriginPolicy(cfg.CORS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	corsHnd := origins.corsHandler()
 
 	//new API handler
 	api := TaskApiImpl{
-		th: initTaskHandler(),
+		th:        th,
+		origins:   origins,
+		adminRole: cfg.Auth.AdminRole,
+		sockets:   newSocketRegistry(),
+		atlases:   newAtlasCatalog(cfg.Atlases),
 	}
 
-	corsHnd := handlers.CORS(
-		handlers.AllowedHeaders([]string{"content-type"}),
-
-		//allowing Credentials (Cookies) to go through
-		handlers.AllowCredentials(),
-
-		//all methods
-		handlers.AllowedMethods([]string{
-			http.MethodHead,
-			http.MethodGet,
-			http.MethodPost,
-			http.MethodPut,
-			http.MethodPatch,
-			http.MethodDelete,
-		}),
+	// creates a new instance of a mux router
+	rootRouter := mux.NewRouter()
+	apiRouter := rootRouter.PathPrefix("/api").Subrouter()
 
-		//during debug, direct access of the API
-		handlers.AllowedOrigins([]string{"http://localhost:9000", "http://localhost:9090"}),
+	//monitoring by Prometheus
+	rootRouter.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
 
-		//browser may cache the Options reponse for up to 1 hour (expressed in seconds)
-		handlers.MaxAge(3600),
-	)
-
-	// creates a new instance of a mux router
-	apiRouter := mux.NewRouter().PathPrefix("/api").Subrouter()
+	//liveness and readiness probes
+	health := newHealthChecker(docker, th, cfg)
+	rootRouter.HandleFunc("/healthz", health.serveHealth).Methods(http.MethodGet, http.MethodHead)
+	rootRouter.HandleFunc("/readyz", health.serveReadiness).Methods(http.MethodGet, http.MethodHead)
 
 	//
 	apiRouter.HandleFunc("/version", api.getApiVersion).Methods(http.MethodGet, http.MethodOptions)
 
-	apiRouter.HandleFunc("/tasks", api.createTask).Methods("POST", http.MethodOptions)
-	apiRouter.HandleFunc("/tasks/{taskId}/cancel", api.cancelTask).Methods("PUT", http.MethodOptions)
-	apiRouter.HandleFunc("/tasks/{taskId}/logs", api.followTaskLogs).Methods(http.MethodGet, http.MethodOptions)
-	apiRouter.HandleFunc("/tasks/{taskId}/status", api.getTaskStatus).Methods(http.MethodGet, http.MethodOptions)
-	apiRouter.HandleFunc("/tasks/{taskId}/results/registered", api.downloadResultsRegistered).Methods(http.MethodGet, http.MethodOptions)
-	apiRouter.HandleFunc("/tasks/{taskId}/results/colorlut", api.downloadResultsColorLUT).Methods(http.MethodGet, http.MethodOptions)
-	apiRouter.HandleFunc("/tasks/{taskId}/results/labels", api.downloadResultsLabels).Methods(http.MethodGet, http.MethodOptions)
-	apiRouter.HandleFunc("/tasks/{taskId}/results/all", api.downloadResultsZip).Methods(http.MethodGet, http.MethodOptions)
-
-	apiRouter.Use(corsHnd)
+	//task endpoints are restricted to authenticated callers (if authentication is enabled)
+	taskRouter := apiRouter.NewRoute().Subrouter()
+	authMw, err := newAuthMiddleware(cfg.Auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if authMw != nil {
+		taskRouter.Use(authMw.Handler, recordRequestUser)
+	} else {
+		log.Warn("Authentication is disabled: API is open to anyone who can reach it")
+	}
 
-	log.Fatal(http.ListenAndServe(":"+getListenedPort(), corsHnd(apiRouter)))
+	taskRouter.HandleFunc("/tasks", api.createTask).Methods("POST", http.MethodOptions)
+	taskRouter.HandleFunc("/tasks/{taskId}/apply-transforms", api.applyTransforms).Methods("POST", http.MethodOptions)
+	taskRouter.HandleFunc("/tasks/{taskId}/cancel", api.cancelTask).Methods("PUT", http.MethodOptions)
+	taskRouter.HandleFunc("/tasks/{taskId}/logs", api.followTaskLogs).Methods(http.MethodGet, http.MethodOptions)
+	taskRouter.HandleFunc("/tasks/{taskId}/status", api.getTaskStatus).Methods(http.MethodGet, http.MethodOptions)
+	taskRouter.HandleFunc("/tasks/{taskId}/metadata", api.getTaskMetadata).Methods(http.MethodGet, http.MethodOptions)
+	taskRouter.HandleFunc("/tasks/{taskId}/quality", api.getQualityMetrics).Methods(http.MethodGet, http.MethodOptions)
+	taskRouter.HandleFunc("/tasks/{taskId}/manifest", api.getResultsManifest).Methods(http.MethodGet, http.MethodOptions)
+	//legacy routes, aliases of well-known artifacts
+	taskRouter.HandleFunc("/tasks/{taskId}/results/registered", api.downloadResultsRegistered).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+	taskRouter.HandleFunc("/tasks/{taskId}/results/colorlut", api.downloadResultsColorLUT).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+	taskRouter.HandleFunc("/tasks/{taskId}/results/labels", api.downloadResultsLabels).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+	taskRouter.HandleFunc("/tasks/{taskId}/results/all", api.downloadResultsZip).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+	//slice preview of result volumes
+	taskRouter.HandleFunc("/tasks/{taskId}/preview", api.getPreview).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+	//mapping of points between user and atlas spaces
+	taskRouter.HandleFunc("/tasks/{taskId}/points", api.mapPoints).Methods(http.MethodPost, http.MethodOptions)
+	//statistics of atlas regions
+	taskRouter.HandleFunc("/tasks/{taskId}/regions", api.getRegionStats).Methods(http.MethodGet, http.MethodOptions)
+	//archive of selected artifacts
+	taskRouter.HandleFunc("/tasks/{taskId}/archive", api.downloadResultsArchive).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+	//any artifact under the results directory (legacy routes above take precedence)
+	taskRouter.HandleFunc("/tasks/{taskId}/results", api.listResults).Methods(http.MethodGet, http.MethodOptions)
+	taskRouter.HandleFunc("/tasks/{taskId}/results/{path:.+}", api.downloadArtifact).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
+	//labels of atlases, with search by name
+	taskRouter.HandleFunc("/atlases", api.listAtlases).Methods(http.MethodGet, http.MethodOptions)
+	taskRouter.HandleFunc("/atlases/{atlas}/labels", api.getAtlasLabels).Methods(http.MethodGet, http.MethodOptions)
+
+	//administration endpoints
+	adminRouter := taskRouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(api.requireAdmin)
+	adminRouter.HandleFunc("/quotas", api.listQuotas).Methods(http.MethodGet, http.MethodOptions)
+	adminRouter.HandleFunc("/quotas/{user}", api.getQuota).Methods(http.MethodGet, http.MethodOptions)
+	adminRouter.HandleFunc("/quotas/{user}", api.setQuota).Methods(http.MethodPut, http.MethodOptions)
+	adminRouter.HandleFunc("/quotas/{user}", api.resetQuota).Methods(http.MethodDelete, http.MethodOptions)
+	adminRouter.HandleFunc("/quotas/{user}/submissions", api.resetQuotaSubmissions).Methods(http.MethodDelete, http.MethodOptions)
+	adminRouter.HandleFunc("/drain", api.getDrainStatus).Methods(http.MethodGet, http.MethodOptions)
+	adminRouter.HandleFunc("/drain", api.startDrain).Methods(http.MethodPost, http.MethodOptions)
+	adminRouter.HandleFunc("/drain", api.stopDrain).Methods(http.MethodDelete, http.MethodOptions)
+
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(cfg.ListenPort),
+		Handler: logRequests(cfg.Log, corsHnd(rootRouter)),
+	}
+	log.WithField("port", cfg.ListenPort).Info("Serving API")
+	serveUntilSignaled(server, th, api.sockets, cfg.Shutdown)
 }
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
+	cfg, printOnly, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	validationErr := cfg.validate()
 
-	fmt.Printf("WORK_DIR: '%s'\n", getBaseWorkingDir())
-	fmt.Printf("LISTEN_PORT: '%s'\n", getListenedPort())
+	if printOnly {
+		if err := cfg.print(); err != nil {
+			log.Fatal(err)
+		}
+		if validationErr != nil {
+			fmt.Fprintln(os.Stderr, validationErr)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if validationErr != nil {
+		log.Fatal(validationErr)
+	}
+	//logging settings have been validated with the configuration
+	initLogging(cfg.Log)
+
+	//effective configuration
+	if content, err := cfg.marshal(); err == nil {
+		log.WithField("config", content).Info("Effective configuration")
+	}
 
-	handleRequests()
+	config = cfg
+	handleRequests(cfg)
 }
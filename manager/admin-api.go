@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"rikencau/abart-manager/auth"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+//Administration endpoints, restricted to admin users (when authentication is enabled)
+
+//reject callers who are not admin
+func (api *TaskApiImpl) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := auth.FromContext(r.Context()); id != nil && !id.HasRole(api.adminRole) {
+			requestLogger(r).Warn("Admin access denied")
+			http.Error(w, "admin role required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//respond to a submission rejected because of a quota
+func writeQuotaExceeded(w http.ResponseWriter, quotaErr *QuotaExceededError) {
+	if quotaErr.ResetAt != nil {
+		retryAfter := int(time.Until(*quotaErr.ResetAt).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(quotaErr)
+}
+
+func (api *TaskApiImpl) getUserUsage(user string) QuotaUsage {
+	running, queued := api.th.countActiveTasks(user)
+	return api.th.quotas.getUsage(user, running, queued)
+}
+
+//usage and limits of all known users
+func (api *TaskApiImpl) listQuotas(w http.ResponseWriter, r *http.Request) {
+
+	usages := []QuotaUsage{}
+	for _, user := range api.th.quotas.knownUsers() {
+		usages = append(usages, api.getUserUsage(user))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usages)
+}
+
+//usage and limits of a user
+func (api *TaskApiImpl) getQuota(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.getUserUsage(user))
+}
+
+//set specific limits of a user
+func (api *TaskApiImpl) setQuota(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+
+	var limits QuotaLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		http.Error(w, "invalid limits: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := api.th.quotas.setLimits(user, limits); err != nil {
+		var persistErr *quotaPersistError
+		if errors.As(err, &persistErr) {
+			requestLogger(r).WithError(err).Error("Could not set quota limits")
+			http.Error(w, "could not persist limits", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "invalid limits: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	requestLogger(r).WithFields(log.Fields{"quota_user": user, "limits": fmt.Sprintf("%+v", limits)}).Info("Quota limits set")
+	//tasks deferred because of the former limits may run now
+	api.th.releaseDeferred(user)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.getUserUsage(user))
+}
+
+//restore configured limits of a user
+func (api *TaskApiImpl) resetQuota(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	if err := api.th.quotas.resetLimits(user); err != nil {
+		requestLogger(r).WithError(err).Error("Could not reset quota limits")
+		http.Error(w, "could not persist limits", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).WithField("quota_user", user).Info("Quota limits reset to configured ones")
+	//tasks deferred because of the former limits may run now
+	api.th.releaseDeferred(user)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.getUserUsage(user))
+}
+
+//forget recent submissions of a user, to lift the hourly limit
+func (api *TaskApiImpl) resetQuotaSubmissions(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	api.th.quotas.resetSubmissions(user)
+	requestLogger(r).WithField("quota_user", user).Info("Recent submissions forgotten")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.getUserUsage(user))
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+func writeDrainStatus(w http.ResponseWriter, status DrainStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+//whether the manager is draining, and its remaining active tasks
+func (api *TaskApiImpl) getDrainStatus(w http.ResponseWriter, r *http.Request) {
+	writeDrainStatus(w, api.th.getDrainStatus())
+}
+
+//stop accepting new tasks and starting queued ones, e.g. before maintenance (running tasks go on)
+func (api *TaskApiImpl) startDrain(w http.ResponseWriter, r *http.Request) {
+	requestLogger(r).Info("Drain requested")
+	api.th.startDrain()
+	writeDrainStatus(w, api.th.getDrainStatus())
+}
+
+//accept and start tasks again
+func (api *TaskApiImpl) stopDrain(w http.ResponseWriter, r *http.Request) {
+	requestLogger(r).Info("End of drain requested")
+	api.th.stopDrain()
+	writeDrainStatus(w, api.th.getDrainStatus())
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Derived tasks, applying the transforms of a finished registration to additional images
+
+	POST /api/tasks/{taskId}/apply-transforms
+
+with one or more "inputDataFile" files, and "interpolation" (linear, nearest, bspline) either once for all
+images or once per image (in the same order). The derived task is processed by the worker like any other task,
+with antsApplyTransforms instead of a registration; additional images are mapped to atlas space on the grid of
+the registered volume, as results/transformed/<name>_toAtlas.nii.gz
+*/
+
+//ApplyTransformsConfig is given to the worker (in config.json) for derived tasks
+type ApplyTransformsConfig struct {
+	//image defining the output grid (registered volume of the parent task)
+	ReferenceImage string `json:"reference_image"`
+	//transforms, in the order of antsApplyTransforms -t options (i.e. the last one is applied first)
+	Transforms []string               `json:"transforms"`
+	Images     []ApplyTransformsImage `json:"images"`
+}
+
+type ApplyTransformsImage struct {
+	Input string `json:"input"`
+	//relative to the task directory
+	Output string `json:"output"`
+	//antsApplyTransforms interpolation
+	Interpolation string `json:"interpolation"`
+}
+
+//interpolations accepted by the API, and their antsApplyTransforms counterpart
+var interpolations = map[string]string{
+	"linear":  "Linear",
+	"nearest": "NearestNeighbor",
+	"bspline": "BSpline",
+}
+
+//directory of the images mapped by derived tasks, relative to the results directory
+const transformedDirPath = "transformed"
+
+//directory of the derived task holding uploaded images, apart from files of the worker (config.json, finished...)
+const derivedInputsDirName = "inputs"
+
+//recorded as the parameters of derived tasks
+type ApplyTransformsParams struct {
+	Images []ApplyTransformsImageParams `json:"images"`
+}
+
+type ApplyTransformsImageParams struct {
+	Name          string `json:"name"`
+	Interpolation string `json:"interpolation"`
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//RegistrationTransforms are the files of the transforms computed by a registration, among its results
+//(empty if not found). As for ANTs, they are expressed as mappings of points, the atlas being the fixed space
+//and the user (input volume) space the moving one
+type RegistrationTransforms struct {
+	//displacement field mapping atlas points towards user space (applied before the affine transform)
+	Warp string
+	//displacement field mapping user points to atlas space (applied after the inverse affine transform)
+	InverseWarp string
+	//affine transform mapping atlas points to user space
+	Affine string
+}
+
+func findRegistrationTransforms(taskDir string) (RegistrationTransforms, error) {
+	transforms := RegistrationTransforms{}
+	artifacts, err := listResultArtifacts(taskDir)
+	if err != nil {
+		return transforms, err
+	}
+	for _, artifact := range artifacts {
+		if artifact.Type != "transform" {
+			continue
+		}
+		name := strings.ToLower(path.Base(artifact.Path))
+		fullPath := filepath.Join(taskDir, resultsDirName, filepath.FromSlash(artifact.Path))
+		switch {
+		case strings.HasSuffix(name, "inversewarp.nii.gz"):
+			if transforms.InverseWarp == "" {
+				transforms.InverseWarp = fullPath
+			}
+		case strings.HasSuffix(name, "warp.nii.gz"):
+			if transforms.Warp == "" {
+				transforms.Warp = fullPath
+			}
+		case strings.HasSuffix(name, ".mat"):
+			if transforms.Affine == "" {
+				transforms.Affine = fullPath
+			}
+		}
+	}
+	if transforms.Warp == "" && transforms.Affine == "" {
+		return transforms, fmt.Errorf("transforms of the registration are not available among its results")
+	}
+	return transforms, nil
+}
+
+//transforms resampling user images in atlas space, in the order expected by antsApplyTransforms (warp, then affine):
+//they map each atlas point of the output grid to the user point whose intensity is taken;
+//pre-transform (initial rotation) is not added, since ANTs collapses it into the output affine transform
+func (rt RegistrationTransforms) forImages() []string {
+	transforms := []string{}
+	for _, transform := range []string{rt.Warp, rt.Affine} {
+		if transform != "" {
+			transforms = append(transforms, transform)
+		}
+	}
+	return transforms
+}
+
+//name of the image once mapped to atlas space
+func transformedImageName(fileName string) string {
+	stem := fileName
+	for _, ext := range []string{".nii.gz", ".nii", ".nrrd", ".mha", ".mhd"} {
+		if strings.HasSuffix(strings.ToLower(stem), ext) {
+			stem = stem[:len(stem)-len(ext)]
+			break
+		}
+	}
+	return stem + "_toAtlas.nii.gz"
+}
+
+//save an uploaded file in the directory, returns its full path and size
+func saveUploadedFile(dir string, fileHeader *multipart.FileHeader) (string, int64, error) {
+	//provided file name might be unsafe
+	fileName := path.Base(getSafeFileName(fileHeader.Filename))
+	if fileName == "." || fileName == ".." || fileName == "/" {
+		return "", 0, fmt.Errorf("invalid file name '%s'", fileHeader.Filename)
+	}
+	src, err := fileHeader.Open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	fullFilePath := path.Join(dir, fileName)
+	dst, err := os.OpenFile(fullFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", 0, err
+	}
+	defer dst.Close()
+	size, err := io.Copy(dst, src)
+	if err != nil {
+		return "", 0, err
+	}
+	return fullFilePath, size, dst.Close()
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//Create a derived task, applying the transforms of the requested (finished) task to the uploaded images
+func (api *TaskApiImpl) applyTransforms(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	parent, ok := api.getRequestedTask(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if status, _ := parent.getStatus(); status != StatusFinished {
+		http.Error(w, "Transforms can only be applied from a finished task", http.StatusConflict)
+		return
+	}
+	referenceImage, _ := getTaskVolumePath(parent.workdir, taskVolumeRegistered)
+	if !fileExists(referenceImage) {
+		http.Error(w, "Registered volume of the task is not available", http.StatusConflict)
+		return
+	}
+	transforms, err := findRegistrationTransforms(parent.workdir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	owner, release, ok := api.admitSubmission(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	uploadStart := time.Now()
+	//files beyond 10 MB are stored in temporary files while parsing
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "Invalid multipart form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	files := r.MultipartForm.File["inputDataFile"]
+	if len(files) == 0 {
+		http.Error(w, "No image uploaded (inputDataFile)", http.StatusBadRequest)
+		return
+	}
+	requested := r.MultipartForm.Value["interpolation"]
+	if len(requested) == 0 {
+		requested = []string{"linear"}
+	}
+	if len(requested) != 1 && len(requested) != len(files) {
+		http.Error(w, "Interpolation must be specified either once, or once per image", http.StatusBadRequest)
+		return
+	}
+	names := make(map[string]bool)
+	for _, fileHeader := range files {
+		name := path.Base(getSafeFileName(fileHeader.Filename))
+		if names[name] {
+			http.Error(w, fmt.Sprintf("Duplicate image name '%s'", name), http.StatusBadRequest)
+			return
+		}
+		names[name] = true
+	}
+	for i, interpolation := range requested {
+		requested[i] = strings.ToLower(interpolation)
+		if _, ok := interpolations[requested[i]]; !ok {
+			http.Error(w, fmt.Sprintf("Unknown interpolation '%s' (linear, nearest, bspline)", interpolation), http.StatusBadRequest)
+			return
+		}
+	}
+
+	parentMetadata := parent.getMetadata()
+	profile, err := api.th.profiles.getProfile(parentMetadata.Preset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	task, err := NewTask(owner)
+	if err != nil {
+		logger.WithError(err).Error("Could not create task")
+		http.Error(w, "Could not create task", http.StatusInternalServerError)
+		return
+	}
+	logger = logger.WithFields(log.Fields{"task": task.id, "parent_task": parent.id})
+	logger.Info("Derived task created")
+
+	applyConfig := &ApplyTransformsConfig{
+		ReferenceImage: referenceImage,
+		Transforms:     transforms.forImages(),
+	}
+	params := ApplyTransformsParams{}
+	inputsDir := path.Join(task.workdir, derivedInputsDirName)
+	if err := os.Mkdir(inputsDir, 0755); err != nil {
+		logger.WithError(err).Error("Could not create inputs directory")
+		task.setFailure(ReasonPreparation, "Could not create inputs directory")
+		http.Error(w, "Could not create task", http.StatusInternalServerError)
+		return
+	}
+	for i, fileHeader := range files {
+		fullFilePath, size, err := saveUploadedFile(inputsDir, fileHeader)
+		if err != nil {
+			logger.WithError(err).Error("Could not save uploaded file")
+			task.setFailure(ReasonPreparation, "Could not save uploaded file: "+err.Error())
+			http.Error(w, "Could not save uploaded file", http.StatusBadRequest)
+			return
+		}
+		uploadBytes.Observe(float64(size))
+		logger.WithFields(log.Fields{"filename": fileHeader.Filename, "size": size}).Info("Input file uploaded")
+
+		interpolation := requested[0]
+		if len(requested) > 1 {
+			interpolation = requested[i]
+		}
+		name := path.Base(fullFilePath)
+		applyConfig.Images = append(applyConfig.Images, ApplyTransformsImage{
+			Input:         fullFilePath,
+			Output:        path.Join(resultsDirName, transformedDirPath, transformedImageName(name)),
+			Interpolation: interpolations[interpolation],
+		})
+		params.Images = append(params.Images, ApplyTransformsImageParams{Name: name, Interpolation: interpolation})
+	}
+	uploadDurationSeconds.Observe(time.Since(uploadStart).Seconds())
+
+	task.config.ApplyTransforms = applyConfig
+	task.preset = parentMetadata.Preset
+	task.profile = profile
+	paramsJson, _ := json.Marshal(params)
+	task.params = string(paramsJson)
+	task.updateMetadata(func(m *TaskMetadata) {
+		m.ParentTaskId = parent.id
+		m.Preset = parentMetadata.Preset
+		m.Params = paramsJson
+	})
+
+	//rest of the process can be defered after the response is sent
+	api.th.StartTask(task)
+
+	w.Header().Set("Location", path.Join(path.Dir(path.Dir(r.URL.Path)), string(task.id)))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"taskId":       string(task.id),
+		"parentTaskId": string(parent.id),
+		"message":      "Successfully submitted task!",
+	})
+}
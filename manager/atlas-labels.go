@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"rikencau/abart-manager/colortable"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Atlas labels
+
+	GET /api/atlases
+	GET /api/atlases/{atlas}/labels?search=<name>
+
+Labels of atlases come from 3D Slicer color tables (<atlas>.ctbl) of a directory read by the manager,
+the atlas ID being the name of the color table as found among results (e.g. "sp2_label_512_3dslicer_v1.0.0").
+An optional hierarchy of regions is read from <atlas>.hierarchy.txt (lines "<id> <parent id>").
+*/
+type AtlasesConfig struct {
+	//directory holding color tables of atlases, atlas labels are not available if not specified
+	LabelsDir string `yaml:"labels_dir"`
+}
+
+func (ac AtlasesConfig) validate() error {
+	if ac.LabelsDir != "" && !dirExists(ac.LabelsDir) {
+		return fmt.Errorf("directory '%s' not found", ac.LabelsDir)
+	}
+	return nil
+}
+
+const (
+	colorTableExt    = ".ctbl"
+	hierarchyFileExt = ".hierarchy.txt"
+)
+
+type AtlasLabel struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+	//red, green, blue and alpha components (0-255)
+	Color [4]uint8 `json:"color"`
+	//label of the enclosing region (omitted at the root of the hierarchy)
+	ParentId *int `json:"parentId,omitempty"`
+	//labels of enclosing regions from the root (only for search results)
+	Ancestors []int `json:"ancestors,omitempty"`
+}
+
+type AtlasLabelsResponse struct {
+	AtlasId string `json:"atlasId"`
+	//whether a hierarchy of regions is available
+	Hierarchy bool         `json:"hierarchy"`
+	Labels    []AtlasLabel `json:"labels"`
+}
+
+type AtlasSummary struct {
+	Id         string `json:"id"`
+	LabelCount int    `json:"labelCount"`
+	Hierarchy  bool   `json:"hierarchy"`
+}
+
+type atlasColorTable struct {
+	table *colortable.Table
+	//modification times of the files the table was read from
+	modTimes [2]time.Time
+}
+
+//atlasCatalog reads color tables on demand, and keeps them until their files change
+type atlasCatalog struct {
+	dir    string
+	mu     sync.Mutex
+	tables map[string]*atlasColorTable
+}
+
+func newAtlasCatalog(ac AtlasesConfig) *atlasCatalog {
+	return &atlasCatalog{dir: ac.LabelsDir, tables: make(map[string]*atlasColorTable)}
+}
+
+//IDs of available atlases
+func (ac *atlasCatalog) list() ([]string, error) {
+	if ac.dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(ac.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), colorTableExt) {
+			ids = append(ids, strings.TrimSuffix(file.Name(), colorTableExt))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+//color table of the atlas, nil if the atlas is unknown
+func (ac *atlasCatalog) get(atlasId string) (*colortable.Table, error) {
+	ids, err := ac.list()
+	if err != nil {
+		return nil, err
+	}
+	//only listed atlases are considered, so that the ID cannot point outside of the directory
+	if i := sort.SearchStrings(ids, atlasId); i == len(ids) || ids[i] != atlasId {
+		return nil, nil
+	}
+	tablePath := filepath.Join(ac.dir, atlasId+colorTableExt)
+	hierarchyPath := filepath.Join(ac.dir, atlasId+hierarchyFileExt)
+	var modTimes [2]time.Time
+	for i, filePath := range []string{tablePath, hierarchyPath} {
+		if info, err := os.Stat(filePath); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if cached, ok := ac.tables[atlasId]; ok && cached.modTimes == modTimes {
+		return cached.table, nil
+	}
+	table, err := colortable.Read(tablePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read color table of atlas %s: %w", atlasId, err)
+	}
+	if !modTimes[1].IsZero() {
+		if err := table.ReadHierarchy(hierarchyPath); err != nil {
+			return nil, fmt.Errorf("could not read hierarchy of atlas %s: %w", atlasId, err)
+		}
+	}
+	ac.tables[atlasId] = &atlasColorTable{table: table, modTimes: modTimes}
+	return table, nil
+}
+
+func atlasLabel(entry colortable.Entry) AtlasLabel {
+	label := AtlasLabel{
+		Id:    entry.Id,
+		Name:  entry.Name,
+		Color: [4]uint8{entry.Color.R, entry.Color.G, entry.Color.B, entry.Color.A},
+	}
+	if entry.Parent != colortable.NoParent {
+		parent := entry.Parent
+		label.ParentId = &parent
+	}
+	return label
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+func (api *TaskApiImpl) listAtlases(w http.ResponseWriter, r *http.Request) {
+	ids, err := api.atlases.list()
+	if err != nil {
+		requestLogger(r).WithError(err).Warn("Could not list atlases")
+		http.Error(w, "Could not list atlases", http.StatusInternalServerError)
+		return
+	}
+	summaries := make([]AtlasSummary, 0, len(ids))
+	for _, id := range ids {
+		table, err := api.atlases.get(id)
+		if err != nil || table == nil {
+			requestLogger(r).WithError(err).WithField("atlas", id).Warn("Atlas labels not available")
+			continue
+		}
+		summaries = append(summaries, AtlasSummary{Id: id, LabelCount: len(table.Entries), Hierarchy: table.HasHierarchy()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Atlases []AtlasSummary `json:"atlases"`
+	}{summaries})
+}
+
+func (api *TaskApiImpl) getAtlasLabels(w http.ResponseWriter, r *http.Request) {
+	atlasId := mux.Vars(r)["atlas"]
+	logger := requestLogger(r).WithField("atlas", atlasId)
+	table, err := api.atlases.get(atlasId)
+	if err != nil {
+		logger.WithError(err).Warn("Could not read atlas labels")
+		http.Error(w, "Could not read atlas labels", http.StatusInternalServerError)
+		return
+	} else if table == nil {
+		http.Error(w, fmt.Sprintf("Unknown atlas '%s'", atlasId), http.StatusNotFound)
+		return
+	}
+
+	response := AtlasLabelsResponse{AtlasId: atlasId, Hierarchy: table.HasHierarchy(), Labels: []AtlasLabel{}}
+	if query, ok := r.URL.Query()["search"]; ok {
+		for _, entry := range table.Search(strings.Join(query, " ")) {
+			label := atlasLabel(entry)
+			label.Ancestors = table.Ancestors(entry.Id)
+			response.Labels = append(response.Labels, label)
+		}
+	} else {
+		for _, entry := range table.Entries {
+			response.Labels = append(response.Labels, atlasLabel(entry))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Identity of the authenticated caller
+type Identity struct {
+	//user name, or token owner
+	Subject string   `json:"subject"`
+	Roles   []string `json:"roles,omitempty"`
+	//authentication method used (e.g. "token", "basic", "jwt")
+	Method string `json:"method"`
+}
+
+func (id *Identity) HasRole(role string) bool {
+	for _, r := range id.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+//attach identity to the context of the request
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+//identity attached to the context (nil if none)
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+//returned by an Authenticator when it does not know the supplied credentials,
+//so that the next authenticator handling the same scheme might be tried
+var ErrUnknownCredentials = errors.New("unknown credentials")
+
+//Authenticator validates the credentials of a given Authorization header scheme
+type Authenticator interface {
+	//scheme of the Authorization header (e.g. "Bearer", "Basic")
+	Scheme() string
+	Authenticate(ctx context.Context, credentials string) (*Identity, error)
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//Middleware rejects requests which are not authenticated by one of the configured authenticators
+type Middleware struct {
+	realm          string
+	authenticators []Authenticator
+}
+
+func NewMiddleware(realm string, authenticators ...Authenticator) *Middleware {
+	return &Middleware{realm, authenticators}
+}
+
+//extract scheme and credentials from the request
+func getCredentials(r *http.Request) (string, string) {
+	authorization := strings.TrimSpace(r.Header.Get("Authorization"))
+	if authorization != "" {
+		parts := strings.SplitN(authorization, " ", 2)
+		if len(parts) == 2 {
+			return parts[0], strings.TrimSpace(parts[1])
+		}
+		return parts[0], ""
+	}
+	//browsers can not set headers of websocket handshake requests, hence token is passed as query parameter
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		if token := r.URL.Query().Get("access_token"); token != "" {
+			return "Bearer", token
+		}
+	}
+	return "", ""
+}
+
+func (m *Middleware) authenticate(r *http.Request) (*Identity, error) {
+	scheme, credentials := getCredentials(r)
+	if scheme == "" {
+		return nil, fmt.Errorf("no credentials")
+	}
+	supported := false
+	for _, authenticator := range m.authenticators {
+		if !strings.EqualFold(authenticator.Scheme(), scheme) {
+			continue
+		}
+		supported = true
+		id, err := authenticator.Authenticate(r.Context(), credentials)
+		if err == ErrUnknownCredentials {
+			continue
+		}
+		return id, err
+	}
+	if !supported {
+		return nil, fmt.Errorf("unsupported authorization scheme '%s'", scheme)
+	}
+	return nil, ErrUnknownCredentials
+}
+
+//challenge for each supported scheme
+func (m *Middleware) challenges() []string {
+	challenges := []string{}
+	seen := make(map[string]bool)
+	for _, authenticator := range m.authenticators {
+		if scheme := authenticator.Scheme(); !seen[scheme] {
+			seen[scheme] = true
+			challenges = append(challenges, fmt.Sprintf("%s realm=\"%s\"", scheme, m.realm))
+		}
+	}
+	return challenges
+}
+
+//mux middleware
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := m.authenticate(r)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"method": r.Method, "path": r.URL.Path}).Warn("Unauthenticated request")
+			for _, challenge := range m.challenges() {
+				w.Header().Add("WWW-Authenticate", challenge)
+			}
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+	})
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type basicUser struct {
+	hash  []byte
+	roles []string
+}
+
+//BasicAuthenticator accepts HTTP basic credentials of users listed in a htpasswd-like file
+type BasicAuthenticator struct {
+	users map[string]basicUser
+	//compared when the user is unknown, so that response time does not reveal which users exist
+	dummyHash []byte
+}
+
+/*
+Load users file, in which each line specifies a user, its bcrypt password hash and optional roles:
+
+	<user>:<bcrypt hash>[:role1,role2]
+
+Such hash is generated by: htpasswd -nbB <user> <password>
+Empty lines and lines starting with '#' are ignored.
+*/
+func NewBasicAuthenticator(usersFile string) (*BasicAuthenticator, error) {
+	file, err := os.Open(usersFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read users file: %w", err)
+	}
+	defer file.Close()
+
+	ba := &BasicAuthenticator{users: make(map[string]basicUser)}
+	maxCost := bcrypt.DefaultCost
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid users file '%s', line %d: '<user>:<bcrypt hash>[:roles]' expected", usersFile, lineNum)
+		}
+		cost, err := bcrypt.Cost([]byte(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid users file '%s', line %d: bcrypt hash expected (%v)", usersFile, lineNum, err)
+		}
+		if cost > maxCost {
+			maxCost = cost
+		}
+		user := basicUser{hash: []byte(fields[1])}
+		if len(fields) == 3 && fields[2] != "" {
+			user.roles = strings.Split(fields[2], ",")
+		}
+		ba.users[fields[0]] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read users file: %w", err)
+	}
+	if ba.dummyHash, err = bcrypt.GenerateFromPassword([]byte("dummy password"), maxCost); err != nil {
+		return nil, err
+	}
+	return ba, nil
+}
+
+func (ba *BasicAuthenticator) Scheme() string {
+	return "Basic"
+}
+
+func (ba *BasicAuthenticator) Authenticate(ctx context.Context, credentials string) (*Identity, error) {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return nil, fmt.Errorf("malformed basic credentials")
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed basic credentials")
+	}
+
+	user, ok := ba.users[parts[0]]
+	if !ok {
+		bcrypt.CompareHashAndPassword(ba.dummyHash, []byte(parts[1]))
+		return nil, fmt.Errorf("invalid user or password")
+	}
+	if err := bcrypt.CompareHashAndPassword(user.hash, []byte(parts[1])); err != nil {
+		return nil, fmt.Errorf("invalid user or password")
+	}
+	return &Identity{Subject: parts[0], Roles: user.roles, Method: "basic"}, nil
+}
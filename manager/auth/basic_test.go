@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersFile := filepath.Join(t.TempDir(), "users")
+	content := "# users\nalice:" + string(hash) + ":admin,user\n\nbob:" + string(hash) + "\n"
+	if err := ioutil.WriteFile(usersFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ba, err := NewBasicAuthenticator(usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, err := bcrypt.Cost(ba.dummyHash); err != nil || cost < bcrypt.DefaultCost {
+		t.Errorf("dummy hash cost %d, at least %d expected (%v)", cost, bcrypt.DefaultCost, err)
+	}
+
+	credentials := func(user, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+	}
+	tests := []struct {
+		name        string
+		credentials string
+		subject     string
+	}{
+		{"valid", credentials("alice", "secret"), "alice"},
+		{"valid without roles", credentials("bob", "secret"), "bob"},
+		{"wrong password", credentials("alice", "wrong"), ""},
+		{"unknown user", credentials("carol", "secret"), ""},
+		{"malformed", "not base64!", ""},
+		{"no password", base64.StdEncoding.EncodeToString([]byte("alice")), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id, err := ba.Authenticate(context.Background(), test.credentials)
+			if test.subject == "" {
+				if err == nil {
+					t.Fatalf("credentials accepted, rejection expected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("credentials rejected: %v", err)
+			}
+			if id.Subject != test.subject || id.Method != "basic" {
+				t.Errorf("unexpected identity %+v", id)
+			}
+		})
+	}
+}
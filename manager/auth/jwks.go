@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//minimum delay between two fetches of the key set, when an unknown key is requested
+const jwksMinRefreshInterval = time.Minute
+
+//jwks caches the public keys of the issuer, refreshed when a token is signed by an unknown key (e.g. after rotation)
+type jwks struct {
+	issuer string
+
+	mu        sync.Mutex
+	url       string
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	//closed when the fetch in progress ends (nil if none), so that keys are fetched once for concurrent requests
+	fetching chan struct{}
+}
+
+func newJWKS(issuer string, url string) *jwks {
+	return &jwks{
+		issuer: issuer,
+		url:    url,
+		keys:   make(map[string]crypto.PublicKey),
+	}
+}
+
+//key of the given id; the lock is not held while keys are fetched, so that tokens signed by known keys are not delayed
+func (ks *jwks) getKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	key, ok := ks.lookup(kid)
+	if !ok && ks.fetching == nil && time.Since(ks.fetchedAt) > jwksMinRefreshInterval {
+		done := make(chan struct{})
+		ks.fetching = done
+		ks.fetchedAt = time.Now()
+		url := ks.url
+		ks.mu.Unlock()
+
+		//not bound to the request, as other requests may wait for the same fetch
+		keys, url, err := ks.fetch(context.Background(), url)
+
+		ks.mu.Lock()
+		if err == nil {
+			ks.keys, ks.url = keys, url
+		}
+		ks.fetching = nil
+		close(done)
+		if err != nil {
+			ks.mu.Unlock()
+			return nil, err
+		}
+		key, ok = ks.lookup(kid)
+	} else if !ok && ks.fetching != nil {
+		done := ks.fetching
+		ks.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		ks.mu.Lock()
+		key, ok = ks.lookup(kid)
+	}
+	ks.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("JWT signed by unknown key '%s'", kid)
+	}
+	return key, nil
+}
+
+func (ks *jwks) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		//key id is optional when there is a single key
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+//retrieve the JWKS URL from the OpenID provider metadata of the issuer
+func (ks *jwks) discover(ctx context.Context) (string, error) {
+	var metadata struct {
+		JwksUri string `json:"jwks_uri"`
+	}
+	discoveryUrl := strings.TrimSuffix(ks.issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(ctx, discoveryUrl, &metadata); err != nil {
+		return "", fmt.Errorf("could not discover JWKS of issuer '%s': %w", ks.issuer, err)
+	}
+	if metadata.JwksUri == "" {
+		return "", fmt.Errorf("no JWKS advertised by issuer '%s'", ks.issuer)
+	}
+	return metadata.JwksUri, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	//RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	//EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//fetch the key set from the given URL (discovered if empty), returned along with the URL
+func (ks *jwks) fetch(ctx context.Context, url string) (map[string]crypto.PublicKey, string, error) {
+	if url == "" {
+		var err error
+		if url, err = ks.discover(ctx); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, url, &keySet); err != nil {
+		return nil, "", fmt.Errorf("could not fetch JWKS from '%s': %w", url, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.WithError(err).WithField("kid", jwk.Kid).Warn("Ignoring key of JWKS")
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, url, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", jwk.Kty)
+	}
+}
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+//JWTOptions specifies how bearer JWTs (e.g. OIDC access tokens) are validated
+type JWTOptions struct {
+	//expected "iss" claim, also used for OIDC discovery of the JWKS if JWKSURL is not specified
+	Issuer string
+	//expected "aud" claim (not checked if empty)
+	Audience string
+	JWKSURL  string
+	//claim holding the user name (default "sub")
+	SubjectClaim string
+	//claim holding the roles, possibly nested (e.g. "realm_access.roles")
+	RolesClaim string
+	//tolerated clock skew when checking validity period
+	Leeway time.Duration
+}
+
+//JWTAuthenticator accepts bearer JWTs signed by one of the keys of the issuer's JWKS
+type JWTAuthenticator struct {
+	options JWTOptions
+	keys    *jwks
+}
+
+func NewJWTAuthenticator(options JWTOptions) (*JWTAuthenticator, error) {
+	if options.Issuer == "" {
+		return nil, fmt.Errorf("JWT issuer must be specified")
+	}
+	if options.SubjectClaim == "" {
+		options.SubjectClaim = "sub"
+	}
+	return &JWTAuthenticator{
+		options: options,
+		keys:    newJWKS(options.Issuer, options.JWKSURL),
+	}, nil
+}
+
+func (ja *JWTAuthenticator) Scheme() string {
+	return "Bearer"
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (ja *JWTAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		//not a JWT
+		return nil, ErrUnknownCredentials
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(segments[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature")
+	}
+	key, err := ja.keys.getKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(segments[0]+"."+segments[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeSegment(segments[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims")
+	}
+	if err := ja.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	subject, _ := lookupClaim(claims, ja.options.SubjectClaim).(string)
+	if subject == "" {
+		return nil, fmt.Errorf("JWT has no '%s' claim", ja.options.SubjectClaim)
+	}
+	id := &Identity{Subject: subject, Method: "jwt"}
+	if ja.options.RolesClaim != "" {
+		id.Roles = claimStrings(lookupClaim(claims, ja.options.RolesClaim))
+	}
+	return id, nil
+}
+
+func (ja *JWTAuthenticator) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	if iss, _ := claims["iss"].(string); iss != ja.options.Issuer {
+		return fmt.Errorf("JWT issued by unexpected issuer '%s'", iss)
+	}
+	if ja.options.Audience != "" {
+		audiences := claimStrings(claims["aud"])
+		found := false
+		for _, aud := range audiences {
+			found = found || aud == ja.options.Audience
+		}
+		if !found {
+			return fmt.Errorf("JWT not intended for audience '%s'", ja.options.Audience)
+		}
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("JWT has no expiration time")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(ja.options.Leeway)) {
+		return fmt.Errorf("JWT expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(ja.options.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("JWT not valid yet")
+	}
+	return nil
+}
+
+//claim value, following dotted path for nested claims
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	var value interface{} = claims
+	for _, key := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+//claim value as list of strings (from array or space separated string)
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+//curve of ECDSA algorithms
+var ecCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		hash = crypto.SHA512
+	default:
+		//in particular, "none" and symmetric algorithms are rejected
+		return fmt.Errorf("unsupported JWT algorithm '%s'", alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	invalid := fmt.Errorf("invalid JWT signature")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		if strings.HasPrefix(alg, "RS") {
+			err = rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		} else if strings.HasPrefix(alg, "PS") {
+			err = rsa.VerifyPSS(k, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			return fmt.Errorf("JWT algorithm '%s' does not match RSA key", alg)
+		}
+		if err != nil {
+			return invalid
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("JWT algorithm '%s' does not match EC key", alg)
+		}
+		//each algorithm is bound to a curve (RFC 7518, 3.4)
+		if curve := ecCurves[alg]; k.Curve.Params().Name != curve {
+			return fmt.Errorf("JWT algorithm '%s' requires curve %s", alg, curve)
+		}
+		//signature is the concatenation of fixed size r and s
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+	default:
+		return fmt.Errorf("unsupported key type")
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testIssuer is a local OIDC issuer serving its discovery document and JWKS
+type testIssuer struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	keys       map[string]crypto.Signer
+	jwksCalls  int
+	jwksHandle func()
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	issuer := &testIssuer{keys: make(map[string]crypto.Signer)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   issuer.server.URL,
+			"jwks_uri": issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		issuer.jwksCalls++
+		handle := issuer.jwksHandle
+		keys := []map[string]string{}
+		for kid, key := range issuer.keys {
+			keys = append(keys, publicJWK(kid, key.Public()))
+		}
+		issuer.mu.Unlock()
+		if handle != nil {
+			handle()
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (ti *testIssuer) addKey(kid string, key crypto.Signer) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.keys[kid] = key
+}
+
+func (ti *testIssuer) calls() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.jwksCalls
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func publicJWK(kid string, key crypto.PublicKey) map[string]string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return map[string]string{"kty": "EC", "kid": kid, "crv": k.Curve.Params().Name,
+			"x": b64(k.X.FillBytes(make([]byte, size))), "y": b64(k.Y.FillBytes(make([]byte, size)))}
+	}
+	panic("unsupported key")
+}
+
+func generateRSA(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func generateEC(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+//signed JWT, the signature being computed with the given algorithm whatever the header says
+func signToken(t *testing.T, header map[string]string, claims map[string]interface{}, alg string, key crypto.Signer) string {
+	headerJSON, _ := json.Marshal(header)
+	claimsJSON, _ := json.Marshal(claims)
+	signed := b64(headerJSON) + "." + b64(claimsJSON)
+	if key == nil {
+		return signed + "."
+	}
+
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	hasher := hash.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			signature, err = rsa.SignPSS(rand.Reader, k, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(signature)
+}
+
+func validClaims(issuer string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":   issuer,
+		"aud":   []string{"abart", "other"},
+		"sub":   "alice",
+		"exp":   now.Add(time.Hour).Unix(),
+		"nbf":   now.Add(-time.Minute).Unix(),
+		"realm": map[string]interface{}{"roles": []string{"admin", "user"}},
+	}
+}
+
+func newTestAuthenticator(t *testing.T, issuer *testIssuer) *JWTAuthenticator {
+	ja, err := NewJWTAuthenticator(JWTOptions{
+		Issuer:     issuer.server.URL,
+		Audience:   "abart",
+		RolesClaim: "realm.roles",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ja
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	issuer := newTestIssuer(t)
+	rsaKey := generateRSA(t)
+	p256Key := generateEC(t, elliptic.P256())
+	p384Key := generateEC(t, elliptic.P384())
+	issuer.addKey("rsa", rsaKey)
+	issuer.addKey("p256", p256Key)
+	issuer.addKey("p384", p384Key)
+	ja := newTestAuthenticator(t, issuer)
+
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		claims := validClaims(issuer.server.URL)
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	now := time.Now()
+	tests := []struct {
+		name   string
+		header map[string]string
+		claims map[string]interface{}
+		//algorithm used to sign, and key (no signature if nil)
+		alg   string
+		key   crypto.Signer
+		valid bool
+	}{
+		{"RS256", map[string]string{"alg": "RS256", "kid": "rsa"}, validClaims(issuer.server.URL), "RS256", rsaKey, true},
+		{"RS512", map[string]string{"alg": "RS512", "kid": "rsa"}, validClaims(issuer.server.URL), "RS512", rsaKey, true},
+		{"PS256", map[string]string{"alg": "PS256", "kid": "rsa"}, validClaims(issuer.server.URL), "PS256", rsaKey, true},
+		{"ES256", map[string]string{"alg": "ES256", "kid": "p256"}, validClaims(issuer.server.URL), "ES256", p256Key, true},
+		{"ES384", map[string]string{"alg": "ES384", "kid": "p384"}, validClaims(issuer.server.URL), "ES384", p384Key, true},
+		{"ES256 with P-384 key", map[string]string{"alg": "ES256", "kid": "p384"}, validClaims(issuer.server.URL), "ES256", p384Key, false},
+		{"ES384 with P-256 key", map[string]string{"alg": "ES384", "kid": "p256"}, validClaims(issuer.server.URL), "ES384", p256Key, false},
+		{"PS256 signed as RS256", map[string]string{"alg": "PS256", "kid": "rsa"}, validClaims(issuer.server.URL), "RS256", rsaKey, false},
+		{"RS256 with EC key", map[string]string{"alg": "RS256", "kid": "p256"}, validClaims(issuer.server.URL), "ES256", p256Key, false},
+		{"expired", map[string]string{"alg": "RS256", "kid": "rsa"}, withClaim("exp", now.Add(-time.Minute).Unix()), "RS256", rsaKey, false},
+		{"no expiration", map[string]string{"alg": "RS256", "kid": "rsa"}, withClaim("exp", nil), "RS256", rsaKey, false},
+		{"not valid yet", map[string]string{"alg": "RS256", "kid": "rsa"}, withClaim("nbf", now.Add(time.Hour).Unix()), "RS256", rsaKey, false},
+		{"wrong issuer", map[string]string{"alg": "RS256", "kid": "rsa"}, withClaim("iss", "https://other.example.org"), "RS256", rsaKey, false},
+		{"wrong audience", map[string]string{"alg": "RS256", "kid": "rsa"}, withClaim("aud", "other"), "RS256", rsaKey, false},
+		{"alg none", map[string]string{"alg": "none", "kid": "rsa"}, validClaims(issuer.server.URL), "", nil, false},
+		{"HS256", map[string]string{"alg": "HS256", "kid": "rsa"}, validClaims(issuer.server.URL), "RS256", rsaKey, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := signToken(t, test.header, test.claims, test.alg, test.key)
+			id, err := ja.Authenticate(context.Background(), token)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("token accepted, rejection expected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("token rejected: %v", err)
+			}
+			if id.Subject != "alice" || id.Method != "jwt" || !id.HasRole("admin") || !id.HasRole("user") {
+				t.Errorf("unexpected identity %+v", id)
+			}
+		})
+	}
+
+	//tampered claims
+	token := signToken(t, map[string]string{"alg": "RS256", "kid": "rsa"}, validClaims(issuer.server.URL), "RS256", rsaKey)
+	segments := strings.Split(token, ".")
+	other := withClaim("sub", "mallory")
+	otherJSON, _ := json.Marshal(other)
+	if _, err := ja.Authenticate(context.Background(), segments[0]+"."+b64(otherJSON)+"."+segments[2]); err == nil {
+		t.Errorf("token with tampered claims accepted")
+	}
+
+	//not a JWT, left to other bearer authenticators
+	if _, err := ja.Authenticate(context.Background(), "opaque-token"); err != ErrUnknownCredentials {
+		t.Errorf("expected ErrUnknownCredentials for opaque token, got %v", err)
+	}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	issuer := newTestIssuer(t)
+	key1 := generateEC(t, elliptic.P256())
+	issuer.addKey("key1", key1)
+	ja := newTestAuthenticator(t, issuer)
+	authenticate := func(kid string, key crypto.Signer) error {
+		token := signToken(t, map[string]string{"alg": "ES256", "kid": kid}, validClaims(issuer.server.URL), "ES256", key)
+		_, err := ja.Authenticate(context.Background(), token)
+		return err
+	}
+
+	if err := authenticate("key1", key1); err != nil {
+		t.Fatalf("token rejected: %v", err)
+	}
+	if err := authenticate("key1", key1); err != nil {
+		t.Fatalf("token rejected: %v", err)
+	}
+	if calls := issuer.calls(); calls != 1 {
+		t.Fatalf("JWKS fetched %d times, once expected", calls)
+	}
+
+	//key rotation: unknown key triggers a refresh (once the minimum interval has elapsed)
+	key2 := generateEC(t, elliptic.P256())
+	issuer.addKey("key2", key2)
+	if err := authenticate("key2", key2); err == nil {
+		t.Fatalf("token signed by key fetched too early accepted")
+	}
+	if calls := issuer.calls(); calls != 1 {
+		t.Fatalf("JWKS fetched %d times before the minimum refresh interval, once expected", calls)
+	}
+	ja.keys.mu.Lock()
+	ja.keys.fetchedAt = time.Now().Add(-2 * jwksMinRefreshInterval)
+	ja.keys.mu.Unlock()
+	if err := authenticate("key2", key2); err != nil {
+		t.Fatalf("token signed by rotated key rejected: %v", err)
+	}
+	if calls := issuer.calls(); calls != 2 {
+		t.Fatalf("JWKS fetched %d times, twice expected", calls)
+	}
+}
+
+func TestJWKSFetchDoesNotBlockKnownKeys(t *testing.T) {
+	issuer := newTestIssuer(t)
+	key1 := generateRSA(t)
+	issuer.addKey("key1", key1)
+	ja := newTestAuthenticator(t, issuer)
+	token := signToken(t, map[string]string{"alg": "RS256", "kid": "key1"}, validClaims(issuer.server.URL), "RS256", key1)
+	if _, err := ja.Authenticate(context.Background(), token); err != nil {
+		t.Fatalf("token rejected: %v", err)
+	}
+
+	//next fetch of the key set hangs until released
+	release := make(chan struct{})
+	fetching := make(chan struct{})
+	issuer.mu.Lock()
+	issuer.jwksHandle = func() {
+		close(fetching)
+		<-release
+	}
+	issuer.mu.Unlock()
+	ja.keys.mu.Lock()
+	ja.keys.fetchedAt = time.Time{}
+	ja.keys.mu.Unlock()
+
+	unknownDone := make(chan error)
+	go func() {
+		unknown := signToken(t, map[string]string{"alg": "RS256", "kid": "unknown"}, validClaims(issuer.server.URL), "RS256", key1)
+		_, err := ja.Authenticate(context.Background(), unknown)
+		unknownDone <- err
+	}()
+	<-fetching
+
+	knownDone := make(chan error)
+	go func() {
+		_, err := ja.Authenticate(context.Background(), token)
+		knownDone <- err
+	}()
+	select {
+	case err := <-knownDone:
+		if err != nil {
+			t.Errorf("token rejected: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("token signed by known key blocked by the fetch of the key set")
+	}
+
+	//requests waiting for the fetch in progress are canceled with their context
+	ctx, cancel := context.WithCancel(context.Background())
+	waitingDone := make(chan error)
+	go func() {
+		other := signToken(t, map[string]string{"alg": "RS256", "kid": "other"}, validClaims(issuer.server.URL), "RS256", key1)
+		_, err := ja.Authenticate(ctx, other)
+		waitingDone <- err
+	}()
+	cancel()
+	if err := <-waitingDone; err != context.Canceled {
+		t.Errorf("expected context.Canceled while waiting for the fetch, got %v", err)
+	}
+
+	close(release)
+	if err := <-unknownDone; err == nil {
+		t.Errorf("token signed by unknown key accepted")
+	}
+	if calls := issuer.calls(); calls != 2 {
+		t.Errorf("JWKS fetched %d times, twice expected", calls)
+	}
+}
+
+func TestJWKSDiscoveryFailure(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	ja, err := NewJWTAuthenticator(JWTOptions{Issuer: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signToken(t, map[string]string{"alg": "RS256", "kid": "key"}, validClaims(server.URL), "RS256", generateRSA(t))
+	if _, err := ja.Authenticate(context.Background(), token); err == nil || !strings.Contains(err.Error(), "discover") {
+		t.Errorf("expected discovery error, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+//TokenAuthenticator accepts static API tokens listed in a file
+type TokenAuthenticator struct {
+	//identities by SHA-256 digest of their token
+	identities map[[sha256.Size]byte]*Identity
+}
+
+/*
+Load tokens file, in which each line specifies a token, its owner and optional roles:
+
+	<token> <subject> [role1,role2]
+
+Token may be specified by its SHA-256 hex digest, prefixed by "sha256:", to avoid storing it in clear.
+Empty lines and lines starting with '#' are ignored.
+*/
+func NewTokenAuthenticator(tokensFile string) (*TokenAuthenticator, error) {
+	file, err := os.Open(tokensFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read tokens file: %w", err)
+	}
+	defer file.Close()
+
+	ta := &TokenAuthenticator{identities: make(map[[sha256.Size]byte]*Identity)}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid tokens file '%s', line %d: '<token> <subject> [roles]' expected", tokensFile, lineNum)
+		}
+
+		var digest [sha256.Size]byte
+		if hexDigest := strings.TrimPrefix(fields[0], "sha256:"); hexDigest != fields[0] {
+			decoded, err := hex.DecodeString(hexDigest)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("invalid tokens file '%s', line %d: invalid SHA-256 digest", tokensFile, lineNum)
+			}
+			copy(digest[:], decoded)
+		} else {
+			digest = sha256.Sum256([]byte(fields[0]))
+		}
+
+		id := &Identity{Subject: fields[1], Method: "token"}
+		if len(fields) == 3 {
+			id.Roles = strings.Split(fields[2], ",")
+		}
+		ta.identities[digest] = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read tokens file: %w", err)
+	}
+	return ta, nil
+}
+
+func (ta *TokenAuthenticator) Scheme() string {
+	return "Bearer"
+}
+
+func (ta *TokenAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	digest := sha256.Sum256([]byte(token))
+	//constant time comparison, not to leak how much of a digest is matched
+	var found *Identity
+	for known, id := range ta.identities {
+		if subtle.ConstantTimeCompare(known[:], digest[:]) == 1 {
+			found = id
+		}
+	}
+	if found == nil {
+		return nil, ErrUnknownCredentials
+	}
+	return found, nil
+}
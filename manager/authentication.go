@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"rikencau/abart-manager/auth"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Authentication of API callers
+
+Any combination of the following methods may be enabled:
+	- static API tokens listed in a file, passed as "Authorization: Bearer <token>"
+	- HTTP basic authentication of users listed in a file with bcrypt hashed passwords
+	- OIDC/JWT bearer tokens, validated against the JWKS of the configured issuer
+
+Websocket endpoints also accept the bearer token as "access_token" query parameter,
+since browsers can not set headers of websocket handshake requests.
+When no method is enabled, the API is open to anyone who can reach it.
+
+Each task is only accessible to the user who created it, and to users having the admin role.
+*/
+type AuthConfig struct {
+	//static API tokens file (see auth.NewTokenAuthenticator)
+	TokensFile string `yaml:"tokens_file,omitempty"`
+	//users file with bcrypt hashed passwords (see auth.NewBasicAuthenticator)
+	UsersFile string    `yaml:"users_file,omitempty"`
+	JWT       JWTConfig `yaml:"jwt,omitempty"`
+	//role granting access to the tasks of all users
+	AdminRole string `yaml:"admin_role"`
+}
+
+//JWTConfig specifies the accepted JWT issuer (disabled if issuer is empty)
+type JWTConfig struct {
+	Issuer   string `yaml:"issuer,omitempty"`
+	Audience string `yaml:"audience,omitempty"`
+	//JWKS location, discovered from issuer's OpenID configuration if empty
+	JWKSURL      string        `yaml:"jwks_url,omitempty"`
+	SubjectClaim string        `yaml:"subject_claim,omitempty"`
+	RolesClaim   string        `yaml:"roles_claim,omitempty"`
+	Leeway       time.Duration `yaml:"leeway,omitempty"`
+}
+
+func (ac AuthConfig) enabled() bool {
+	return ac.TokensFile != "" || ac.UsersFile != "" || ac.JWT.Issuer != ""
+}
+
+//middleware authenticating API callers (nil when authentication is disabled)
+func newAuthMiddleware(ac AuthConfig) (*auth.Middleware, error) {
+	if !ac.enabled() {
+		return nil, nil
+	}
+
+	authenticators := []auth.Authenticator{}
+	if ac.TokensFile != "" {
+		ta, err := auth.NewTokenAuthenticator(ac.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, ta)
+	}
+	if ac.JWT.Issuer != "" {
+		ja, err := auth.NewJWTAuthenticator(auth.JWTOptions{
+			Issuer:       ac.JWT.Issuer,
+			Audience:     ac.JWT.Audience,
+			JWKSURL:      ac.JWT.JWKSURL,
+			SubjectClaim: ac.JWT.SubjectClaim,
+			RolesClaim:   ac.JWT.RolesClaim,
+			Leeway:       ac.JWT.Leeway,
+		})
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, ja)
+	}
+	if ac.UsersFile != "" {
+		ba, err := auth.NewBasicAuthenticator(ac.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, ba)
+	}
+	if ac.AdminRole == "" {
+		return nil, fmt.Errorf("admin role must not be empty")
+	}
+	if ac.JWT.Leeway < 0 {
+		return nil, fmt.Errorf("invalid JWT leeway %v", ac.JWT.Leeway)
+	}
+	return auth.NewMiddleware("abart", authenticators...), nil
+}
@@ -0,0 +1,237 @@
+//Package colortable reads color tables in 3D Slicer format (.ctbl, .txt), mapping label values to names and colors
+package colortable
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//NoParent is the parent of entries at the root of the hierarchy (or when no hierarchy has been loaded)
+const NoParent = -1
+
+//Entry associates a label value with its name and display color
+type Entry struct {
+	Id    int
+	Name  string
+	Color color.RGBA
+	//label of the enclosing region, NoParent if none
+	Parent int
+}
+
+type Table struct {
+	Entries []Entry
+	index   map[int]int
+	//whether a hierarchy of regions has been loaded
+	hierarchy bool
+}
+
+//Read the color table from a file
+func Read(filePath string) (*Table, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+/*
+Parse a color table, made of lines such as:
+
+	# comment
+	<id> <name> <red> <green> <blue> <alpha>
+
+where color components range from 0 to 255.
+*/
+func Parse(r io.Reader) (*Table, error) {
+	table := &Table{index: make(map[int]int)}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("line %d: expected id, name and RGBA components", lineNum)
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid id '%s'", lineNum, fields[0])
+		}
+		var rgba [4]uint8
+		for c, field := range fields[len(fields)-4:] {
+			value, err := strconv.ParseUint(field, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid color component '%s'", lineNum, field)
+			}
+			rgba[c] = uint8(value)
+		}
+		if _, exists := table.index[id]; exists {
+			return nil, fmt.Errorf("line %d: duplicate id %d", lineNum, id)
+		}
+		table.index[id] = len(table.Entries)
+		table.Entries = append(table.Entries, Entry{
+			Id:     id,
+			Name:   strings.Join(fields[1:len(fields)-4], " "),
+			Color:  color.RGBA{rgba[0], rgba[1], rgba[2], rgba[3]},
+			Parent: NoParent,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+//entry of the label value
+func (t *Table) Lookup(id int) (Entry, bool) {
+	i, ok := t.index[id]
+	if !ok {
+		return Entry{}, false
+	}
+	return t.Entries[i], true
+}
+
+//Read the hierarchy of regions from a file (see ParseHierarchy)
+func (t *Table) ReadHierarchy(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return t.ParseHierarchy(file)
+}
+
+/*
+ParseHierarchy sets the parent of entries, from lines such as:
+
+	# comment
+	<id> <parent id>
+
+where both labels must be entries of the table, and regions not listed remain at the root.
+*/
+func (t *Table) ParseHierarchy(r io.Reader) error {
+	parents := make(map[int]int)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected id and parent id", lineNum)
+		}
+		var ids [2]int
+		for i, field := range fields {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid id '%s'", lineNum, field)
+			}
+			if _, ok := t.index[id]; !ok {
+				return fmt.Errorf("line %d: unknown id %d", lineNum, id)
+			}
+			ids[i] = id
+		}
+		if _, exists := parents[ids[0]]; exists {
+			return fmt.Errorf("line %d: duplicate id %d", lineNum, ids[0])
+		}
+		parents[ids[0]] = ids[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	//hierarchy must be a tree
+	for id := range parents {
+		seen := map[int]bool{id: true}
+		for parent, ok := parents[id]; ok; parent, ok = parents[parent] {
+			if seen[parent] {
+				return fmt.Errorf("cycle in hierarchy through id %d", id)
+			}
+			seen[parent] = true
+		}
+	}
+	for id, parent := range parents {
+		t.Entries[t.index[id]].Parent = parent
+	}
+	t.hierarchy = true
+	return nil
+}
+
+//whether a hierarchy of regions has been loaded
+func (t *Table) HasHierarchy() bool {
+	return t.hierarchy
+}
+
+//labels of the enclosing regions of the entry, from the root
+func (t *Table) Ancestors(id int) []int {
+	var ancestors []int
+	for entry, ok := t.Lookup(id); ok && entry.Parent != NoParent; entry, ok = t.Lookup(entry.Parent) {
+		ancestors = append([]int{entry.Parent}, ancestors...)
+	}
+	return ancestors
+}
+
+//lower case words of a name, underscores and dashes being separators as in "Left_Hippocampus"
+func nameWords(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == '_' || r == '-' || r == ' ' || r == '\t'
+	})
+}
+
+/*
+Search entries whose name contains every word of the query (case insensitive).
+Entries matching the query as a word prefix come first, then entries are in the order of the table.
+*/
+func (t *Table) Search(query string) []Entry {
+	queryWords := nameWords(query)
+	if len(queryWords) == 0 {
+		return nil
+	}
+	type match struct {
+		entry  Entry
+		prefix bool
+	}
+	var matches []match
+	for _, entry := range t.Entries {
+		words := nameWords(entry.Name)
+		joined := strings.Join(words, " ")
+		found := true
+		for _, queryWord := range queryWords {
+			if !strings.Contains(joined, queryWord) {
+				found = false
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		prefix := false
+		for _, word := range words {
+			if strings.HasPrefix(word, queryWords[0]) {
+				prefix = true
+				break
+			}
+		}
+		matches = append(matches, match{entry, prefix})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].prefix && !matches[j].prefix
+	})
+	entries := make([]Entry, len(matches))
+	for i, m := range matches {
+		entries[i] = m.entry
+	}
+	return entries
+}
@@ -0,0 +1,170 @@
+package colortable
+
+import (
+	"image/color"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTable = `# Color table file sp2_label_512_3dslicer_v1.0.0.ctbl
+# 6 values
+0 background 0 0 0 0
+1 Forebrain 10 20 30 255
+2 Left_Hippocampus 40 50 60 255
+3 Right_Hippocampus 70 80 90 255
+
+10 Hippocampal formation (HF) 100 110 120 128
+11 Dentate-gyrus 1 2 3 255
+`
+
+func parseTestTable(t *testing.T) *Table {
+	table, err := Parse(strings.NewReader(testTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestParse(t *testing.T) {
+	table := parseTestTable(t)
+	if len(table.Entries) != 6 {
+		t.Fatalf("%d entries, 6 expected", len(table.Entries))
+	}
+	tests := []struct {
+		id    int
+		name  string
+		color color.RGBA
+	}{
+		{0, "background", color.RGBA{0, 0, 0, 0}},
+		{2, "Left_Hippocampus", color.RGBA{40, 50, 60, 255}},
+		//names may hold spaces
+		{10, "Hippocampal formation (HF)", color.RGBA{100, 110, 120, 128}},
+	}
+	for _, test := range tests {
+		entry, ok := table.Lookup(test.id)
+		if !ok {
+			t.Errorf("label %d not found", test.id)
+			continue
+		}
+		if entry.Name != test.name || entry.Color != test.color || entry.Parent != NoParent {
+			t.Errorf("label %d: %+v, name '%s' and color %v expected at the root", test.id, entry, test.name, test.color)
+		}
+	}
+	if _, ok := table.Lookup(4); ok {
+		t.Errorf("unknown label found")
+	}
+	if table.HasHierarchy() {
+		t.Errorf("hierarchy reported without being loaded")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		//expected part of the error message
+		err string
+	}{
+		{"duplicate id", "1 a 0 0 0 255\n1 b 0 0 0 255\n", "line 2: duplicate id 1"},
+		{"missing color", "1 a 0 0 0\n", "line 1: expected"},
+		{"invalid id", "x a 0 0 0 255\n", "invalid id"},
+		{"color out of range", "1 a 0 0 256 255\n", "invalid color component '256'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(test.content))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error containing '%s' expected, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestParseHierarchy(t *testing.T) {
+	table := parseTestTable(t)
+	err := table.ParseHierarchy(strings.NewReader("# id parent\n10 1\n2 10\n3 10\n\n11 10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !table.HasHierarchy() {
+		t.Errorf("hierarchy not reported")
+	}
+	parents := map[int]int{0: NoParent, 1: NoParent, 2: 10, 3: 10, 10: 1, 11: 10}
+	for id, parent := range parents {
+		if entry, _ := table.Lookup(id); entry.Parent != parent {
+			t.Errorf("label %d: parent %d, %d expected", id, entry.Parent, parent)
+		}
+	}
+	if ancestors := table.Ancestors(2); !reflect.DeepEqual(ancestors, []int{1, 10}) {
+		t.Errorf("ancestors of label 2: %v, [1 10] expected", ancestors)
+	}
+	if ancestors := table.Ancestors(1); len(ancestors) != 0 {
+		t.Errorf("ancestors of root label: %v", ancestors)
+	}
+}
+
+func TestParseHierarchyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		//expected part of the error message
+		err string
+	}{
+		{"cycle", "2 3\n3 10\n10 2\n", "cycle"},
+		{"self parent", "2 2\n", "cycle"},
+		{"unknown id", "2 42\n", "unknown id 42"},
+		{"duplicate id", "2 10\n2 1\n", "line 2: duplicate id 2"},
+		{"missing parent", "2\n", "expected id and parent id"},
+		{"invalid id", "2 x\n", "invalid id 'x'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := parseTestTable(t)
+			err := table.ParseHierarchy(strings.NewReader(test.content))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error containing '%s' expected, got %v", test.err, err)
+			}
+			//table is left unchanged
+			if table.HasHierarchy() {
+				t.Errorf("invalid hierarchy reported")
+			}
+			for _, entry := range table.Entries {
+				if entry.Parent != NoParent {
+					t.Errorf("label %d got parent %d from invalid hierarchy", entry.Id, entry.Parent)
+				}
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	table := parseTestTable(t)
+	tests := []struct {
+		query string
+		ids   []int
+	}{
+		//word prefix matches first, then in table order
+		{"hippo", []int{2, 3, 10}},
+		{"HIPPOCAMPUS", []int{2, 3}},
+		{"left hippo", []int{2}},
+		{"hippocampus_left", []int{2}},
+		{"campal", []int{10}},
+		{"gyrus", []int{11}},
+		{"dentate gyrus", []int{11}},
+		{"formation", []int{10}},
+		{"cortex", []int{}},
+		{"  ", []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			ids := []int{}
+			for _, entry := range table.Search(test.query) {
+				ids = append(ids, entry.Id)
+			}
+			if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("search '%s': %v, %v expected", test.query, ids, test.ids)
+			}
+		})
+	}
+}
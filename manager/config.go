@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
+
+	"rikencau/abart-manager/dockerhandler"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Manager configuration
+
+Settings are merged from the following sources, each one overriding the previous:
+	- built-in defaults
+	- YAML configuration file, specified by --config flag or ABART_CONFIG environment variable
+	- ABART_* environment variables
+	- command-line flags
+
+The effective configuration is displayed by --print-config flag.
+Invalid values are reported at startup, rather than silently replaced by defaults.
+*/
+type Config struct {
+	//port on which the API is served
+	ListenPort int `yaml:"listen_port"`
+	//base directory holding working directories of tasks
+	BaseWorkDir string `yaml:"base_workdir"`
+	//free space required on the filesystem holding the base working directory to accept tasks (e.g. "5g")
+	MinFreeSpace string `yaml:"min_free_space"`
+	//name of the volume holding the base working directory, mounted in worker containers
+	WorkVolume string `yaml:"work_volume"`
+	//network to which worker containers are connected
+	PrivateNetwork string `yaml:"private_network"`
+	//max number of tasks executed at same time
+	WorkerMaxNum int `yaml:"worker_maxnum"`
+	//maximum wall-clock duration of a task execution (0 means unlimited)
+	TaskTimeout time.Duration `yaml:"task_timeout"`
+	//maximum duration of a single call to the Docker daemon (0 means unlimited)
+	DockerCallTimeout time.Duration `yaml:"docker_call_timeout"`
+
+	Worker WorkerConfig `yaml:"worker"`
+	CORS   CORSConfig   `yaml:"cors"`
+	Auth   AuthConfig   `yaml:"auth"`
+	//per-user limits
+	Quotas QuotaConfig `yaml:"quotas"`
+	Log    LogConfig   `yaml:"log"`
+	//graceful shutdown
+	Shutdown ShutdownConfig `yaml:"shutdown"`
+	//registration quality metrics
+	Quality QualityConfig `yaml:"quality"`
+	//labels of atlases
+	Atlases AtlasesConfig `yaml:"atlases"`
+}
+
+//WorkerConfig gathers settings of worker containers
+type WorkerConfig struct {
+	Image      string                   `yaml:"image"`
+	PullPolicy dockerhandler.PullPolicy `yaml:"pull_policy"`
+	//atlas directory within worker containers (image default if empty)
+	AtlasDir string `yaml:"atlas_dir,omitempty"`
+	//additional read-only mounts, as "source:target"
+	ExtraMounts []string `yaml:"extra_mounts,omitempty"`
+
+	//deployment-wide resource limits and isolation settings
+	Settings WorkerSettings `yaml:",inline"`
+	//named presets, possibly completed by the ones defined in a separate JSON file
+	Presets     map[string]WorkerSettings `yaml:"presets,omitempty"`
+	PresetsFile string                    `yaml:"presets_file,omitempty"`
+}
+
+//effective configuration of the manager, set once at startup
+var config Config
+
+func defaultConfig() Config {
+	return Config{
+		ListenPort:        10000,
+		BaseWorkDir:       "/datawd",
+		MinFreeSpace:      "1g",
+		WorkerMaxNum:      1,
+		TaskTimeout:       0,
+		DockerCallTimeout: 30 * time.Second,
+		Worker: WorkerConfig{
+			PullPolicy: dockerhandler.PullIfNotPresent,
+		},
+		CORS: defaultCORSConfig(),
+		Auth: AuthConfig{
+			AdminRole: "admin",
+		},
+		Log:      defaultLogConfig(),
+		Shutdown: defaultShutdownConfig(),
+	}
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//configOption binds a setting to its environment variable and (optional) command-line flag
+type configOption struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func setString(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setList(field func(c *Config) *[]string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = splitList(value)
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		intValue, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("integer expected")
+		}
+		*field(c) = intValue
+		return nil
+	}
+}
+
+func setBool(field func(c *Config) *bool) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		boolValue, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("boolean expected")
+		}
+		*field(c) = boolValue
+		return nil
+	}
+}
+
+func setDuration(field func(c *Config) *time.Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("duration expected (e.g. \"90s\", \"2h\")")
+		}
+		*field(c) = duration
+		return nil
+	}
+}
+
+var configOptions = []configOption{
+	{"ABART_MGR_LSTN_PORT", "listen-port", "port on which the API is served",
+		setInt(func(c *Config) *int { return &c.ListenPort })},
+	{"ABART_BASE_WORKDIR", "base-workdir", "base directory holding working directories of tasks",
+		setString(func(c *Config) *string { return &c.BaseWorkDir })},
+	{"ABART_MIN_FREE_SPACE", "min-free-space", "free space required in the base working directory to be ready (e.g. 5g)",
+		setString(func(c *Config) *string { return &c.MinFreeSpace })},
+	{"ABART_WORK_VOL", "work-volume", "name of the volume holding the base working directory",
+		setString(func(c *Config) *string { return &c.WorkVolume })},
+	{"ABART_PRIVATE_NET", "private-network", "network to which worker containers are connected",
+		setString(func(c *Config) *string { return &c.PrivateNetwork })},
+	{"ABART_WORKER_MAXNUM", "worker-maxnum", "max number of tasks executed at same time",
+		setInt(func(c *Config) *int { return &c.WorkerMaxNum })},
+	{"ABART_TASK_TIMEOUT", "task-timeout", "maximum duration of a task execution (0 means unlimited)",
+		setDuration(func(c *Config) *time.Duration { return &c.TaskTimeout })},
+	{"ABART_DOCKER_CALL_TIMEOUT", "docker-call-timeout", "maximum duration of a single call to the Docker daemon (0 means unlimited)",
+		setDuration(func(c *Config) *time.Duration { return &c.DockerCallTimeout })},
+
+	{"ABART_WORKER_IMAGE", "worker-image", "worker image reference",
+		setString(func(c *Config) *string { return &c.Worker.Image })},
+	{"ABART_WORKER_PULL_POLICY", "worker-pull-policy", "when the worker image is pulled (always, if-not-present, never)",
+		func(c *Config, value string) error {
+			c.Worker.PullPolicy = dockerhandler.PullPolicy(value)
+			return nil
+		}},
+	{"ABART_WORKER_ATLAS_DIR", "worker-atlas-dir", "atlas directory within worker containers",
+		setString(func(c *Config) *string { return &c.Worker.AtlasDir })},
+	{"ABART_WORKER_EXTRA_MOUNTS", "", "",
+		setList(func(c *Config) *[]string { return &c.Worker.ExtraMounts })},
+	{"ABART_WORKER_PRESETS", "worker-presets", "JSON file defining named worker presets",
+		setString(func(c *Config) *string { return &c.Worker.PresetsFile })},
+
+	{"ABART_WORKER_CPUS", "", "",
+		setString(func(c *Config) *string { return &c.Worker.Settings.Cpus })},
+	{"ABART_WORKER_CPUSET", "", "",
+		setString(func(c *Config) *string { return &c.Worker.Settings.Cpuset })},
+	{"ABART_WORKER_MEMORY", "", "",
+		setString(func(c *Config) *string { return &c.Worker.Settings.Memory })},
+	{"ABART_WORKER_MEMORY_SWAP", "", "",
+		setString(func(c *Config) *string { return &c.Worker.Settings.MemorySwap })},
+	{"ABART_WORKER_ULIMITS", "", "",
+		setList(func(c *Config) *[]string { return &c.Worker.Settings.Ulimits })},
+	{"ABART_WORKER_CAP_DROP", "", "",
+		setList(func(c *Config) *[]string { return &c.Worker.Settings.CapDrop })},
+	{"ABART_WORKER_USER", "", "",
+		setString(func(c *Config) *string { return &c.Worker.Settings.User })},
+	{"ABART_WORKER_THREADS", "", "",
+		setInt(func(c *Config) *int { return &c.Worker.Settings.Threads })},
+	{"ABART_WORKER_PIDS_LIMIT", "", "",
+		func(c *Config, value string) error {
+			pidsLimit, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("integer expected")
+			}
+			c.Worker.Settings.PidsLimit = pidsLimit
+			return nil
+		}},
+	{"ABART_WORKER_READONLY_ROOTFS", "", "",
+		func(c *Config, value string) error {
+			readonly, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("boolean expected")
+			}
+			c.Worker.Settings.ReadonlyRootfs = &readonly
+			return nil
+		}},
+
+	{"ABART_CORS_ALLOWED_ORIGINS", "cors-allowed-origins", "comma separated allowed origins, possibly with wildcard subdomain (e.g. https://*.example.org)",
+		setList(func(c *Config) *[]string { return &c.CORS.AllowedOrigins })},
+	{"ABART_CORS_ALLOWED_HEADERS", "", "",
+		setList(func(c *Config) *[]string { return &c.CORS.AllowedHeaders })},
+	{"ABART_CORS_ALLOW_CREDENTIALS", "cors-allow-credentials", "allow credentials in cross-origin requests (true, false)",
+		setBool(func(c *Config) *bool { return &c.CORS.AllowCredentials })},
+
+	{"ABART_AUTH_TOKENS_FILE", "auth-tokens-file", "file listing static API tokens",
+		setString(func(c *Config) *string { return &c.Auth.TokensFile })},
+	{"ABART_AUTH_USERS_FILE", "auth-users-file", "file listing users with bcrypt hashed passwords",
+		setString(func(c *Config) *string { return &c.Auth.UsersFile })},
+	{"ABART_AUTH_ADMIN_ROLE", "", "",
+		setString(func(c *Config) *string { return &c.Auth.AdminRole })},
+	{"ABART_AUTH_JWT_ISSUER", "auth-jwt-issuer", "issuer of accepted JWT bearer tokens",
+		setString(func(c *Config) *string { return &c.Auth.JWT.Issuer })},
+	{"ABART_AUTH_JWT_AUDIENCE", "", "",
+		setString(func(c *Config) *string { return &c.Auth.JWT.Audience })},
+	{"ABART_AUTH_JWT_JWKS_URL", "", "",
+		setString(func(c *Config) *string { return &c.Auth.JWT.JWKSURL })},
+	{"ABART_AUTH_JWT_ROLES_CLAIM", "", "",
+		setString(func(c *Config) *string { return &c.Auth.JWT.RolesClaim })},
+
+	{"ABART_QUOTA_MAX_RUNNING", "", "",
+		setInt(func(c *Config) *int { return &c.Quotas.MaxRunning })},
+	{"ABART_QUOTA_MAX_QUEUED", "", "",
+		setInt(func(c *Config) *int { return &c.Quotas.MaxQueued })},
+	{"ABART_QUOTA_MAX_SUBMISSIONS_PER_HOUR", "", "",
+		setInt(func(c *Config) *int { return &c.Quotas.MaxSubmissionsPerHour })},
+	{"ABART_QUOTA_MAX_STORED", "", "",
+		setString(func(c *Config) *string { return &c.Quotas.MaxStored })},
+
+	{"ABART_LOG_FORMAT", "log-format", "format of log entries (logfmt, json)",
+		setString(func(c *Config) *string { return &c.Log.Format })},
+	{"ABART_LOG_LEVEL", "log-level", "minimum level of log entries (debug, info, warning, error)",
+		setString(func(c *Config) *string { return &c.Log.Level })},
+	{"ABART_LOG_ACCESS", "log-access", "log every API call (true, false)",
+		setBool(func(c *Config) *bool { return &c.Log.AccessLog })},
+
+	{"ABART_SHUTDOWN_REQUEST_TIMEOUT", "shutdown-request-timeout", "maximum time given to in-flight requests (e.g. uploads) to complete on shutdown",
+		setDuration(func(c *Config) *time.Duration { return &c.Shutdown.RequestTimeout })},
+	{"ABART_SHUTDOWN_TASK_WAIT", "shutdown-task-wait", "maximum time waiting for running tasks to end on shutdown (0 means not waiting)",
+		setDuration(func(c *Config) *time.Duration { return &c.Shutdown.TaskWait })},
+
+	{"ABART_QUALITY_ATLAS_TEMPLATE", "quality-atlas-template", "atlas template volume read by the manager to compute similarity of registered volumes",
+		setString(func(c *Config) *string { return &c.Quality.AtlasTemplate })},
+	{"ABART_QUALITY_ATLAS_BRAIN_MASK", "quality-atlas-brain-mask", "atlas brain mask volume read by the manager to compute quality metrics",
+		setString(func(c *Config) *string { return &c.Quality.AtlasBrainMask })},
+
+	{"ABART_ATLAS_LABELS_DIR", "atlas-labels-dir", "directory holding color tables of atlases (<atlas>.ctbl), read by the manager",
+		setString(func(c *Config) *string { return &c.Atlases.LabelsDir })},
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//load configuration from all sources; printOnly is set when only the effective configuration must be displayed
+func loadConfig(args []string) (cfg Config, printOnly bool, err error) {
+	cfg = defaultConfig()
+
+	flags := flag.NewFlagSet("abart-manager", flag.ContinueOnError)
+	configFile := flags.String("config", strings.TrimSpace(os.Getenv("ABART_CONFIG")), "YAML configuration file (ABART_CONFIG)")
+	flags.BoolVar(&printOnly, "print-config", false, "print effective configuration and exit")
+	flagValues := make(map[string]*string)
+	for _, opt := range configOptions {
+		if opt.flag != "" {
+			flagValues[opt.flag] = flags.String(opt.flag, "", fmt.Sprintf("%s (%s)", opt.usage, opt.env))
+		}
+	}
+	if err = flags.Parse(args); err != nil {
+		return cfg, false, err
+	}
+
+	if *configFile != "" {
+		if err = cfg.loadFile(*configFile); err != nil {
+			return cfg, printOnly, err
+		}
+	}
+
+	for _, opt := range configOptions {
+		if value := strings.TrimSpace(os.Getenv(opt.env)); value != "" {
+			if err := opt.set(&cfg, value); err != nil {
+				return cfg, printOnly, fmt.Errorf("invalid specified %s: '%s' (%v)", opt.env, value, err)
+			}
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		for _, opt := range configOptions {
+			if err == nil && opt.flag == f.Name {
+				value := strings.TrimSpace(*flagValues[opt.flag])
+				if setErr := opt.set(&cfg, value); setErr != nil {
+					err = fmt.Errorf("invalid specified --%s: '%s' (%v)", opt.flag, value, setErr)
+				}
+			}
+		}
+	})
+	return cfg, printOnly, err
+}
+
+func (c *Config) loadFile(configFile string) error {
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("could not read configuration file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	//typos must not go unnoticed
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("invalid configuration file '%s': %w", configFile, err)
+	}
+	return nil
+}
+
+//check all settings, and normalize them; all the invalid ones are reported at once
+func (c *Config) validate() error {
+	problems := []string{}
+	addProblem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if c.ListenPort <= 0 || c.ListenPort > 65535 {
+		addProblem("listen_port: %d is not a valid port number", c.ListenPort)
+	}
+	if !dirExists(c.BaseWorkDir) {
+		addProblem("base_workdir: '%s' is not an existing directory", c.BaseWorkDir)
+	}
+	if _, err := c.minFreeSpaceBytes(); err != nil {
+		addProblem("min_free_space: %v", err)
+	}
+	if c.WorkVolume == "" {
+		addProblem("work_volume: not specified")
+	}
+	if c.PrivateNetwork == "" {
+		addProblem("private_network: not specified")
+	}
+	if c.WorkerMaxNum < 1 {
+		addProblem("worker_maxnum: %d, at least 1 expected", c.WorkerMaxNum)
+	}
+	if c.TaskTimeout < 0 {
+		addProblem("task_timeout: %v must not be negative", c.TaskTimeout)
+	}
+	if c.DockerCallTimeout < 0 {
+		addProblem("docker_call_timeout: %v must not be negative", c.DockerCallTimeout)
+	}
+
+	if strings.TrimSpace(c.Worker.Image) == "" {
+		addProblem("worker.image: not specified")
+	}
+	if pullPolicy, err := dockerhandler.ParsePullPolicy(string(c.Worker.PullPolicy)); err != nil {
+		addProblem("worker.pull_policy: %v", err)
+	} else {
+		c.Worker.PullPolicy = pullPolicy
+	}
+	if _, err := c.Worker.atlasDir(); err != nil {
+		addProblem("worker.atlas_dir: %v", err)
+	}
+	if _, err := c.Worker.extraMounts(); err != nil {
+		addProblem("worker.extra_mounts: %v", err)
+	}
+	if _, err := initWorkerProfiles(c.Worker); err != nil {
+		addProblem("worker: %v", err)
+	}
+
+	if _, err := newOriginPolicy(c.CORS); err != nil {
+		addProblem("cors: %v", err)
+	}
+
+	if _, err := newAuthMiddleware(c.Auth); err != nil {
+		addProblem("auth: %v", err)
+	}
+
+	if err := c.Quotas.validate(); err != nil {
+		addProblem("quotas: %v", err)
+	}
+
+	if err := c.Log.validate(); err != nil {
+		addProblem("log: %v", err)
+	}
+
+	if c.Shutdown.RequestTimeout < 0 || c.Shutdown.TaskWait < 0 {
+		addProblem("shutdown: durations must not be negative")
+	}
+
+	if err := c.Quality.validate(); err != nil {
+		addProblem("quality: %v", err)
+	}
+
+	if err := c.Atlases.validate(); err != nil {
+		addProblem("atlases: %v", err)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+func (c *Config) minFreeSpaceBytes() (int64, error) {
+	if c.MinFreeSpace == "" {
+		return 0, nil
+	}
+	minFreeSpace, err := units.RAMInBytes(c.MinFreeSpace)
+	if err != nil || minFreeSpace < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", c.MinFreeSpace)
+	}
+	return minFreeSpace, nil
+}
+
+func (c *Config) marshal() (string, error) {
+	content, err := yaml.Marshal(c)
+	return string(content), err
+}
+
+func (c *Config) print() error {
+	content, err := c.marshal()
+	if err != nil {
+		return err
+	}
+	fmt.Print(content)
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/handlers"
+	log "github.com/sirupsen/logrus"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Cross-origin policy, applied to both REST and websocket endpoints
+
+Allowed origins are specified as:
+	- exact origins, e.g. "https://abart.example.org" or "http://localhost:9000"
+	- wildcard subdomain patterns, e.g. "https://*.example.org" (matching any subdomain, but not "example.org" itself)
+	- "*" to allow any origin (not allowed along with credentials)
+
+Requests without Origin header (i.e. not issued by a browser), and same-origin requests
+(e.g. UI served behind the same reverse proxy) are not subject to the policy. Same origin means same scheme and host,
+the scheme being the one reported by the reverse proxy (X-Forwarded-Proto) if any.
+*/
+type CORSConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	//request headers allowed in addition to the ones required by the API
+	AllowedHeaders []string `yaml:"allowed_headers,omitempty"`
+	//allow credentials (cookies, authorization headers) to go through
+	AllowCredentials bool `yaml:"allow_credentials"`
+	//how long browsers may cache preflight responses
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func defaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		//origin when debugging or when running in Desktop mode
+		AllowedOrigins:   []string{"http://localhost:9000", "http://localhost:9090"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	}
+}
+
+//request headers required by the API
+var apiRequestHeaders = []string{"content-type", "authorization", ApiVersionHeader, requestIdHeader,
+	//resumed and conditional downloads
+	"range", "if-range", "if-none-match", "if-modified-since"}
+
+type originPattern struct {
+	scheme string
+	//exact host name, or domain suffix (starting with ".") when wildcard
+	host     string
+	wildcard bool
+	port     string
+}
+
+func parseOriginPattern(pattern string) (originPattern, error) {
+	invalid := fmt.Errorf("invalid origin '%s' (expected 'scheme://host[:port]', host possibly starting with '*.')", pattern)
+
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(pattern)), "://", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(parts[1], "/?#@") {
+		return originPattern{}, invalid
+	}
+	op := originPattern{scheme: parts[0], host: parts[1]}
+	if i := strings.LastIndex(op.host, ":"); i >= 0 && !strings.HasSuffix(op.host, "]") {
+		op.host, op.port = op.host[:i], op.host[i+1:]
+		if op.port == "" {
+			return originPattern{}, invalid
+		}
+	}
+	if strings.HasPrefix(op.host, "*.") {
+		op.wildcard = true
+		op.host = op.host[1:]
+	}
+	if op.host == "" || op.host == "." || strings.Contains(op.host, "*") {
+		return originPattern{}, invalid
+	}
+	return op, nil
+}
+
+func (op originPattern) matches(origin *url.URL) bool {
+	if strings.ToLower(origin.Scheme) != op.scheme || origin.Port() != op.port {
+		return false
+	}
+	host := strings.ToLower(origin.Hostname())
+	if op.wildcard {
+		return strings.HasSuffix(host, op.host) && len(host) > len(op.host)
+	}
+	return host == op.host
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//OriginPolicy decides which cross-origin requests are accepted
+type OriginPolicy struct {
+	config    CORSConfig
+	anyOrigin bool
+	patterns  []originPattern
+}
+
+func newOriginPolicy(cfg CORSConfig) (*OriginPolicy, error) {
+	policy := &OriginPolicy{config: cfg}
+	for _, origin := range cfg.AllowedOrigins {
+		if strings.TrimSpace(origin) == "*" {
+			policy.anyOrigin = true
+			continue
+		}
+		pattern, err := parseOriginPattern(origin)
+		if err != nil {
+			return nil, err
+		}
+		policy.patterns = append(policy.patterns, pattern)
+	}
+	if policy.anyOrigin && cfg.AllowCredentials {
+		return nil, fmt.Errorf("any origin ('*') can not be allowed along with credentials")
+	}
+	if cfg.MaxAge < 0 {
+		return nil, fmt.Errorf("invalid max age %v", cfg.MaxAge)
+	}
+	return policy, nil
+}
+
+func (policy *OriginPolicy) isAllowed(origin string) bool {
+	if policy.anyOrigin {
+		return true
+	}
+	originUrl, err := url.Parse(origin)
+	if err != nil || originUrl.Host == "" {
+		return false
+	}
+	for _, pattern := range policy.patterns {
+		if pattern.matches(originUrl) {
+			return true
+		}
+	}
+	return false
+}
+
+//scheme used by the client to reach the manager, possibly through a reverse proxy terminating TLS
+//(browsers can not set X-Forwarded-Proto themselves, it is not a CORS-safelisted header)
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		//proxies of a chain append their own, the first one is the one the client connected to
+		return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func isSameOrigin(origin string, r *http.Request) bool {
+	originUrl, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(originUrl.Scheme, requestScheme(r)) && strings.EqualFold(originUrl.Host, r.Host)
+}
+
+//check origin of the request, logging rejected ones
+func (policy *OriginPolicy) checkOrigin(origin string, r *http.Request) bool {
+	if isSameOrigin(origin, r) || policy.isAllowed(origin) {
+		return true
+	}
+	requestLogger(r).WithFields(log.Fields{"origin": origin, "method": r.Method, "path": r.URL.Path}).Warn("Rejected request from origin")
+	return false
+}
+
+//origin check of websocket upgrade requests
+func (policy *OriginPolicy) checkWebsocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	return policy.checkOrigin(origin, r)
+}
+
+//middleware handling CORS headers and preflight requests
+func (policy *OriginPolicy) corsHandler() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		options := []handlers.CORSOption{
+			handlers.AllowedHeaders(append(append([]string{}, apiRequestHeaders...), policy.config.AllowedHeaders...)),
+			handlers.ExposedHeaders([]string{ApiVersionHeader, requestIdHeader,
+				//downloads
+				"Content-Disposition", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"}),
+
+			//all methods
+			handlers.AllowedMethods([]string{
+				http.MethodHead,
+				http.MethodGet,
+				http.MethodPost,
+				http.MethodPut,
+				http.MethodPatch,
+				http.MethodDelete,
+			}),
+
+			//browser may cache the Options reponse (expressed in seconds)
+			handlers.MaxAge(int(policy.config.MaxAge / time.Second)),
+		}
+		if policy.config.AllowCredentials {
+			//allowing Credentials (Cookies) to go through
+			options = append(options, handlers.AllowCredentials())
+		}
+
+		options = append(options, handlers.AllowedOriginValidator(policy.isAllowed))
+		corsHnd := handlers.CORS(options...)(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			//rejected requests are only logged here, CORS headers being simply omitted by the CORS handler
+			if origin := r.Header.Get("Origin"); origin != "" {
+				policy.checkOrigin(origin, r)
+			}
+			corsHnd.ServeHTTP(w, r)
+		})
+	}
+}
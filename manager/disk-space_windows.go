@@ -0,0 +1,6 @@
+package main
+
+//free (for unprivileged users) and total bytes of the filesystem holding the directory
+func getDiskSpace(dir string) (free uint64, total uint64, err error) {
+	return 0, 0, errDiskSpaceUnsupported
+}
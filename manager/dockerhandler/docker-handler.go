@@ -1,207 +1,470 @@
 package dockerhandler
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	log "github.com/sirupsen/logrus"
 )
 
-func FollowContainerLogs(
-	containerRef string,
-) io.ReadCloser {
-	fmt.Println("enter FollowContainerLogs : ", containerRef)
+//grace period given to a container to stop before it is killed
+const stopTimeout = 10 * time.Second
+
+//longer lines of worker output are not logged
+const maxOutputLineSize = 1024 * 1024
+
+//CallObserver is notified of each call to the Docker daemon (e.g. for monitoring);
+//failed is not set for "not found" errors, which are expected in some situations
+type CallObserver func(operation string, duration time.Duration, failed bool)
 
-	ctx := context.Background()
+//Handler holds a long-lived Docker client shared by all tasks
+type Handler struct {
+	cli *client.Client
+	//maximum duration of a single (non-streaming) call to the Docker daemon
+	callTimeout time.Duration
+	observer    CallObserver
+}
 
+func NewHandler(callTimeout time.Duration) (*Handler, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("could not connect to Docker daemon: %w", err)
+	}
+	return &Handler{
+		cli:         cli,
+		callTimeout: callTimeout,
+	}, nil
+}
+
+func (h *Handler) Close() error {
+	return h.cli.Close()
+}
+
+//check that the Docker daemon is reachable
+func (h *Handler) Ping(ctx context.Context) error {
+	callCtx, cancel := h.callContext(ctx)
+	defer cancel()
+	start := time.Now()
+	_, err := h.cli.Ping(callCtx)
+	h.observe("ping", start, err)
+	if err != nil {
+		return fmt.Errorf("Docker daemon is not reachable: %w", err)
+	}
+	return nil
+}
+
+//check that the network exists
+func (h *Handler) CheckNetwork(ctx context.Context, networkName string) error {
+	callCtx, cancel := h.callContext(ctx)
+	defer cancel()
+	start := time.Now()
+	_, err := h.cli.NetworkInspect(callCtx, networkName, types.NetworkInspectOptions{})
+	h.observe("network_inspect", start, err)
+	if err != nil {
+		return fmt.Errorf("could not inspect network '%s': %w", networkName, err)
+	}
+	return nil
+}
+
+//must be set before the handler is used
+func (h *Handler) SetCallObserver(observer CallObserver) {
+	h.observer = observer
+}
+
+//notify observer of a call started at the given time
+func (h *Handler) observe(operation string, start time.Time, err error) {
+	if h.observer != nil {
+		h.observer(operation, time.Since(start), err != nil && !client.IsErrNotFound(err))
+	}
+}
+
+//derive a context bounding a single call to the Docker daemon
+func (h *Handler) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if h.callTimeout > 0 {
+		return context.WithTimeout(ctx, h.callTimeout)
 	}
-	rc, err := cli.ContainerLogs(ctx, containerRef,
+	return context.WithCancel(ctx)
+}
+
+//follow logs of the container until it stops or the context is canceled
+func (h *Handler) FollowContainerLogs(
+	ctx context.Context,
+	containerRef string,
+) (io.ReadCloser, error) {
+	loggerFrom(ctx).WithField("container", containerRef).Debug("Following container logs")
+
+	start := time.Now()
+	rc, err := h.cli.ContainerLogs(ctx, containerRef,
 		types.ContainerLogsOptions{
 			Follow:     true,
 			ShowStdout: true,
 			ShowStderr: true,
 		})
+	h.observe("container_logs", start, err)
 	if err != nil {
-		fmt.Println("Couldn't obtain container logs, error : ", err)
-		return nil
+		return nil, fmt.Errorf("could not obtain logs of container %s: %w", containerRef, err)
 	} else {
 
-		return rc
+		return rc, nil
 	}
 }
 
 //should be called before ContainerStart() to be able to read streams from beginning
-func AttachContainerAndStream(
+func (h *Handler) AttachContainerAndStream(
+	ctx context.Context,
 	containerRef string,
-) {
-	fmt.Println("enter AttachContainerAndStream : ", containerRef)
+) error {
+	logger := loggerFrom(ctx).WithField("container", containerRef)
+	logger.Debug("Attaching to container")
 
-	ctx := context.Background()
-
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		panic(err)
-	}
-	resp, err := cli.ContainerAttach(ctx, containerRef,
+	start := time.Now()
+	resp, err := h.cli.ContainerAttach(ctx, containerRef,
 		types.ContainerAttachOptions{
 			Stream: true,
 			Stdout: true,
 			Stderr: true,
 		})
+	h.observe("container_attach", start, err)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("could not attach to container %s: %w", containerRef, err)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		_, err := io.Copy(os.Stdout, resp.Reader)
-		if err == nil {
-			fmt.Println("Stream reading finished in error : ", err)
-		}
-	}()
 	go func() {
-		defer wg.Done()
-		_, err := io.Copy(os.Stderr, resp.Reader)
-		if err == nil {
-			fmt.Println("Stream reading finished in error : ", err)
-		}
-	}()
-
-	go func() {
-		//wait for both streams to be closed before closing attach response
-
-
 		//FIXME gracefully close the logs socket, but it is not handled by the websocket lib
 		//https://github.com/gorilla/websocket/issues/448
 
 		defer resp.Close()
-		wg.Wait()
-		fmt.Println("end of streams : ", containerRef)
+		//container has a TTY, hence stdout and stderr are merged in a single stream, logged line by line
+		scanner := bufio.NewScanner(resp.Reader)
+		scanner.Buffer(make([]byte, 64*1024), maxOutputLineSize)
+		for scanner.Scan() {
+			logger.WithField("stream", "worker").Info(strings.TrimRight(scanner.Text(), "\r"))
+		}
+		if err := scanner.Err(); err != nil {
+			logger.WithError(err).Warn("Reading of worker output ended in error")
+		}
+		logger.Debug("End of worker output")
 	}()
 
+	return nil
 }
 
-func RunContainer(
-	imageName string,
-	volumeName string,
-	networkName string,
-	workingDirBasePath string,
-	workingDir string,
-	containerName string,
-	onStarted func(),
-) {
-	ctx := context.Background()
+//WorkerLimits gathers resource constraints and isolation settings applied to a worker container
+type WorkerLimits struct {
+	//CPU quota in units of 10^-9 CPUs (0 means unlimited)
+	NanoCPUs int64
+	//CPUs in which execution is allowed (e.g. "0-3", "0,1"; empty means any)
+	CpusetCpus string
+	//memory limit in bytes (0 means unlimited)
+	Memory int64
+	//total memory + swap limit in bytes (0 means twice the memory limit, -1 means unlimited swap)
+	MemorySwap int64
+	//max number of processes in the container (0 means unlimited)
+	PidsLimit int64
+	Ulimits   []*units.Ulimit
+	//mount container root filesystem read-only (a tmpfs is then provided for /tmp)
+	ReadonlyRootfs bool
+	//kernel capabilities removed from the container (e.g. "ALL")
+	CapDrop []string
+	//user (and optionally group) the worker process runs as, e.g. "1000:1000" (empty means image default)
+	User string
+}
 
-	fmt.Println("imageName : ", imageName)
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		panic(err)
-	}
-	//fmt.Println("client : ", cli)
+//Mount describes an extra read-only mount of the worker container
+type Mount struct {
+	//volume name or host absolute path
+	Source string
+	//absolute path within the container
+	Target string
+}
 
-	//check if image exists in Docker daemon repository
-	histResp, err := cli.ImageHistory(ctx, imageName)
-	if err != nil {
-		fmt.Println("Err image : ", err)
+//WorkerSpec describes the worker container to be run for a task
+type WorkerSpec struct {
+	//preferably pinned reference of the image (see ImageInfo.Pinned)
+	ImageName          string
+	VolumeName         string
+	NetworkName        string
+	WorkingDirBasePath string
+	WorkingDir         string
+	ContainerName      string
+	Limits             WorkerLimits
+	//environment variables ("NAME=value")
+	Env []string
+	//additional read-only mounts (e.g. shared atlas directory)
+	ExtraMounts []Mount
+}
+
+//returned (wrapped) by RunContainer when the worker was killed by the kernel for exceeding its memory limit
+var ErrOOMKilled = errors.New("worker container ran out of memory")
+
+func (spec *WorkerSpec) hostConfig() *container.HostConfig {
+	//volume binding
+	binds := []string{strings.Join([]string{spec.VolumeName, spec.WorkingDirBasePath, "rw"}, ":")}
+	for _, mount := range spec.ExtraMounts {
+		binds = append(binds, strings.Join([]string{mount.Source, mount.Target, "ro"}, ":"))
 	}
 
-	fmt.Println("Image History : ", histResp)
+	hostConfig := &container.HostConfig{
+		Binds: binds,
+		//container is not auto-removed, since its state must be inspected after it exits
+		AutoRemove: false,
 
-	//task ID passed as environment variable
-	newEnv := []string{
-		//"TaskID=" + taskID,
+		Resources: container.Resources{
+			NanoCPUs:   spec.Limits.NanoCPUs,
+			CpusetCpus: spec.Limits.CpusetCpus,
+			Memory:     spec.Limits.Memory,
+			MemorySwap: spec.Limits.MemorySwap,
+			Ulimits:    spec.Limits.Ulimits,
+		},
+		ReadonlyRootfs: spec.Limits.ReadonlyRootfs,
+		CapDrop:        spec.Limits.CapDrop,
+	}
+	if spec.Limits.PidsLimit > 0 {
+		pidsLimit := spec.Limits.PidsLimit
+		hostConfig.Resources.PidsLimit = &pidsLimit
 	}
+	if spec.Limits.ReadonlyRootfs {
+		//scratch space for temporary files
+		hostConfig.Tmpfs = map[string]string{"/tmp": "rw,exec"}
+	}
+	return hostConfig
+}
+
+//Create and start the worker container, then wait for it to stop.
+//If the context is canceled or its deadline exceeded while the container is running,
+//the container is stopped and the context error is returned (wrapped).
+func (h *Handler) RunContainer(
+	ctx context.Context,
+	spec WorkerSpec,
+	onStarted func(),
+) error {
+	logger := loggerFrom(ctx).WithField("container", spec.ContainerName)
+	//image is expected to have been checked beforehand (see EnsureImage)
+	logger.WithField("image", spec.ImageName).Debug("Creating worker container")
 
 	//create container
-	resp, err := cli.ContainerCreate(
-		ctx,
+	callCtx, cancel := h.callContext(ctx)
+	start := time.Now()
+	resp, err := h.cli.ContainerCreate(
+		callCtx,
 		&container.Config{
-			Image:        imageName,
+			Image:        spec.ImageName,
 			AttachStderr: true,
 			Tty:          true,
 			AttachStdout: true,
-			Env:          newEnv,
-			WorkingDir:   workingDir,
-		},
-		&container.HostConfig{
-			//volume binding
-			Binds: []string{strings.Join([]string{volumeName, workingDirBasePath, "rw"}, ":")},
-			//remove container when it exits
-			AutoRemove: true,
+			Env:          spec.Env,
+			WorkingDir:   spec.WorkingDir,
+			User:         spec.Limits.User,
 		},
+		spec.hostConfig(),
 		nil,
 		nil,
-		containerName)
+		spec.ContainerName)
+	h.observe("container_create", start, err)
+	cancel()
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("could not create worker container from image '%s': %w", spec.ImageName, err)
+	}
+	logger.WithField("container_id", resp.ID).Info("Worker container created")
+
+	//container is not auto-removed, so it must be removed explicitly once done with it
+	removeCreated := func() {
+		//task context might be already done at this point
+		if err := h.removeContainer(context.Background(), resp.ID); err != nil {
+			logger.WithError(err).Warn("Could not remove worker container")
+		}
 	}
-	fmt.Println("Container Created!")
 
 	//disconnect from default "bridge" network
-	cli.NetworkDisconnect(ctx, "bridge", resp.ID, true)
+	callCtx, cancel = h.callContext(ctx)
+	start = time.Now()
+	err = h.cli.NetworkDisconnect(callCtx, "bridge", resp.ID, true)
+	h.observe("network_disconnect", start, err)
+	cancel()
 	//connect to supplied network
-	if err := cli.NetworkConnect(ctx, networkName, resp.ID, &network.EndpointSettings{}); err != nil {
-		panic(err)
+	callCtx, cancel = h.callContext(ctx)
+	start = time.Now()
+	err = h.cli.NetworkConnect(callCtx, spec.NetworkName, resp.ID, &network.EndpointSettings{})
+	h.observe("network_connect", start, err)
+	cancel()
+	if err != nil {
+		removeCreated()
+		return fmt.Errorf("could not connect worker container to network '%s': %w", spec.NetworkName, err)
 	}
 
-	AttachContainerAndStream(resp.ID)
+	if err := h.AttachContainerAndStream(ctx, resp.ID); err != nil {
+		removeCreated()
+		return err
+	}
 	//start newly created container
-	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		panic(err)
+	callCtx, cancel = h.callContext(ctx)
+	start = time.Now()
+	err = h.cli.ContainerStart(callCtx, resp.ID, types.ContainerStartOptions{})
+	h.observe("container_start", start, err)
+	cancel()
+	if err != nil {
+		removeCreated()
+		return fmt.Errorf("could not start worker container: %w", err)
 	}
 
 	//signal that container started
 	onStarted()
 
-	//wait for the container to stop
-	statusCh, errCh := cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+	return h.waitContainer(ctx, resp.ID, spec.Limits, logger)
+}
+
+//Wait for the container to stop, and remove it.
+//If the context deadline is exceeded meanwhile, the container is stopped and the context error is returned (wrapped);
+//if the context is canceled, the container is left to the caller which canceled it (see StopNRemoveContainer).
+func (h *Handler) waitContainer(ctx context.Context, containerRef string, limits WorkerLimits, logger *log.Entry) error {
+	removeContainer := func() {
+		//task context might be already done at this point
+		if err := h.removeContainer(context.Background(), containerRef); err != nil {
+			logger.WithError(err).Warn("Could not remove worker container")
+		}
+	}
+
+	//wait for the container to stop (no call timeout here, only bounded by the task context)
+	statusCh, errCh := h.cli.ContainerWait(ctx, containerRef, container.WaitConditionNotRunning)
 	select {
 	case err := <-errCh:
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			//task timed-out: container must not outlive it
+			if stopErr := h.StopNRemoveContainer(context.Background(), containerRef); stopErr != nil {
+				logger.WithError(stopErr).Warn("Could not stop worker container")
+			}
+			return fmt.Errorf("worker container interrupted: %w", ctx.Err())
+		} else if ctx.Err() != nil {
+			//task was canceled, its container is stopped by the canceling side
+			return fmt.Errorf("worker container interrupted: %w", ctx.Err())
+		}
 		if err != nil {
-			fmt.Println("Container ended in Error!")
+			//container would leak otherwise, since it is not started with auto-remove option
+			removeContainer()
+			return fmt.Errorf("error while waiting for worker container: %w", err)
+		}
+	case status := <-statusCh:
+		logger.WithField("exit_code", status.StatusCode).Info("Worker container ended")
+		if status.Error != nil {
+			removeContainer()
+			return fmt.Errorf("worker container ended in error: %s", status.Error.Message)
+		}
+	}
+
+	//check why the container stopped
+	callCtx, cancel := h.callContext(context.Background())
+	start := time.Now()
+	contJson, err := h.cli.ContainerInspect(callCtx, containerRef)
+	h.observe("container_inspect", start, err)
+	cancel()
+	if err != nil {
+		//container might have been removed in the meantime (e.g. task canceled)
+		logger.WithError(err).Warn("Could not inspect worker container")
+		return nil
+	}
+	removeContainer()
+	if contJson.State != nil && contJson.State.OOMKilled {
+		if limits.Memory > 0 {
+			return fmt.Errorf("%w (memory limit: %s)", ErrOOMKilled, units.BytesSize(float64(limits.Memory)))
 		}
-	case <-statusCh:
-		fmt.Println("Container ended statusCh :", statusCh)
+		return ErrOOMKilled
 	}
 
+	return nil
 }
 
-func StopNRemoveContainer(
+//whether the container exists (running or not)
+func (h *Handler) ContainerExists(ctx context.Context, containerRef string) (bool, error) {
+	callCtx, cancel := h.callContext(ctx)
+	defer cancel()
+	start := time.Now()
+	_, err := h.cli.ContainerInspect(callCtx, containerRef)
+	h.observe("container_inspect", start, err)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not inspect container %s: %w", containerRef, err)
+	}
+	return true, nil
+}
+
+//Re-attach to a worker container created by a previous run of the manager (e.g. left running during a restart),
+//and wait for it to stop, with same outcome as RunContainer
+func (h *Handler) ReattachContainer(
+	ctx context.Context,
 	containerName string,
-) {
-	ctx := context.Background()
+	limits WorkerLimits,
+) error {
+	logger := loggerFrom(ctx).WithField("container", containerName)
+	logger.Info("Re-attaching to worker container")
+	//container may have ended in the meantime, in which case there is no more output to stream
+	if err := h.AttachContainerAndStream(ctx, containerName); err != nil {
+		logger.WithError(err).Warn("Could not stream worker output")
+	}
+	return h.waitContainer(ctx, containerName, limits, logger)
+}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		panic(err)
+//remove the container, if it still exists
+func (h *Handler) removeContainer(ctx context.Context, containerRef string) error {
+	callCtx, cancel := h.callContext(ctx)
+	defer cancel()
+	start := time.Now()
+	err := h.cli.ContainerRemove(callCtx, containerRef, types.ContainerRemoveOptions{Force: true})
+	h.observe("container_remove", start, err)
+	if err != nil && !client.IsErrNotFound(err) {
+		return fmt.Errorf("could not remove container %s: %w", containerRef, err)
 	}
-	contJson, err := cli.ContainerInspect(ctx, containerName)
-	if err != nil {
-		//container not found, most likely already stopped?
-		fmt.Println("Could not inspect container :", err)
+	return nil
+}
+
+func (h *Handler) StopNRemoveContainer(
+	ctx context.Context,
+	containerName string,
+) error {
+	logger := loggerFrom(ctx).WithField("container", containerName)
+	callCtx, cancel := h.callContext(ctx)
+	start := time.Now()
+	contJson, err := h.cli.ContainerInspect(callCtx, containerName)
+	h.observe("container_inspect", start, err)
+	cancel()
+	if client.IsErrNotFound(err) {
+		//most likely already stopped and removed
+		logger.Info("Container not found, not stopping it")
+	} else if err != nil {
+		return fmt.Errorf("could not inspect container %s: %w", containerName, err)
 	} else {
 
-		fmt.Println("container info : ", contJson)
+		logger.WithField("container_id", contJson.ID).Info("Stopping container")
+
+		//call must last at least as long as the grace period given to the container
+		var stopCtx context.Context
+		var cancel context.CancelFunc
+		if h.callTimeout > 0 {
+			stopCtx, cancel = context.WithTimeout(ctx, h.callTimeout+stopTimeout)
+		} else {
+			stopCtx, cancel = context.WithCancel(ctx)
+		}
+		defer cancel()
 
-		timeout := 10 * time.Second
-		err = cli.ContainerStop(ctx, containerName, &timeout)
+		timeout := stopTimeout
+		start = time.Now()
+		err = h.cli.ContainerStop(stopCtx, containerName, &timeout)
+		h.observe("container_stop", start, err)
 		if err != nil {
-			fmt.Println("Could not stop container :", err)
+			return fmt.Errorf("could not stop container %s: %w", containerName, err)
 		}
-		//No cleaning needed: container are started with auto-remove options
+		//containers are not started with auto-remove option
+		return h.removeContainer(ctx, containerName)
 	}
+	return nil
 }
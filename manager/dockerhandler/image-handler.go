@@ -0,0 +1,136 @@
+package dockerhandler
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+//PullPolicy specifies when the worker image is pulled from its registry
+type PullPolicy string
+
+const (
+	//pull image before each run, to get latest version of the tag
+	PullAlways PullPolicy = "always"
+	//pull image only if not present in local Docker daemon repository
+	PullIfNotPresent PullPolicy = "if-not-present"
+	//never pull, image must be present in local repository
+	PullNever PullPolicy = "never"
+)
+
+func ParsePullPolicy(value string) (PullPolicy, error) {
+	switch policy := PullPolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case PullAlways, PullIfNotPresent, PullNever:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid pull policy '%s' (expected one of: %s, %s, %s)", value, PullAlways, PullIfNotPresent, PullNever)
+	}
+}
+
+//ImageInfo identifies precisely the image used to create containers
+type ImageInfo struct {
+	//reference as specified (e.g. "rikencau/abart-worker:latest")
+	Reference string `json:"reference"`
+	//local image ID (e.g. "sha256:...")
+	Id string `json:"id"`
+	//repository digest (e.g. "rikencau/abart-worker@sha256:..."), empty for locally built images never pushed nor pulled
+	//from the repository of the reference
+	Digest string `json:"digest,omitempty"`
+}
+
+//reference pinned to the exact image content, to be used to create containers
+func (info ImageInfo) Pinned() string {
+	if info.Digest != "" {
+		return info.Digest
+	}
+	return info.Id
+}
+
+//Make sure the image is available according to the pull policy, and return its pinned identity
+func (h *Handler) EnsureImage(ctx context.Context, imageRef string, policy PullPolicy) (ImageInfo, error) {
+	if strings.TrimSpace(imageRef) == "" {
+		return ImageInfo{}, fmt.Errorf("no worker image specified")
+	}
+
+	if policy == PullAlways {
+		if err := h.pullImage(ctx, imageRef); err != nil {
+			return ImageInfo{}, err
+		}
+	}
+
+	info, err := h.inspectImage(ctx, imageRef)
+	if client.IsErrNotFound(err) && policy == PullIfNotPresent {
+		if err := h.pullImage(ctx, imageRef); err != nil {
+			return ImageInfo{}, err
+		}
+		info, err = h.inspectImage(ctx, imageRef)
+	}
+	if client.IsErrNotFound(err) {
+		return ImageInfo{}, fmt.Errorf("image '%s' not found in local repository (pull policy: %s)", imageRef, policy)
+	}
+	return info, err
+}
+
+func (h *Handler) inspectImage(ctx context.Context, imageRef string) (ImageInfo, error) {
+	callCtx, cancel := h.callContext(ctx)
+	defer cancel()
+	start := time.Now()
+	inspect, _, err := h.cli.ImageInspectWithRaw(callCtx, imageRef)
+	h.observe("image_inspect", start, err)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return ImageInfo{}, err
+		}
+		return ImageInfo{}, fmt.Errorf("could not inspect image '%s': %w", imageRef, err)
+	}
+
+	return ImageInfo{
+		Reference: imageRef,
+		Id:        inspect.ID,
+		Digest:    selectRepoDigest(imageRef, inspect.RepoDigests),
+	}, nil
+}
+
+//select, amongst the digests of the image, the one corresponding to the repository of the reference
+//(empty if none: digests of other repositories must not be used to pin the image)
+func selectRepoDigest(imageRef string, repoDigests []string) string {
+	if named, err := reference.ParseNormalizedNamed(imageRef); err == nil {
+		if _, isDigested := named.(reference.Digested); isDigested {
+			//reference is already pinned
+			return imageRef
+		}
+		for _, repoDigest := range repoDigests {
+			if digested, err := reference.ParseNormalizedNamed(repoDigest); err == nil && digested.Name() == named.Name() {
+				return repoDigest
+			}
+		}
+	}
+	return ""
+}
+
+//pull image from its registry (not bounded by call timeout since it may take a while)
+func (h *Handler) pullImage(ctx context.Context, imageRef string) error {
+	logger := loggerFrom(ctx).WithField("image", imageRef)
+	logger.Info("Pulling image")
+	start := time.Now()
+	rc, err := h.cli.ImagePull(ctx, imageRef, types.ImagePullOptions{})
+	h.observe("image_pull", start, err)
+	if err != nil {
+		return fmt.Errorf("could not pull image '%s': %w", imageRef, err)
+	}
+	defer rc.Close()
+
+	//pull is only complete once the progress stream has been consumed, which may also report errors
+	if err := jsonmessage.DisplayJSONMessagesStream(rc, ioutil.Discard, 0, false, nil); err != nil {
+		return fmt.Errorf("could not pull image '%s': %w", imageRef, err)
+	}
+	logger.Info("Image pulled")
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/docker/go-units"
+
+	"rikencau/abart-manager/dockerhandler"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Health endpoints, for orchestrators and start scripts
+
+	- /healthz : the manager process is alive and serving requests
+	- /readyz : the manager can process tasks, i.e. all the checks below succeed
+
+Both answer with a JSON report, and /readyz with a 503 status when not ready.
+*/
+
+//maximum duration of each readiness check
+const readinessCheckTimeout = 5 * time.Second
+
+var errDiskSpaceUnsupported = errors.New("disk space not available on this platform")
+
+//CheckResult reports the outcome of a single readiness check
+type CheckResult struct {
+	Name       string  `json:"name"`
+	Ok         bool    `json:"ok"`
+	Message    string  `json:"message,omitempty"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+type HealthReport struct {
+	//"alive", "ready" or "not-ready"
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks,omitempty"`
+}
+
+type readinessCheck struct {
+	name string
+	//returns a message describing the checked state, and an error if not ready
+	check func(ctx context.Context) (string, error)
+}
+
+//HealthChecker verifies the resources needed to process tasks
+type HealthChecker struct {
+	docker         *dockerhandler.Handler
+	th             *TaskHandler
+	baseWorkDir    string
+	minFreeSpace   int64
+	workerImage    string
+	privateNetwork string
+}
+
+func newHealthChecker(docker *dockerhandler.Handler, th *TaskHandler, cfg Config) *HealthChecker {
+	//already validated with the configuration
+	minFreeSpace, _ := cfg.minFreeSpaceBytes()
+	return &HealthChecker{
+		docker:         docker,
+		th:             th,
+		baseWorkDir:    cfg.BaseWorkDir,
+		minFreeSpace:   minFreeSpace,
+		workerImage:    cfg.Worker.Image,
+		privateNetwork: cfg.PrivateNetwork,
+	}
+}
+
+func (hc *HealthChecker) checks() []readinessCheck {
+	return []readinessCheck{
+		{"accepting-tasks", hc.checkAcceptingTasks},
+		{"workdir-writable", hc.checkWorkdirWritable},
+		{"workdir-free-space", hc.checkFreeSpace},
+		{"docker", hc.checkDocker},
+		{"worker-image", hc.checkWorkerImage},
+		{"private-network", hc.checkPrivateNetwork},
+	}
+}
+
+func (hc *HealthChecker) checkAcceptingTasks(ctx context.Context) (string, error) {
+	if hc.th.isDraining() {
+		return "", fmt.Errorf("manager is draining")
+	}
+	return "", nil
+}
+
+func (hc *HealthChecker) checkWorkdirWritable(ctx context.Context) (string, error) {
+	probe, err := ioutil.TempFile(hc.baseWorkDir, ".readyz-")
+	if err != nil {
+		return "", fmt.Errorf("base working directory is not writable: %w", err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return hc.baseWorkDir, nil
+}
+
+func (hc *HealthChecker) checkFreeSpace(ctx context.Context) (string, error) {
+	free, _, err := getDiskSpace(hc.baseWorkDir)
+	if err == errDiskSpaceUnsupported {
+		return err.Error(), nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not get free space of base working directory: %w", err)
+	}
+	message := fmt.Sprintf("%s free (%s required)", units.BytesSize(float64(free)), units.BytesSize(float64(hc.minFreeSpace)))
+	if hc.minFreeSpace > 0 && free < uint64(hc.minFreeSpace) {
+		return "", fmt.Errorf("not enough free space: %s", message)
+	}
+	return message, nil
+}
+
+func (hc *HealthChecker) checkDocker(ctx context.Context) (string, error) {
+	return "", hc.docker.Ping(ctx)
+}
+
+func (hc *HealthChecker) checkWorkerImage(ctx context.Context) (string, error) {
+	info, err := hc.docker.EnsureImage(ctx, hc.workerImage, dockerhandler.PullNever)
+	if err != nil {
+		return "", err
+	}
+	return info.Pinned(), nil
+}
+
+func (hc *HealthChecker) checkPrivateNetwork(ctx context.Context) (string, error) {
+	return hc.privateNetwork, hc.docker.CheckNetwork(ctx, hc.privateNetwork)
+}
+
+//run all readiness checks
+func (hc *HealthChecker) checkReadiness(ctx context.Context) HealthReport {
+	report := HealthReport{Status: "ready"}
+	for _, rc := range hc.checks() {
+		checkCtx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+		start := time.Now()
+		message, err := rc.check(checkCtx)
+		cancel()
+
+		result := CheckResult{
+			Name:       rc.name,
+			Ok:         err == nil,
+			Message:    message,
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		if err != nil {
+			result.Message = err.Error()
+			report.Status = "not-ready"
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+func writeHealthReport(w http.ResponseWriter, status int, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+func (hc *HealthChecker) serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, http.StatusOK, HealthReport{Status: "alive"})
+}
+
+func (hc *HealthChecker) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	report := hc.checkReadiness(r.Context())
+	if report.Status != "ready" {
+		for _, result := range report.Checks {
+			if !result.Ok {
+				requestLogger(r).WithField("check", result.Name).Warn("Not ready: " + result.Message)
+			}
+		}
+		writeHealthReport(w, http.StatusServiceUnavailable, report)
+		return
+	}
+	writeHealthReport(w, http.StatusOK, report)
+}
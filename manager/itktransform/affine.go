@@ -0,0 +1,153 @@
+//Package itktransform reads linear transforms written by ITK (and thus ANTs), and applies them to points
+package itktransform
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-gl/mathgl/mgl64"
+)
+
+/*
+Affine maps points as ITK MatrixOffsetTransformBase: T(x) = M (x - c) + t + c
+with matrix M, translation t and center c, coordinates being in ITK physical space (LPS).
+
+ANTs registrations (e.g. "0GenericAffine.mat") map points from the fixed space to the moving space.
+*/
+type Affine struct {
+	Matrix mgl64.Mat3
+	//t + c - M c
+	Offset mgl64.Vec3
+}
+
+//map a point (LPS)
+func (a Affine) Transform(p mgl64.Vec3) mgl64.Vec3 {
+	return a.Matrix.Mul3x1(p).Add(a.Offset)
+}
+
+//map a point (LPS) with the inverse transform
+func (a Affine) InverseTransform(p mgl64.Vec3) mgl64.Vec3 {
+	return a.Matrix.Inv().Mul3x1(p.Sub(a.Offset))
+}
+
+//build the transform from ITK parameters (9 matrix elements row by row, then 3 translation components)
+//and fixed parameters (center)
+func fromParameters(params []float64, fixed []float64) (Affine, error) {
+	if len(params) != 12 {
+		return Affine{}, fmt.Errorf("expected 12 parameters of 3D affine transform, got %d", len(params))
+	}
+	center := mgl64.Vec3{}
+	if len(fixed) >= 3 {
+		center = mgl64.Vec3{fixed[0], fixed[1], fixed[2]}
+	}
+	matrix := mgl64.Mat3FromRows(
+		mgl64.Vec3{params[0], params[1], params[2]},
+		mgl64.Vec3{params[3], params[4], params[5]},
+		mgl64.Vec3{params[6], params[7], params[8]},
+	)
+	if math.Abs(matrix.Det()) < 1e-12 {
+		return Affine{}, fmt.Errorf("affine transform is not invertible")
+	}
+	translation := mgl64.Vec3{params[9], params[10], params[11]}
+	return Affine{
+		Matrix: matrix,
+		Offset: translation.Add(center).Sub(matrix.Mul3x1(center)),
+	}, nil
+}
+
+//Read an affine transform, either in MATLAB format (.mat, as written by ANTs) or in ITK text format (.txt, .tfm)
+func ReadAffine(filePath string) (Affine, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return Affine{}, err
+	}
+	if bytes.HasPrefix(content, []byte("#Insight Transform File")) || bytes.Contains(content, []byte("Parameters:")) {
+		return parseText(content)
+	}
+	return parseMat(content)
+}
+
+//ITK text format, with "Parameters:" and "FixedParameters:" lines (only the first transform is considered)
+func parseText(content []byte) (Affine, error) {
+	var params, fixed []float64
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	parseValues := func(line string) ([]float64, error) {
+		values := []float64{}
+		for _, field := range strings.Fields(line[strings.Index(line, ":")+1:]) {
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid parameter '%s'", field)
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	var err error
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Parameters:") && params == nil {
+			if params, err = parseValues(line); err != nil {
+				return Affine{}, err
+			}
+		} else if strings.HasPrefix(line, "FixedParameters:") && fixed == nil {
+			if fixed, err = parseValues(line); err != nil {
+				return Affine{}, err
+			}
+		}
+	}
+	return fromParameters(params, fixed)
+}
+
+//MATLAB level 4 format, holding the parameters (e.g. "AffineTransform_double_3_3") and the "fixed" parameters
+func parseMat(content []byte) (Affine, error) {
+	var params, fixed []float64
+	reader := bytes.NewReader(content)
+	for reader.Len() > 0 {
+		var header [5]int32
+		if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+			return Affine{}, fmt.Errorf("invalid MATLAB file: %w", err)
+		}
+		//type code 0 for little-endian doubles, 1000 for big-endian ones
+		var order binary.ByteOrder = binary.LittleEndian
+		if header[0] != 0 {
+			if swap(header[0]) != 1000 {
+				return Affine{}, fmt.Errorf("unsupported MATLAB variable type %d", header[0])
+			}
+			order = binary.BigEndian
+			for i := range header {
+				header[i] = swap(header[i])
+			}
+		}
+		rows, cols, imaginary, nameLength := header[1], header[2], header[3], header[4]
+		if rows < 0 || cols < 0 || nameLength <= 0 || imaginary != 0 || int64(rows)*int64(cols) > 1024 {
+			return Affine{}, fmt.Errorf("unsupported MATLAB variable")
+		}
+		name := make([]byte, nameLength)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return Affine{}, fmt.Errorf("invalid MATLAB file: %w", err)
+		}
+		values := make([]float64, rows*cols)
+		if err := binary.Read(reader, order, values); err != nil {
+			return Affine{}, fmt.Errorf("invalid MATLAB file: %w", err)
+		}
+		if strings.TrimRight(string(name), "\x00") == "fixed" {
+			fixed = values
+		} else if params == nil {
+			params = values
+		}
+	}
+	return fromParameters(params, fixed)
+}
+
+func swap(value int32) int32 {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(value))
+	return int32(binary.BigEndian.Uint32(buf[:]))
+}
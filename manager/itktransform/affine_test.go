@@ -0,0 +1,158 @@
+package itktransform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl64"
+)
+
+//parameters of an affine transform with a non-zero center, and its expected mapping
+var (
+	testParams = []float64{
+		1.1, 0.2, -0.1,
+		-0.15, 0.9, 0.05,
+		0.1, -0.05, 1.2,
+		3, -4, 5,
+	}
+	testCenter = []float64{10, -20, 30}
+)
+
+//T(x) = M (x - c) + t + c
+func expectedTransform(p mgl64.Vec3) mgl64.Vec3 {
+	m := mgl64.Mat3FromRows(
+		mgl64.Vec3{testParams[0], testParams[1], testParams[2]},
+		mgl64.Vec3{testParams[3], testParams[4], testParams[5]},
+		mgl64.Vec3{testParams[6], testParams[7], testParams[8]},
+	)
+	c := mgl64.Vec3{testCenter[0], testCenter[1], testCenter[2]}
+	t := mgl64.Vec3{testParams[9], testParams[10], testParams[11]}
+	return m.Mul3x1(p.Sub(c)).Add(t).Add(c)
+}
+
+func formatValues(values []float64) string {
+	fields := make([]string, len(values))
+	for i, value := range values {
+		fields[i] = fmt.Sprint(value)
+	}
+	return strings.Join(fields, " ")
+}
+
+func textTransform(params, fixed []float64) []byte {
+	return []byte("#Insight Transform File V1.0\n" +
+		"#Transform 0\n" +
+		"Transform: AffineTransform_double_3_3\n" +
+		"Parameters: " + formatValues(params) + "\n" +
+		"FixedParameters: " + formatValues(fixed) + "\n")
+}
+
+type matVariable struct {
+	name   string
+	values []float64
+}
+
+//MATLAB level 4 file, as written by ITK (column vectors of doubles)
+func matTransform(order binary.ByteOrder, variables ...matVariable) []byte {
+	var buf bytes.Buffer
+	typeCode := int32(0)
+	if order == binary.BigEndian {
+		typeCode = 1000
+	}
+	for _, variable := range variables {
+		name := append([]byte(variable.name), 0)
+		binary.Write(&buf, order, [5]int32{typeCode, int32(len(variable.values)), 1, 0, int32(len(name))})
+		buf.Write(name)
+		binary.Write(&buf, order, variable.values)
+	}
+	return buf.Bytes()
+}
+
+func TestReadAffine(t *testing.T) {
+	params := matVariable{"AffineTransform_double_3_3", testParams}
+	fixed := matVariable{"fixed", testCenter}
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"text", textTransform(testParams, testCenter)},
+		{"little endian mat", matTransform(binary.LittleEndian, params, fixed)},
+		{"big endian mat", matTransform(binary.BigEndian, params, fixed)},
+		{"mat with fixed parameters first", matTransform(binary.LittleEndian, fixed, params)},
+	}
+	points := []mgl64.Vec3{{0, 0, 0}, {10, -20, 30}, {-35.5, 12.25, 80}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "0GenericAffine.mat")
+			if err := os.WriteFile(filePath, test.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			affine, err := ReadAffine(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range points {
+				mapped := affine.Transform(p)
+				if expected := expectedTransform(p); !mapped.ApproxEqualThreshold(expected, 1e-9) {
+					t.Errorf("%v mapped to %v, %v expected", p, mapped, expected)
+				}
+				if back := affine.InverseTransform(mapped); !back.ApproxEqualThreshold(p, 1e-9) {
+					t.Errorf("%v mapped back to %v", p, back)
+				}
+			}
+		})
+	}
+}
+
+func TestReadAffineWithoutCenter(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "affine.txt")
+	if err := os.WriteFile(filePath, textTransform(testParams, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+	affine, err := ReadAffine(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//translation only
+	if mapped := affine.Transform(mgl64.Vec3{}); !mapped.ApproxEqual(mgl64.Vec3{3, -4, 5}) {
+		t.Errorf("origin mapped to %v, (3, -4, 5) expected", mapped)
+	}
+}
+
+func TestReadAffineErrors(t *testing.T) {
+	singular := append([]float64{}, testParams...)
+	copy(singular, []float64{1, 2, 3, 2, 4, 6, 0, 0, 1})
+	complete := matTransform(binary.LittleEndian, matVariable{"AffineTransform_double_3_3", testParams})
+	unknownType := append([]byte{}, complete...)
+	binary.LittleEndian.PutUint32(unknownType, 20)
+
+	tests := []struct {
+		name    string
+		content []byte
+		//expected part of the error message
+		err string
+	}{
+		{"missing parameters", textTransform(testParams[:9], testCenter), "12 parameters"},
+		{"invalid parameter", []byte("Parameters: 1 2 x\n"), "invalid parameter"},
+		{"singular matrix", textTransform(singular, testCenter), "not invertible"},
+		{"truncated mat", complete[:len(complete)-4], "invalid MATLAB file"},
+		{"unsupported mat type", unknownType, "unsupported MATLAB variable type"},
+		{"empty file", []byte{}, "12 parameters"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "affine.mat")
+			if err := os.WriteFile(filePath, test.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := ReadAffine(filePath)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error containing '%s' expected, got %v", test.err, err)
+			}
+		})
+	}
+}
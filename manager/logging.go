@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"rikencau/abart-manager/auth"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Logging
+
+Entries are written to stdout, either in logfmt ("key=value" pairs) or JSON format.
+Entries related to an API call carry its "request_id", and the ones related to a task carry its "task" ID.
+*/
+type LogConfig struct {
+	//"logfmt" or "json"
+	Format string `yaml:"format"`
+	//minimum level of logged entries ("debug", "info", "warning", "error")
+	Level string `yaml:"level"`
+	//log every API call
+	AccessLog bool `yaml:"access_log"`
+}
+
+func defaultLogConfig() LogConfig {
+	return LogConfig{
+		Format:    "logfmt",
+		Level:     "info",
+		AccessLog: true,
+	}
+}
+
+func (lc LogConfig) formatter() (log.Formatter, error) {
+	switch strings.ToLower(lc.Format) {
+	case "logfmt":
+		return &log.TextFormatter{DisableColors: true, FullTimestamp: true, TimestampFormat: time.RFC3339Nano}, nil
+	case "json":
+		return &log.JSONFormatter{TimestampFormat: time.RFC3339Nano}, nil
+	default:
+		return nil, fmt.Errorf("unknown format '%s' (logfmt, json)", lc.Format)
+	}
+}
+
+func (lc LogConfig) validate() error {
+	if _, err := lc.formatter(); err != nil {
+		return err
+	}
+	if _, err := log.ParseLevel(lc.Level); err != nil {
+		return fmt.Errorf("unknown level '%s' (debug, info, warning, error)", lc.Level)
+	}
+	return nil
+}
+
+//configure the standard logger, used by all packages
+func initLogging(lc LogConfig) error {
+	formatter, err := lc.formatter()
+	if err != nil {
+		return err
+	}
+	level, err := log.ParseLevel(lc.Level)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(os.Stdout)
+	log.SetFormatter(formatter)
+	log.SetLevel(level)
+	return nil
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//header carrying the request ID, kept if supplied by the client (or a proxy), echoed in the response
+const requestIdHeader = "X-Request-Id"
+
+const requestIdLength = 16
+
+//requestInfo is attached to the context of each request
+type requestInfo struct {
+	id string
+	//authenticated user (set once authenticated)
+	user string
+}
+
+type requestInfoKey struct{}
+
+func getRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+//logger of entries related to the request
+func requestLogger(r *http.Request) *log.Entry {
+	entry := log.NewEntry(log.StandardLogger())
+	if info := getRequestInfo(r); info != nil {
+		entry = entry.WithField("request_id", info.id)
+	}
+	if id := auth.FromContext(r.Context()); id != nil {
+		entry = entry.WithField("user", id.Subject)
+	}
+	return entry
+}
+
+//supplied request IDs are only kept when reasonably short and printable
+func isValidRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > 128 {
+		return false
+	}
+	for _, c := range requestId {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+//responseRecorder captures status and size of the response, for the access log
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//needed to upgrade connections to websocket
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can not be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+//middleware assigning an ID to each request, and logging it once served (if access log is enabled)
+func logRequests(lc LogConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestId := r.Header.Get(requestIdHeader)
+		if !isValidRequestId(requestId) {
+			requestId, _ = randSeq(requestIdLength)
+		}
+		info := &requestInfo{id: requestId}
+		w.Header().Set(requestIdHeader, requestId)
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		if !lc.AccessLog {
+			return
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		fields := log.Fields{
+			"request_id":  info.id,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      status,
+			"bytes":       rec.bytes,
+			"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"remote_addr": r.RemoteAddr,
+		}
+		if info.user != "" {
+			fields["user"] = info.user
+		}
+		entry := log.WithFields(fields)
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			entry.Info("API call")
+		} else {
+			//e.g. periodic scraping of metrics
+			entry.Debug("HTTP request")
+		}
+	})
+}
+
+//middleware recording the authenticated user of the request, for the access log
+func recordRequestUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info, id := getRequestInfo(r), auth.FromContext(r.Context()); info != nil && id != nil {
+			info.user = id.Subject
+		}
+		next.ServeHTTP(w, r)
+	})
+}
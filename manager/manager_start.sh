@@ -23,6 +23,20 @@ sudo docker run --rm -d  \
 # connect manager to default bridge network 
 sudo docker network connect bridge abart-manager
 
+# wait until manager is ready to process tasks (working directory, Docker daemon, worker image, private network)
+printf ' waiting for abart-manager readiness'
+for i in $(seq 1 30); do
+  if curl -fsS -o /dev/null http://localhost:${ABART_MGR_XPRT_PORT}/readyz 2> /dev/null; then
+    break
+  fi
+  printf '.'
+  sleep 2
+done
+echo
+# display readiness report (failed checks explain what is missing)
+curl -sS http://localhost:${ABART_MGR_XPRT_PORT}/readyz
+echo
+
 # attach console to container to display logs 
 sudo docker attach abart-manager
 
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+//Prometheus metrics, exposed at /metrics
+
+const metricsNamespace = "abart"
+
+//buckets for task durations, from 1 minute up to 2 days
+var taskDurationBuckets = []float64{60, 300, 600, 1800, 3600, 2 * 3600, 4 * 3600, 8 * 3600, 16 * 3600, 48 * 3600}
+
+var (
+	tasksEndedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tasks_ended_total",
+		Help:      "Number of tasks which reached a final status, by status and failure reason.",
+	}, []string{"status", "reason"})
+
+	taskDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_duration_seconds",
+		Help:      "Duration of task processing, from worker start to end, by final status.",
+		Buckets:   taskDurationBuckets,
+	}, []string{"status"})
+
+	taskQueueWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_queue_wait_seconds",
+		Help:      "Time spent by tasks between their submission and the start of their worker.",
+		Buckets:   append([]float64{1, 10}, taskDurationBuckets...),
+	})
+
+	uploadBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_bytes",
+		Help:      "Size of the volumes uploaded for new tasks.",
+		//from 1MiB to 4GiB
+		Buckets: prometheus.ExponentialBuckets(1<<20, 4, 7),
+	})
+
+	uploadDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Time taken to receive and store the volumes uploaded for new tasks.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 3, 9),
+	})
+
+	websocketConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "websocket_connections",
+		Help:      "Number of open websocket connections (log streaming).",
+	})
+
+	dockerCallDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "docker_call_duration_seconds",
+		Help:      "Latency of calls to the Docker daemon, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	dockerCallErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "docker_call_errors_total",
+		Help:      "Number of failed calls to the Docker daemon, by operation.",
+	}, []string{"operation"})
+)
+
+//record the outcome of a task reaching a final status
+func observeTaskEnded(status TaskStatus, reason FailureReason) {
+	tasksEndedTotal.WithLabelValues(string(status), string(reason)).Inc()
+}
+
+//record duration of a call to the Docker daemon (see dockerhandler.CallObserver)
+func observeDockerCall(operation string, duration time.Duration, failed bool) {
+	dockerCallDurationSeconds.WithLabelValues(operation).Observe(duration.Seconds())
+	if failed {
+		dockerCallErrorsTotal.WithLabelValues(operation).Inc()
+	}
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//how long the size of the working directories is reused, since computing it walks the whole tree
+const workdirUsageTTL = time.Minute
+
+//workdirCollector reports disk usage of the base working directory
+type workdirCollector struct {
+	baseWorkDir string
+
+	usedDesc  *prometheus.Desc
+	freeDesc  *prometheus.Desc
+	totalDesc *prometheus.Desc
+
+	mu         sync.Mutex
+	used       int64
+	computedAt time.Time
+}
+
+func newWorkdirCollector(baseWorkDir string) *workdirCollector {
+	return &workdirCollector{
+		baseWorkDir: baseWorkDir,
+		usedDesc:    prometheus.NewDesc(metricsNamespace+"_workdir_used_bytes", "Bytes stored in the base working directory.", nil, nil),
+		freeDesc:    prometheus.NewDesc(metricsNamespace+"_workdir_fs_free_bytes", "Free bytes of the filesystem holding the base working directory.", nil, nil),
+		totalDesc:   prometheus.NewDesc(metricsNamespace+"_workdir_fs_size_bytes", "Size of the filesystem holding the base working directory.", nil, nil),
+	}
+}
+
+func (c *workdirCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.usedDesc
+	ch <- c.freeDesc
+	ch <- c.totalDesc
+}
+
+func (c *workdirCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	if time.Since(c.computedAt) > workdirUsageTTL {
+		c.used = dirSize(c.baseWorkDir)
+		c.computedAt = time.Now()
+	}
+	used := c.used
+	c.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(c.usedDesc, prometheus.GaugeValue, float64(used))
+
+	free, total, err := getDiskSpace(c.baseWorkDir)
+	if err != nil {
+		log.WithError(err).Warn("Could not get disk space of working directory")
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.freeDesc, prometheus.GaugeValue, float64(free))
+	ch <- prometheus.MustNewConstMetric(c.totalDesc, prometheus.GaugeValue, float64(total))
+}
+
+//register all metrics, including the ones computed from the state of the task handler
+func registerMetrics(th *TaskHandler, baseWorkDir string) {
+	prometheus.MustRegister(
+		tasksEndedTotal,
+		taskDurationSeconds,
+		taskQueueWaitSeconds,
+		uploadBytes,
+		uploadDurationSeconds,
+		websocketConnections,
+		dockerCallDurationSeconds,
+		dockerCallErrorsTotal,
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_depth",
+			Help:      "Number of tasks waiting to be processed.",
+		}, func() float64 {
+			_, queued := th.countAllActiveTasks()
+			return float64(queued)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "running_tasks",
+			Help:      "Number of tasks being processed.",
+		}, func() float64 {
+			running, _ := th.countAllActiveTasks()
+			return float64(running)
+		}),
+
+		newWorkdirCollector(baseWorkDir),
+	)
+}
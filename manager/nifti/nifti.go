@@ -0,0 +1,409 @@
+//Package nifti reads volumes in NIfTI-1 format (.nii, or gzip compressed .nii.gz)
+package nifti
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/go-gl/mathgl/mgl64"
+)
+
+const headerSize = 348
+
+//largest volume data loaded in memory
+const maxDataSize = 2 << 30
+
+//NIfTI-1 datatype codes
+const (
+	DtUint8   = 2
+	DtInt16   = 4
+	DtInt32   = 8
+	DtFloat32 = 16
+	DtFloat64 = 64
+	DtInt8    = 256
+	DtUint16  = 512
+	DtUint32  = 768
+	DtInt64   = 1024
+	DtUint64  = 1280
+)
+
+//size in mm of spatial units (xyzt_units bits 0-2), unknown units being taken as mm
+var spatialUnitsMm = map[int8]float64{
+	0: 1,
+	1: 1000,  //meter
+	2: 1,     //millimeter
+	3: 0.001, //micron
+}
+
+var bytesPerVoxel = map[int16]int{
+	DtUint8:   1,
+	DtInt16:   2,
+	DtInt32:   4,
+	DtFloat32: 4,
+	DtFloat64: 8,
+	DtInt8:    1,
+	DtUint16:  2,
+	DtUint32:  4,
+	DtInt64:   8,
+	DtUint64:  8,
+}
+
+//Volume is a 3D image (only the first volume of 4D images is loaded), possibly with vector voxels
+type Volume struct {
+	//number of voxels along i, j and k axes
+	Dims [3]int
+	//number of components of each voxel (e.g. 3 for displacement fields, stored along the 5th dimension)
+	Components int
+	//voxel size along i, j and k axes (mm)
+	Spacing  [3]float64
+	Datatype int16
+	//transform from voxel indices (i, j, k, 1) to world coordinates (RAS+, mm)
+	Affine mgl64.Mat4
+
+	slope     float64
+	intercept float64
+	order     binary.ByteOrder
+	voxelSize int
+	data      []byte
+}
+
+//header fields, at their offset in the NIfTI-1 header
+type header struct {
+	SizeofHdr  int32
+	_          [36]byte
+	Dim        [8]int16
+	IntentP    [3]float32
+	IntentCode int16
+	Datatype   int16
+	Bitpix     int16
+	SliceStart int16
+	Pixdim     [8]float32
+	VoxOffset  float32
+	SclSlope   float32
+	SclInter   float32
+	SliceEnd   int16
+	SliceCode  int8
+	XyztUnits  int8
+	CalMax     float32
+	CalMin     float32
+	SliceDur   float32
+	Toffset    float32
+	Glmax      int32
+	Glmin      int32
+	Descrip    [80]byte
+	AuxFile    [24]byte
+	QformCode  int16
+	SformCode  int16
+	QuaternB   float32
+	QuaternC   float32
+	QuaternD   float32
+	QoffsetX   float32
+	QoffsetY   float32
+	QoffsetZ   float32
+	SrowX      [4]float32
+	SrowY      [4]float32
+	SrowZ      [4]float32
+	IntentName [16]byte
+	Magic      [4]byte
+}
+
+//Read the volume from a .nii or .nii.gz file
+func Read(filePath string) (*Volume, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadFrom(file)
+}
+
+//Read the geometry of the volume (dimensions, voxel size and transform) from a .nii or .nii.gz file,
+//without loading its data (voxel values must not be accessed)
+func ReadGeometry(filePath string) (*Volume, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return read(file, false)
+}
+
+//Read the volume from a stream, gzip compressed or not
+func ReadFrom(r io.Reader) (*Volume, error) {
+	return read(r, true)
+}
+
+func read(r io.Reader, withData bool) (*Volume, error) {
+	reader := bufio.NewReader(r)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = bufio.NewReader(gzipReader)
+	}
+
+	rawHeader := make([]byte, headerSize)
+	if _, err := io.ReadFull(reader, rawHeader); err != nil {
+		return nil, fmt.Errorf("could not read NIfTI header: %w", err)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if int32(binary.LittleEndian.Uint32(rawHeader)) != headerSize {
+		order = binary.BigEndian
+		if int32(binary.BigEndian.Uint32(rawHeader)) != headerSize {
+			return nil, fmt.Errorf("not a NIfTI-1 file")
+		}
+	}
+	var hdr header
+	if err := binary.Read(bytes.NewReader(rawHeader), order, &hdr); err != nil {
+		return nil, err
+	}
+	if magic := string(hdr.Magic[:3]); magic != "n+1" {
+		return nil, fmt.Errorf("unsupported NIfTI file (magic '%s', single file NIfTI-1 expected)", magic)
+	}
+
+	v := &Volume{
+		Datatype:  hdr.Datatype,
+		slope:     float64(hdr.SclSlope),
+		intercept: float64(hdr.SclInter),
+		order:     order,
+	}
+	if hdr.Dim[0] < 1 || hdr.Dim[0] > 7 {
+		return nil, fmt.Errorf("invalid number of dimensions: %d", hdr.Dim[0])
+	}
+	dataSize := int64(1)
+	for axis := 0; axis < 3; axis++ {
+		v.Dims[axis] = 1
+		v.Spacing[axis] = 1
+		if axis < int(hdr.Dim[0]) {
+			v.Dims[axis] = int(hdr.Dim[axis+1])
+			if spacing := math.Abs(float64(hdr.Pixdim[axis+1])); spacing > 0 {
+				v.Spacing[axis] = spacing
+			}
+		}
+		if v.Dims[axis] < 1 {
+			return nil, fmt.Errorf("invalid dimension: %d", v.Dims[axis])
+		}
+		dataSize *= int64(v.Dims[axis])
+	}
+	var ok bool
+	if v.voxelSize, ok = bytesPerVoxel[hdr.Datatype]; !ok {
+		return nil, fmt.Errorf("unsupported datatype: %d", hdr.Datatype)
+	}
+	v.Components = 1
+	if hdr.Dim[0] >= 5 && hdr.Dim[4] <= 1 && hdr.Dim[5] > 1 {
+		v.Components = int(hdr.Dim[5])
+	}
+	dataSize *= int64(v.Components) * int64(v.voxelSize)
+	if dataSize > maxDataSize {
+		return nil, fmt.Errorf("volume too large (%d bytes)", dataSize)
+	}
+	//spacing and world coordinates are converted to mm
+	unitMm, ok := spatialUnitsMm[hdr.XyztUnits&0x07]
+	if !ok {
+		return nil, fmt.Errorf("unsupported spatial units: %d", hdr.XyztUnits&0x07)
+	}
+	v.Affine = hdr.affine(v.Spacing)
+	if unitMm != 1 {
+		for axis := 0; axis < 3; axis++ {
+			v.Spacing[axis] *= unitMm
+		}
+		v.Affine = mgl64.Scale3D(unitMm, unitMm, unitMm).Mul4(v.Affine)
+	}
+	if !withData {
+		return v, nil
+	}
+
+	//extensions, if any, lie between header and data
+	if skip := int64(hdr.VoxOffset) - headerSize; skip > 0 {
+		if _, err := io.CopyN(io.Discard, reader, skip); err != nil {
+			return nil, fmt.Errorf("could not read NIfTI extensions: %w", err)
+		}
+	}
+	v.data = make([]byte, dataSize)
+	if _, err := io.ReadFull(reader, v.data); err != nil {
+		return nil, fmt.Errorf("could not read NIfTI data: %w", err)
+	}
+	return v, nil
+}
+
+//voxel to world transform, from sform if specified, otherwise from qform, otherwise from voxel size only
+func (hdr *header) affine(spacing [3]float64) mgl64.Mat4 {
+	if hdr.SformCode > 0 {
+		row := func(r [4]float32) mgl64.Vec4 {
+			return mgl64.Vec4{float64(r[0]), float64(r[1]), float64(r[2]), float64(r[3])}
+		}
+		return mgl64.Mat4FromRows(row(hdr.SrowX), row(hdr.SrowY), row(hdr.SrowZ), mgl64.Vec4{0, 0, 0, 1})
+	}
+	if hdr.QformCode > 0 {
+		//see quatern_to_mat44 of nifti1_io
+		b, c, d := float64(hdr.QuaternB), float64(hdr.QuaternC), float64(hdr.QuaternD)
+		a := 1 - (b*b + c*c + d*d)
+		if a < 1e-7 {
+			norm := 1 / math.Sqrt(b*b+c*c+d*d)
+			a, b, c, d = 0, b*norm, c*norm, d*norm
+		} else {
+			a = math.Sqrt(a)
+		}
+		qfac := 1.0
+		if hdr.Pixdim[0] < 0 {
+			qfac = -1
+		}
+		x, y, z := spacing[0], spacing[1], spacing[2]*qfac
+		return mgl64.Mat4FromRows(
+			mgl64.Vec4{(a*a + b*b - c*c - d*d) * x, 2 * (b*c - a*d) * y, 2 * (b*d + a*c) * z, float64(hdr.QoffsetX)},
+			mgl64.Vec4{2 * (b*c + a*d) * x, (a*a + c*c - b*b - d*d) * y, 2 * (c*d - a*b) * z, float64(hdr.QoffsetY)},
+			mgl64.Vec4{2 * (b*d - a*c) * x, 2 * (c*d + a*b) * y, (a*a + d*d - c*c - b*b) * z, float64(hdr.QoffsetZ)},
+			mgl64.Vec4{0, 0, 0, 1},
+		)
+	}
+	return mgl64.Scale3D(spacing[0], spacing[1], spacing[2])
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//DataSize is the number of bytes taken in memory by the voxel values, once loaded
+func (v *Volume) DataSize() int64 {
+	return int64(v.Dims[0]) * int64(v.Dims[1]) * int64(v.Dims[2]) * int64(v.Components) * int64(v.voxelSize)
+}
+
+//whether the voxel indices lie within the volume
+func (v *Volume) Contains(i, j, k int) bool {
+	return i >= 0 && j >= 0 && k >= 0 && i < v.Dims[0] && j < v.Dims[1] && k < v.Dims[2]
+}
+
+//raw value of the voxel (indices must lie within the volume)
+func (v *Volume) Raw(i, j, k int) float64 {
+	return v.rawComponent(i, j, k, 0)
+}
+
+func (v *Volume) rawComponent(i, j, k, c int) float64 {
+	offset := (((c*v.Dims[2]+k)*v.Dims[1]+j)*v.Dims[0] + i) * v.voxelSize
+	data := v.data[offset : offset+v.voxelSize]
+	switch v.Datatype {
+	case DtUint8:
+		return float64(data[0])
+	case DtInt8:
+		return float64(int8(data[0]))
+	case DtInt16:
+		return float64(int16(v.order.Uint16(data)))
+	case DtUint16:
+		return float64(v.order.Uint16(data))
+	case DtInt32:
+		return float64(int32(v.order.Uint32(data)))
+	case DtUint32:
+		return float64(v.order.Uint32(data))
+	case DtInt64:
+		return float64(int64(v.order.Uint64(data)))
+	case DtUint64:
+		return float64(v.order.Uint64(data))
+	case DtFloat32:
+		return float64(math.Float32frombits(v.order.Uint32(data)))
+	case DtFloat64:
+		return math.Float64frombits(v.order.Uint64(data))
+	}
+	return 0
+}
+
+//value of the voxel, scaled as specified by the header (indices must lie within the volume)
+func (v *Volume) At(i, j, k int) float64 {
+	return v.Component(i, j, k, 0)
+}
+
+//component of a vector voxel, scaled as specified by the header (indices must lie within the volume)
+func (v *Volume) Component(i, j, k, c int) float64 {
+	value := v.rawComponent(i, j, k, c)
+	if v.slope != 0 {
+		value = value*v.slope + v.intercept
+	}
+	return value
+}
+
+//component of the vector field at continuous voxel indices, by trilinear interpolation
+//(false if indices lie outside the volume)
+func (v *Volume) Interpolate(ijk mgl64.Vec3, c int) (float64, bool) {
+	var base [3]int
+	var frac [3]float64
+	for axis := 0; axis < 3; axis++ {
+		if ijk[axis] < 0 || ijk[axis] > float64(v.Dims[axis]-1) {
+			return 0, false
+		}
+		base[axis] = int(math.Floor(ijk[axis]))
+		if base[axis] == v.Dims[axis]-1 && base[axis] > 0 {
+			base[axis]--
+		}
+		frac[axis] = ijk[axis] - float64(base[axis])
+	}
+	value := 0.0
+	for corner := 0; corner < 8; corner++ {
+		weight := 1.0
+		var idx [3]int
+		for axis := 0; axis < 3; axis++ {
+			idx[axis] = base[axis]
+			if corner&(1<<axis) != 0 {
+				idx[axis]++
+				weight *= frac[axis]
+			} else {
+				weight *= 1 - frac[axis]
+			}
+		}
+		if weight == 0 {
+			continue
+		}
+		value += weight * v.Component(idx[0], idx[1], idx[2], c)
+	}
+	return value, true
+}
+
+//label of the voxel, for label volumes (indices must lie within the volume)
+func (v *Volume) Label(i, j, k int) int {
+	return int(math.Round(v.Raw(i, j, k)))
+}
+
+//world coordinates (RAS+, mm) of the voxel indices
+func (v *Volume) ToWorld(ijk mgl64.Vec3) mgl64.Vec3 {
+	return v.Affine.Mul4x1(ijk.Vec4(1)).Vec3()
+}
+
+//voxel indices (continuous) of the world coordinates (RAS+, mm)
+func (v *Volume) ToVoxel(ras mgl64.Vec3) mgl64.Vec3 {
+	return v.Affine.Inv().Mul4x1(ras.Vec4(1)).Vec3()
+}
+
+//whether both volumes share the same voxel grid (dimensions and position in world space)
+func (v *Volume) SameGrid(other *Volume) bool {
+	return v.Dims == other.Dims && v.Affine.ApproxEqualThreshold(other.Affine, 1e-3)
+}
+
+//world axis (0: R-L, 1: A-P, 2: S-I) along which each voxel axis is mostly oriented (each world axis
+//being assigned to a single voxel axis), and whether indices increase towards R, A and S respectively
+func (v *Volume) Orientation() (axes [3]int, positive [3]bool) {
+	assigned := [3]bool{}
+	used := [3]bool{}
+	//strongest components are assigned first, so that oblique axes get the remaining world axis
+	for n := 0; n < 3; n++ {
+		bestAxis, bestWorld, bestValue := -1, -1, -1.0
+		for axis := 0; axis < 3; axis++ {
+			if assigned[axis] {
+				continue
+			}
+			column := v.Affine.Col(axis)
+			for world := 0; world < 3; world++ {
+				if !used[world] && math.Abs(column[world]) > bestValue {
+					bestAxis, bestWorld, bestValue = axis, world, math.Abs(column[world])
+				}
+			}
+		}
+		assigned[bestAxis], used[bestWorld] = true, true
+		axes[bestAxis] = bestWorld
+		positive[bestAxis] = v.Affine.Col(bestAxis)[bestWorld] >= 0
+	}
+	return axes, positive
+}
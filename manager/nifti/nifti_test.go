@@ -0,0 +1,350 @@
+package nifti
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl64"
+)
+
+//volume to be encoded by encodeVolume
+type testVolume struct {
+	order    binary.ByteOrder
+	gzipped  bool
+	dims     []int16
+	pixdim   [4]float32
+	datatype int16
+	//values in file order, encoded according to datatype
+	values []float64
+	slope  float32
+	inter  float32
+	units  int8
+	//transforms (not specified if codes are 0)
+	sformCode int16
+	srow      [3][4]float32
+	qformCode int16
+	quatern   [3]float32
+	qoffset   [3]float32
+}
+
+func encodeVolume(t *testing.T, tv testVolume) []byte {
+	hdr := header{
+		SizeofHdr: headerSize,
+		Datatype:  tv.datatype,
+		Bitpix:    int16(8 * bytesPerVoxel[tv.datatype]),
+		VoxOffset: 352,
+		SclSlope:  tv.slope,
+		SclInter:  tv.inter,
+		XyztUnits: tv.units,
+		SformCode: tv.sformCode,
+		SrowX:     tv.srow[0],
+		SrowY:     tv.srow[1],
+		SrowZ:     tv.srow[2],
+		QformCode: tv.qformCode,
+		QuaternB:  tv.quatern[0],
+		QuaternC:  tv.quatern[1],
+		QuaternD:  tv.quatern[2],
+		QoffsetX:  tv.qoffset[0],
+		QoffsetY:  tv.qoffset[1],
+		QoffsetZ:  tv.qoffset[2],
+	}
+	hdr.Dim[0] = int16(len(tv.dims))
+	copy(hdr.Dim[1:], tv.dims)
+	copy(hdr.Pixdim[:], tv.pixdim[:])
+	copy(hdr.Magic[:], "n+1\x00")
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, tv.order, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != headerSize {
+		t.Fatalf("header encoded on %d bytes", buf.Len())
+	}
+	//no extension
+	buf.Write([]byte{0, 0, 0, 0})
+	for _, value := range tv.values {
+		var v interface{}
+		switch tv.datatype {
+		case DtUint8:
+			v = uint8(value)
+		case DtInt16:
+			v = int16(value)
+		case DtFloat32:
+			v = float32(value)
+		case DtFloat64:
+			v = value
+		default:
+			t.Fatalf("datatype %d not supported by test encoder", tv.datatype)
+		}
+		binary.Write(&buf, tv.order, v)
+	}
+	if !tv.gzipped {
+		return buf.Bytes()
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(buf.Bytes())
+	gz.Close()
+	return compressed.Bytes()
+}
+
+//values 0, 1, 2... of the given count
+func sequence(count int) []float64 {
+	values := make([]float64, count)
+	for i := range values {
+		values[i] = float64(i)
+	}
+	return values
+}
+
+func approxEqual(a, b mgl64.Mat4) bool {
+	return a.ApproxEqualThreshold(b, 1e-5)
+}
+
+func TestRead(t *testing.T) {
+	sform := [3][4]float32{{-2, 0, 0, 10}, {0, 3, 0, -20}, {0, 0, 4, 30}}
+	sformAffine := mgl64.Mat4FromRows(
+		mgl64.Vec4{-2, 0, 0, 10},
+		mgl64.Vec4{0, 3, 0, -20},
+		mgl64.Vec4{0, 0, 4, 30},
+		mgl64.Vec4{0, 0, 0, 1},
+	)
+	//qform rotating by 180 degrees about z (quaternion b=0, c=0, d=1)
+	qformAffine := mgl64.Mat4FromRows(
+		mgl64.Vec4{-2, 0, 0, 1},
+		mgl64.Vec4{0, -3, 0, 2},
+		mgl64.Vec4{0, 0, 4, 3},
+		mgl64.Vec4{0, 0, 0, 1},
+	)
+
+	tests := []struct {
+		name   string
+		volume testVolume
+		//expected geometry
+		dims       [3]int
+		components int
+		spacing    [3]float64
+		affine     mgl64.Mat4
+		//expected scaled value of voxel (1, 2, 3) of first component, and its raw value
+		value float64
+		raw   float64
+	}{
+		{
+			name:   "little endian uint8 with sform",
+			volume: testVolume{order: binary.LittleEndian, dims: []int16{2, 3, 4}, pixdim: [4]float32{1, 2, 3, 4}, datatype: DtUint8, values: sequence(24), sformCode: 1, srow: sform},
+			dims:   [3]int{2, 3, 4}, components: 1, spacing: [3]float64{2, 3, 4}, affine: sformAffine,
+			value: 23, raw: 23,
+		},
+		{
+			name:   "big endian int16 with scaling",
+			volume: testVolume{order: binary.BigEndian, dims: []int16{2, 3, 4}, pixdim: [4]float32{1, 2, 3, 4}, datatype: DtInt16, values: sequence(24), slope: 2, inter: -1, sformCode: 1, srow: sform},
+			dims:   [3]int{2, 3, 4}, components: 1, spacing: [3]float64{2, 3, 4}, affine: sformAffine,
+			value: 45, raw: 23,
+		},
+		{
+			name:   "gzip float32",
+			volume: testVolume{order: binary.LittleEndian, gzipped: true, dims: []int16{2, 3, 4}, pixdim: [4]float32{1, 2, 3, 4}, datatype: DtFloat32, values: sequence(24), sformCode: 1, srow: sform},
+			dims:   [3]int{2, 3, 4}, components: 1, spacing: [3]float64{2, 3, 4}, affine: sformAffine,
+			value: 23, raw: 23,
+		},
+		{
+			name:   "gzip big endian float64",
+			volume: testVolume{order: binary.BigEndian, gzipped: true, dims: []int16{2, 3, 4}, pixdim: [4]float32{1, 2, 3, 4}, datatype: DtFloat64, values: sequence(24), sformCode: 1, srow: sform},
+			dims:   [3]int{2, 3, 4}, components: 1, spacing: [3]float64{2, 3, 4}, affine: sformAffine,
+			value: 23, raw: 23,
+		},
+		{
+			name:   "qform only",
+			volume: testVolume{order: binary.LittleEndian, dims: []int16{2, 3, 4}, pixdim: [4]float32{1, 2, 3, 4}, datatype: DtUint8, values: sequence(24), qformCode: 1, quatern: [3]float32{0, 0, 1}, qoffset: [3]float32{1, 2, 3}},
+			dims:   [3]int{2, 3, 4}, components: 1, spacing: [3]float64{2, 3, 4}, affine: qformAffine,
+			value: 23, raw: 23,
+		},
+		{
+			name:   "qform with negative qfac",
+			volume: testVolume{order: binary.LittleEndian, dims: []int16{2, 3, 4}, pixdim: [4]float32{-1, 2, 3, 4}, datatype: DtUint8, values: sequence(24), qformCode: 1, quatern: [3]float32{0, 0, 1}, qoffset: [3]float32{1, 2, 3}},
+			dims:   [3]int{2, 3, 4}, components: 1, spacing: [3]float64{2, 3, 4},
+			affine: mgl64.Mat4FromRows(mgl64.Vec4{-2, 0, 0, 1}, mgl64.Vec4{0, -3, 0, 2}, mgl64.Vec4{0, 0, -4, 3}, mgl64.Vec4{0, 0, 0, 1}),
+			value:  23, raw: 23,
+		},
+		{
+			name:   "sform preferred to qform",
+			volume: testVolume{order: binary.LittleEndian, dims: []int16{2, 3, 4}, pixdim: [4]float32{1, 2, 3, 4}, datatype: DtUint8, values: sequence(24), sformCode: 2, srow: sform, qformCode: 1, quatern: [3]float32{0, 0, 1}, qoffset: [3]float32{1, 2, 3}},
+			dims:   [3]int{2, 3, 4}, components: 1, spacing: [3]float64{2, 3, 4}, affine: sformAffine,
+			value: 23, raw: 23,
+		},
+		{
+			name:   "no transform",
+			volume: testVolume{order: binary.LittleEndian, dims: []int16{2, 3, 4}, pixdim: [4]float32{1, 2, 3, 4}, datatype: DtUint8, values: sequence(24)},
+			dims:   [3]int{2, 3, 4}, components: 1, spacing: [3]float64{2, 3, 4}, affine: mgl64.Scale3D(2, 3, 4),
+			value: 23, raw: 23,
+		},
+		{
+			name:   "spacing in microns",
+			volume: testVolume{order: binary.LittleEndian, dims: []int16{2, 3, 4}, pixdim: [4]float32{1, 100, 200, 300}, datatype: DtUint8, values: sequence(24), units: 3, sformCode: 1, srow: [3][4]float32{{100, 0, 0, 1000}, {0, 200, 0, 2000}, {0, 0, 300, 3000}}},
+			dims:   [3]int{2, 3, 4}, components: 1, spacing: [3]float64{0.1, 0.2, 0.3},
+			affine: mgl64.Mat4FromRows(mgl64.Vec4{0.1, 0, 0, 1}, mgl64.Vec4{0, 0.2, 0, 2}, mgl64.Vec4{0, 0, 0.3, 3}, mgl64.Vec4{0, 0, 0, 1}),
+			value:  23, raw: 23,
+		},
+		{
+			name:   "spacing in meters",
+			volume: testVolume{order: binary.LittleEndian, dims: []int16{2, 3, 4}, pixdim: [4]float32{1, 0.002, 0.003, 0.004}, datatype: DtUint8, values: sequence(24), units: 1 | 8},
+			dims:   [3]int{2, 3, 4}, components: 1, spacing: [3]float64{2, 3, 4}, affine: mgl64.Scale3D(2, 3, 4),
+			value: 23, raw: 23,
+		},
+		{
+			name:   "displacement field",
+			volume: testVolume{order: binary.LittleEndian, dims: []int16{2, 3, 4, 1, 3}, pixdim: [4]float32{1, 1, 1, 1}, datatype: DtFloat32, values: sequence(72)},
+			dims:   [3]int{2, 3, 4}, components: 3, spacing: [3]float64{1, 1, 1}, affine: mgl64.Ident4(),
+			value: 23, raw: 23,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := ReadFrom(bytes.NewReader(encodeVolume(t, test.volume)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Dims != test.dims || v.Components != test.components {
+				t.Errorf("dims %v with %d components, %v with %d expected", v.Dims, v.Components, test.dims, test.components)
+			}
+			for axis := 0; axis < 3; axis++ {
+				if math.Abs(v.Spacing[axis]-test.spacing[axis]) > 1e-6 {
+					t.Errorf("spacing %v, %v expected", v.Spacing, test.spacing)
+					break
+				}
+			}
+			if !approxEqual(v.Affine, test.affine) {
+				t.Errorf("affine\n%v\nexpected\n%v", v.Affine, test.affine)
+			}
+			if value := v.At(1, 2, 3); value != test.value {
+				t.Errorf("value %v, %v expected", value, test.value)
+			}
+			if raw := v.Raw(1, 2, 3); raw != test.raw {
+				t.Errorf("raw value %v, %v expected", raw, test.raw)
+			}
+			if v.Components == 3 {
+				if value := v.Component(1, 2, 3, 2); value != 71 {
+					t.Errorf("last component %v, 71 expected", value)
+				}
+			}
+		})
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	valid := testVolume{order: binary.LittleEndian, dims: []int16{2, 3, 4}, pixdim: [4]float32{1, 1, 1, 1}, datatype: DtUint8, values: sequence(24)}
+	encoded := encodeVolume(t, valid)
+
+	badMagic := append([]byte{}, encoded...)
+	copy(badMagic[344:], "ni1\x00")
+	badSize := append([]byte{}, encoded...)
+	badSize[0] = 0
+	unknownType := valid
+	unknownType.datatype = 2048
+	unknownType.values = nil
+	badDims := valid
+	badDims.dims = []int16{2, 0, 4}
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(encoded[:len(encoded)-5])
+	gz.Close()
+
+	tests := []struct {
+		name string
+		data []byte
+		//expected part of the error message
+		err string
+	}{
+		{"truncated data", encoded[:len(encoded)-1], "data"},
+		{"truncated gzip data", gzipped.Bytes(), "data"},
+		{"truncated header", encoded[:100], "header"},
+		{"not NIfTI", badSize, "not a NIfTI"},
+		{"two-file NIfTI", badMagic, "magic"},
+		{"unsupported datatype", encodeVolume(t, unknownType), "datatype"},
+		{"invalid dimension", encodeVolume(t, badDims), "dimension"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadFrom(bytes.NewReader(test.data))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error containing '%s' expected, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestReadGeometry(t *testing.T) {
+	encoded := encodeVolume(t, testVolume{order: binary.LittleEndian, dims: []int16{2, 3, 4}, pixdim: [4]float32{1, 2, 3, 4}, datatype: DtUint8, values: sequence(24)})
+	filePath := filepath.Join(t.TempDir(), "volume.nii")
+	//data is not needed
+	if err := os.WriteFile(filePath, encoded[:headerSize], 0644); err != nil {
+		t.Fatal(err)
+	}
+	v, err := ReadGeometry(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Dims != [3]int{2, 3, 4} || !approxEqual(v.Affine, mgl64.Scale3D(2, 3, 4)) {
+		t.Errorf("unexpected geometry: dims %v, affine %v", v.Dims, v.Affine)
+	}
+	//memory needed to load the volume is known from its header
+	if size := v.DataSize(); size != 24 {
+		t.Errorf("data size %d, 24 expected", size)
+	}
+	if _, err := Read(filePath); err == nil {
+		t.Errorf("truncated volume read along with its data")
+	}
+}
+
+func TestGeometry(t *testing.T) {
+	encoded := encodeVolume(t, testVolume{
+		order: binary.LittleEndian, dims: []int16{2, 3, 4, 1, 3}, pixdim: [4]float32{1, 2, 3, 4}, datatype: DtFloat32, values: sequence(72),
+		sformCode: 1, srow: [3][4]float32{{-2, 0, 0, 10}, {0, 3, 0, -20}, {0, 0, 4, 30}},
+	})
+	v, err := ReadFrom(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ijk := mgl64.Vec3{1, 2, 3}
+	ras := v.ToWorld(ijk)
+	if !ras.ApproxEqual(mgl64.Vec3{8, -14, 42}) {
+		t.Errorf("world coordinates %v, (8, -14, 42) expected", ras)
+	}
+	if back := v.ToVoxel(ras); !back.ApproxEqual(ijk) {
+		t.Errorf("voxel coordinates %v, %v expected", back, ijk)
+	}
+
+	axes, positive := v.Orientation()
+	if axes != [3]int{0, 1, 2} || positive != [3]bool{false, true, true} {
+		t.Errorf("orientation %v %v, [0 1 2] [false true true] expected", axes, positive)
+	}
+
+	//values are linear in indices, hence exactly interpolated
+	value, ok := v.Interpolate(mgl64.Vec3{0.5, 1.25, 2.5}, 1)
+	if expected := 24 + 0.5 + 2*1.25 + 6*2.5; !ok || math.Abs(value-expected) > 1e-9 {
+		t.Errorf("interpolated %v (%v), %v expected", value, ok, expected)
+	}
+	//upper bound is included
+	if value, ok := v.Interpolate(mgl64.Vec3{1, 2, 3}, 0); !ok || value != 23 {
+		t.Errorf("interpolated %v (%v) at last voxel, 23 expected", value, ok)
+	}
+	if _, ok := v.Interpolate(mgl64.Vec3{1.01, 0, 0}, 0); ok {
+		t.Errorf("interpolation outside of the volume")
+	}
+
+	other := *v
+	if !v.SameGrid(&other) {
+		t.Errorf("volume not on its own grid")
+	}
+	other.Affine = mgl64.Translate3D(0.5, 0, 0).Mul4(v.Affine)
+	if v.SameGrid(&other) {
+		t.Errorf("shifted grids considered the same")
+	}
+}
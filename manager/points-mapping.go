@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-gl/mathgl/mgl64"
+
+	"rikencau/abart-manager/colortable"
+	"rikencau/abart-manager/itktransform"
+	"rikencau/abart-manager/nifti"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Mapping of points between user space (input volume) and atlas space, with the transforms of a registration
+
+	POST /api/tasks/{taskId}/points
+	{"space": "user"|"atlas", "coordinates": "ras"|"voxel", "points": [[x, y, z], ...]}
+
+Each point is returned in both spaces, as RAS (mm) and voxel coordinates (of the input volume in user space,
+of the registered volume in atlas space), along with the atlas label at its location.
+
+As for ANTs, transforms map points from atlas (fixed) space to user (moving) space:
+	p_user = A(p_atlas + warp(p_atlas))
+and conversely
+	p_atlas = q + inverseWarp(q), where q = A⁻¹(p_user)
+computed in ITK physical space (LPS).
+*/
+
+//max number of points mapped by a single request
+const maxMappedPoints = 10000
+
+const (
+	pointSpaceUser  = "user"
+	pointSpaceAtlas = "atlas"
+)
+
+type PointsMappingRequest struct {
+	//space of the specified points: "user" or "atlas"
+	Space string `json:"space"`
+	//"ras" (mm, default) or "voxel"
+	Coordinates string       `json:"coordinates"`
+	Points      [][3]float64 `json:"points"`
+}
+
+type PointCoordinates struct {
+	Ras   [3]float64 `json:"ras"`
+	Voxel [3]float64 `json:"voxel"`
+}
+
+type PointLabel struct {
+	Id   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+type MappedPoint struct {
+	User  PointCoordinates `json:"user"`
+	Atlas PointCoordinates `json:"atlas"`
+	//atlas label at the point (omitted if the point lies outside of the labels)
+	Label *PointLabel `json:"label,omitempty"`
+	//point lies outside of the warp field, only the affine transform was applied
+	OutsideWarpField bool `json:"outsideWarpField,omitempty"`
+}
+
+type PointsMappingResponse struct {
+	TaskId TaskId        `json:"taskId"`
+	Points []MappedPoint `json:"points"`
+}
+
+func rasToLps(p mgl64.Vec3) mgl64.Vec3 {
+	return mgl64.Vec3{-p[0], -p[1], p[2]}
+}
+
+//same conversion, in both directions
+var lpsToRas = rasToLps
+
+func toArray(p mgl64.Vec3) [3]float64 {
+	return [3]float64{p[0], p[1], p[2]}
+}
+
+//displace the point (LPS) by the field, unchanged if it lies outside of the field
+func displace(field *nifti.Volume, p mgl64.Vec3) (mgl64.Vec3, bool) {
+	if field == nil {
+		return p, true
+	}
+	ijk := field.ToVoxel(lpsToRas(p))
+	var displacement mgl64.Vec3
+	for c := 0; c < 3; c++ {
+		value, ok := field.Interpolate(ijk, c)
+		if !ok {
+			return p, false
+		}
+		displacement[c] = value
+	}
+	return p.Add(displacement), true
+}
+
+//pointMapper holds what is needed to map points of a registration task
+type pointMapper struct {
+	affine *itktransform.Affine
+	//only the field of the requested direction is loaded
+	warp        *nifti.Volume
+	inverseWarp *nifti.Volume
+	//geometry of user and atlas spaces
+	userGrid  *nifti.Volume
+	atlasGrid *nifti.Volume
+	labels    *nifti.Volume
+	colors    *colortable.Table
+	//releases the memory reserved for the volumes, once points are mapped
+	release func()
+}
+
+//load what is needed to map points from the specified space, memory being reserved for the volumes until the
+//mapper is released
+func newPointMapper(ctx context.Context, taskDir string, fromSpace string) (*pointMapper, error) {
+	transforms, err := findRegistrationTransforms(taskDir)
+	if err != nil {
+		return nil, err
+	}
+	pm := &pointMapper{}
+	if transforms.Affine != "" {
+		affine, err := itktransform.ReadAffine(transforms.Affine)
+		if err != nil {
+			return nil, fmt.Errorf("could not read affine transform: %w", err)
+		}
+		pm.affine = &affine
+	}
+	fieldPath := ""
+	if fromSpace == pointSpaceAtlas && transforms.Warp != "" {
+		fieldPath = transforms.Warp
+	} else if fromSpace == pointSpaceUser && transforms.InverseWarp != "" {
+		fieldPath = transforms.InverseWarp
+	} else if transforms.Warp != "" {
+		return nil, fmt.Errorf("inverse warp field is not available among results")
+	}
+	labelsPath, _ := getTaskVolumePath(taskDir, taskVolumeLabels)
+	if !fileExists(labelsPath) {
+		labelsPath = ""
+	}
+
+	//other volumes are only read for their geometry
+	if pm.release, err = acquireVolumeProcessing(ctx, fieldPath, labelsPath); err != nil {
+		return nil, err
+	}
+	if err := pm.load(taskDir, fieldPath, fromSpace, labelsPath); err != nil {
+		pm.release()
+		return nil, err
+	}
+	return pm, nil
+}
+
+func (pm *pointMapper) load(taskDir string, fieldPath string, fromSpace string, labelsPath string) error {
+	if fieldPath != "" {
+		field, err := nifti.Read(fieldPath)
+		if err != nil {
+			return fmt.Errorf("could not read warp field: %w", err)
+		}
+		if field.Components != 3 {
+			return fmt.Errorf("warp field has %d components, 3 expected", field.Components)
+		}
+		if fromSpace == pointSpaceAtlas {
+			pm.warp = field
+		} else {
+			pm.inverseWarp = field
+		}
+	}
+
+	var err error
+	//labels mapped to the input volume share its grid
+	if labelsPath != "" {
+		if pm.labels, err = nifti.Read(labelsPath); err != nil {
+			return fmt.Errorf("could not read labels: %w", err)
+		}
+		pm.userGrid = pm.labels
+		if colorTablePath := findColorTable(filepath.Join(taskDir, resultsDirName)); colorTablePath != "" {
+			pm.colors, _ = colortable.Read(colorTablePath)
+		}
+	} else if inputPath, err := getTaskVolumePath(taskDir, taskVolumeInput); err == nil {
+		if pm.userGrid, err = nifti.ReadGeometry(inputPath); err != nil {
+			return fmt.Errorf("could not read input volume: %w", err)
+		}
+	}
+	if pm.userGrid == nil {
+		return fmt.Errorf("input volume is not available")
+	}
+	registeredPath, _ := getTaskVolumePath(taskDir, taskVolumeRegistered)
+	if pm.atlasGrid, err = nifti.ReadGeometry(registeredPath); err != nil {
+		return fmt.Errorf("could not read registered volume: %w", err)
+	}
+	return nil
+}
+
+//map a point in RAS coordinates of the specified space
+func (pm *pointMapper) mapPoint(fromSpace string, ras mgl64.Vec3) MappedPoint {
+	var userRas, atlasRas mgl64.Vec3
+	inside := true
+	if fromSpace == pointSpaceAtlas {
+		atlasRas = ras
+		p, ok := displace(pm.warp, rasToLps(ras))
+		if pm.affine != nil {
+			p = pm.affine.Transform(p)
+		}
+		userRas, inside = lpsToRas(p), ok
+	} else {
+		userRas = ras
+		q := rasToLps(ras)
+		if pm.affine != nil {
+			q = pm.affine.InverseTransform(q)
+		}
+		p, ok := displace(pm.inverseWarp, q)
+		atlasRas, inside = lpsToRas(p), ok
+	}
+
+	point := MappedPoint{
+		User:             PointCoordinates{Ras: toArray(userRas), Voxel: toArray(pm.userGrid.ToVoxel(userRas))},
+		Atlas:            PointCoordinates{Ras: toArray(atlasRas), Voxel: toArray(pm.atlasGrid.ToVoxel(atlasRas))},
+		OutsideWarpField: !inside,
+	}
+	if pm.labels != nil {
+		ijk := pm.labels.ToVoxel(userRas)
+		i, j, k := int(math.Round(ijk[0])), int(math.Round(ijk[1])), int(math.Round(ijk[2]))
+		if pm.labels.Contains(i, j, k) {
+			point.Label = &PointLabel{Id: pm.labels.Label(i, j, k)}
+			if pm.colors != nil {
+				if entry, ok := pm.colors.Lookup(point.Label.Id); ok {
+					point.Label.Name = entry.Name
+				}
+			}
+		}
+	}
+	return point
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+func (api *TaskApiImpl) mapPoints(w http.ResponseWriter, r *http.Request) {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	logger := requestLogger(r).WithField("task", task.id)
+
+	var req PointsMappingRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Space = strings.ToLower(req.Space)
+	req.Coordinates = strings.ToLower(req.Coordinates)
+	if req.Coordinates == "" {
+		req.Coordinates = "ras"
+	}
+	if req.Space != pointSpaceUser && req.Space != pointSpaceAtlas {
+		http.Error(w, fmt.Sprintf("Unknown space '%s' (user, atlas)", req.Space), http.StatusBadRequest)
+		return
+	}
+	if req.Coordinates != "ras" && req.Coordinates != "voxel" {
+		http.Error(w, fmt.Sprintf("Unknown coordinates '%s' (ras, voxel)", req.Coordinates), http.StatusBadRequest)
+		return
+	}
+	if len(req.Points) == 0 || len(req.Points) > maxMappedPoints {
+		http.Error(w, fmt.Sprintf("Between 1 and %d points must be specified", maxMappedPoints), http.StatusBadRequest)
+		return
+	}
+
+	metadata := task.getMetadata()
+	if status, _ := task.getStatus(); status != StatusFinished || metadata.ParentTaskId != "" {
+		http.Error(w, "Points can only be mapped with a finished registration task", http.StatusConflict)
+		return
+	}
+
+	mapper, err := newPointMapper(r.Context(), task.workdir, req.Space)
+	if err != nil {
+		if r.Context().Err() != nil {
+			//client is gone
+			return
+		}
+		logger.WithError(err).Warn("Could not map points")
+		http.Error(w, "Could not map points: "+err.Error(), http.StatusConflict)
+		return
+	}
+	defer mapper.release()
+	grid := mapper.userGrid
+	if req.Space == pointSpaceAtlas {
+		grid = mapper.atlasGrid
+	}
+
+	response := PointsMappingResponse{TaskId: task.id, Points: make([]MappedPoint, 0, len(req.Points))}
+	for _, coordinates := range req.Points {
+		ras := mgl64.Vec3(coordinates)
+		if req.Coordinates == "voxel" {
+			ras = grid.ToWorld(ras)
+		}
+		response.Points = append(response.Points, mapper.mapPoint(req.Space, ras))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
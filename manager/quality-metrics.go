@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl64"
+
+	"rikencau/abart-manager/nifti"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Registration quality metrics
+
+Computed by the manager once a task has finished, and stored in its metadata:
+	- similarity between the registered volume and the atlas template:
+	  normalized cross-correlation, and mutual information (within the atlas brain mask if specified)
+	- overlap (Dice) between the atlas brain mask and the brain mask of the registered volume,
+	  when the worker produced one (artifact under registered/ whose name contains "mask")
+	- statistics of the Jacobian determinant of the warp field (values <= 0 denote folding)
+
+Template and brain mask of the atlas are files read by the manager, in the space of the registered volume.
+*/
+type QualityConfig struct {
+	//atlas template volume (NIfTI), similarity metrics are not computed if not specified
+	AtlasTemplate string `yaml:"atlas_template"`
+	//atlas brain mask volume (NIfTI), optional
+	AtlasBrainMask string `yaml:"atlas_brain_mask"`
+}
+
+func (qc QualityConfig) validate() error {
+	for _, filePath := range []string{qc.AtlasTemplate, qc.AtlasBrainMask} {
+		if filePath != "" && !fileExists(filePath) {
+			return fmt.Errorf("file '%s' not found", filePath)
+		}
+	}
+	return nil
+}
+
+//number of bins of the joint histogram used to compute mutual information
+const mutualInformationBins = 32
+
+type JacobianStats struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+	Std  float64 `json:"std"`
+	//fraction of voxels where the warp folds (determinant <= 0)
+	NonPositiveFraction float64 `json:"nonPositiveFraction"`
+}
+
+type QualityMetrics struct {
+	ComputedAt time.Time `json:"computedAt"`
+	//normalized cross-correlation between registered volume and atlas template ([-1, 1])
+	Ncc *float64 `json:"ncc,omitempty"`
+	//mutual information between registered volume and atlas template (bits)
+	MutualInformation *float64 `json:"mutualInformation,omitempty"`
+	//overlap of brain masks ([0, 1])
+	Dice *float64 `json:"dice,omitempty"`
+	//Jacobian determinant of the warp field
+	Jacobian *JacobianStats `json:"jacobian,omitempty"`
+	//metrics which could not be computed, and why
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//indices of the voxels to consider (nil mask means all voxels)
+func maskedVoxels(v *nifti.Volume, mask *nifti.Volume, visit func(i, j, k int)) {
+	for k := 0; k < v.Dims[2]; k++ {
+		for j := 0; j < v.Dims[1]; j++ {
+			for i := 0; i < v.Dims[0]; i++ {
+				if mask == nil || mask.Raw(i, j, k) != 0 {
+					visit(i, j, k)
+				}
+			}
+		}
+	}
+}
+
+func normalizedCrossCorrelation(a, b *nifti.Volume, mask *nifti.Volume) float64 {
+	var n, sumA, sumB, sumAA, sumBB, sumAB float64
+	maskedVoxels(a, mask, func(i, j, k int) {
+		va, vb := a.At(i, j, k), b.At(i, j, k)
+		n++
+		sumA += va
+		sumB += vb
+		sumAA += va * va
+		sumBB += vb * vb
+		sumAB += va * vb
+	})
+	if n == 0 {
+		return 0
+	}
+	covariance := sumAB - sumA*sumB/n
+	varianceA := sumAA - sumA*sumA/n
+	varianceB := sumBB - sumB*sumB/n
+	if varianceA <= 0 || varianceB <= 0 {
+		return 0
+	}
+	return covariance / math.Sqrt(varianceA*varianceB)
+}
+
+func mutualInformation(a, b *nifti.Volume, mask *nifti.Volume) float64 {
+	minA, maxA := math.Inf(1), math.Inf(-1)
+	minB, maxB := math.Inf(1), math.Inf(-1)
+	maskedVoxels(a, mask, func(i, j, k int) {
+		va, vb := a.At(i, j, k), b.At(i, j, k)
+		minA, maxA = math.Min(minA, va), math.Max(maxA, va)
+		minB, maxB = math.Min(minB, vb), math.Max(maxB, vb)
+	})
+	bin := func(value, min, max float64) int {
+		if max <= min {
+			return 0
+		}
+		return int(math.Min(mutualInformationBins-1, (value-min)/(max-min)*mutualInformationBins))
+	}
+
+	var joint [mutualInformationBins][mutualInformationBins]float64
+	n := 0.0
+	maskedVoxels(a, mask, func(i, j, k int) {
+		joint[bin(a.At(i, j, k), minA, maxA)][bin(b.At(i, j, k), minB, maxB)]++
+		n++
+	})
+	if n == 0 {
+		return 0
+	}
+	var marginalA, marginalB [mutualInformationBins]float64
+	for x := range joint {
+		for y := range joint[x] {
+			marginalA[x] += joint[x][y] / n
+			marginalB[y] += joint[x][y] / n
+		}
+	}
+	mi := 0.0
+	for x := range joint {
+		for y := range joint[x] {
+			if p := joint[x][y] / n; p > 0 {
+				mi += p * math.Log2(p/(marginalA[x]*marginalB[y]))
+			}
+		}
+	}
+	return mi
+}
+
+func diceCoefficient(a, b *nifti.Volume) float64 {
+	var countA, countB, countBoth float64
+	maskedVoxels(a, nil, func(i, j, k int) {
+		inA, inB := a.Raw(i, j, k) != 0, b.Raw(i, j, k) != 0
+		if inA {
+			countA++
+		}
+		if inB {
+			countB++
+		}
+		if inA && inB {
+			countBoth++
+		}
+	})
+	if countA+countB == 0 {
+		return 0
+	}
+	return 2 * countBoth / (countA + countB)
+}
+
+/*
+Jacobian determinant of the transform x -> x + u(x) defined by the displacement field u, at interior voxels.
+As produced by ANTs (ITK), displacement vectors are expressed in LPS physical space, so derivatives are taken
+with respect to LPS coordinates as well.
+*/
+func jacobianStats(field *nifti.Volume) (*JacobianStats, error) {
+	if field.Components != 3 {
+		return nil, fmt.Errorf("warp field has %d components, 3 expected", field.Components)
+	}
+	for axis := 0; axis < 3; axis++ {
+		if field.Dims[axis] < 3 {
+			return nil, fmt.Errorf("warp field is too small")
+		}
+	}
+	//voxel to LPS transform (linear part), inverted to get derivatives with respect to physical coordinates
+	rasToLps := mgl64.Diag3(mgl64.Vec3{-1, -1, 1})
+	voxelToLps := rasToLps.Mul3(field.Affine.Mat3())
+	if math.Abs(voxelToLps.Det()) < 1e-12 {
+		return nil, fmt.Errorf("warp field has a degenerate voxel to world transform")
+	}
+	lpsToVoxel := voxelToLps.Inv()
+
+	stats := &JacobianStats{Min: math.Inf(1), Max: math.Inf(-1)}
+	var n, sum, sumSquares, nonPositive float64
+	for k := 1; k < field.Dims[2]-1; k++ {
+		for j := 1; j < field.Dims[1]-1; j++ {
+			for i := 1; i < field.Dims[0]-1; i++ {
+				//derivatives of each component along voxel axes (central differences)
+				var voxelGradient mgl64.Mat3
+				for c := 0; c < 3; c++ {
+					voxelGradient.Set(c, 0, (field.Component(i+1, j, k, c)-field.Component(i-1, j, k, c))/2)
+					voxelGradient.Set(c, 1, (field.Component(i, j+1, k, c)-field.Component(i, j-1, k, c))/2)
+					voxelGradient.Set(c, 2, (field.Component(i, j, k+1, c)-field.Component(i, j, k-1, c))/2)
+				}
+				det := mgl64.Ident3().Add(voxelGradient.Mul3(lpsToVoxel)).Det()
+				stats.Min = math.Min(stats.Min, det)
+				stats.Max = math.Max(stats.Max, det)
+				sum += det
+				sumSquares += det * det
+				if det <= 0 {
+					nonPositive++
+				}
+				n++
+			}
+		}
+	}
+	stats.Mean = sum / n
+	stats.Std = math.Sqrt(math.Max(0, sumSquares/n-stats.Mean*stats.Mean))
+	stats.NonPositiveFraction = nonPositive / n
+	return stats, nil
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//forward warp field, and brain mask of the registered volume, among the artifacts of the task (empty if none)
+func findQualityArtifacts(taskDir string) (warpField string, brainMask string, err error) {
+	artifacts, err := listResultArtifacts(taskDir)
+	if err != nil {
+		return "", "", err
+	}
+	for _, artifact := range artifacts {
+		name := strings.ToLower(filepath.Base(artifact.Path))
+		if strings.HasPrefix(artifact.Path, "registered/") && strings.Contains(name, "mask") {
+			brainMask = filepath.Join(taskDir, resultsDirName, filepath.FromSlash(artifact.Path))
+			break
+		}
+	}
+	//missing transforms are reported by the Jacobian metric
+	transforms, _ := findRegistrationTransforms(taskDir)
+	return transforms.Warp, brainMask, nil
+}
+
+//volumes read to compute the metrics of the task (paths are empty for missing ones)
+func qualityVolumes(taskDir string, qc QualityConfig) []string {
+	registeredPath, _ := getTaskVolumePath(taskDir, taskVolumeRegistered)
+	warpFieldPath, userMaskPath, _ := findQualityArtifacts(taskDir)
+	return []string{registeredPath, qc.AtlasTemplate, qc.AtlasBrainMask, userMaskPath, warpFieldPath}
+}
+
+//compute the metrics which can be computed, the reasons why others can not be are reported as warnings
+func computeQualityMetrics(taskDir string, qc QualityConfig) QualityMetrics {
+	metrics := QualityMetrics{}
+	warn := func(format string, args ...interface{}) {
+		metrics.Warnings = append(metrics.Warnings, fmt.Sprintf(format, args...))
+	}
+	warpFieldPath, userMaskPath, err := findQualityArtifacts(taskDir)
+	if err != nil {
+		warn("could not list results: %v", err)
+	}
+
+	var atlasMask *nifti.Volume
+	if qc.AtlasBrainMask != "" {
+		if atlasMask, err = nifti.Read(qc.AtlasBrainMask); err != nil {
+			warn("could not read atlas brain mask: %v", err)
+		}
+	}
+
+	if qc.AtlasTemplate == "" {
+		warn("similarity not computed: atlas template not specified")
+	} else if registered, err := loadTaskVolume(taskDir, taskVolumeRegistered); err != nil {
+		warn("similarity not computed: could not read registered volume: %v", err)
+	} else if template, err := nifti.Read(qc.AtlasTemplate); err != nil {
+		warn("similarity not computed: could not read atlas template: %v", err)
+	} else if !registered.SameGrid(template) {
+		warn("similarity not computed: registered volume and atlas template do not share the same grid")
+	} else {
+		mask := atlasMask
+		if mask != nil && !mask.SameGrid(template) {
+			warn("atlas brain mask ignored for similarity: it does not share the grid of the atlas template")
+			mask = nil
+		}
+		ncc := normalizedCrossCorrelation(registered, template, mask)
+		mi := mutualInformation(registered, template, mask)
+		metrics.Ncc, metrics.MutualInformation = &ncc, &mi
+	}
+
+	if atlasMask != nil && userMaskPath != "" {
+		if userMask, err := nifti.Read(userMaskPath); err != nil {
+			warn("Dice not computed: could not read brain mask of registered volume: %v", err)
+		} else if !userMask.SameGrid(atlasMask) {
+			warn("Dice not computed: brain masks do not share the same grid")
+		} else {
+			dice := diceCoefficient(atlasMask, userMask)
+			metrics.Dice = &dice
+		}
+	}
+
+	if warpFieldPath == "" {
+		warn("Jacobian not computed: no warp field among results")
+	} else if field, err := nifti.Read(warpFieldPath); err != nil {
+		warn("Jacobian not computed: could not read warp field: %v", err)
+	} else if stats, err := jacobianStats(field); err != nil {
+		warn("Jacobian not computed: %v", err)
+	} else {
+		metrics.Jacobian = stats
+	}
+
+	metrics.ComputedAt = time.Now()
+	return metrics
+}
+
+//computations of quality metrics in progress (closed once done), so that metrics of a task are computed once
+var qualityComputations = struct {
+	sync.Mutex
+	inProgress map[TaskId]chan struct{}
+}{inProgress: make(map[TaskId]chan struct{})}
+
+//metrics already stored for the task, possibly by another instance of the task (hence read from its state directory as well)
+func (t *Task) storedQualityMetrics() *QualityMetrics {
+	if metrics := t.getMetadata().Quality; metrics != nil {
+		return metrics
+	}
+	if metadata, err := loadTaskMetadata(t.statedir); err == nil {
+		return metadata.Quality
+	}
+	return nil
+}
+
+//metrics of the task, computed and stored in its metadata unless already done
+func (t *Task) ensureQualityMetrics(ctx context.Context, qc QualityConfig) (*QualityMetrics, error) {
+	var done chan struct{}
+	for {
+		if metrics := t.storedQualityMetrics(); metrics != nil {
+			return metrics, nil
+		}
+		qualityComputations.Lock()
+		var busy bool
+		done, busy = qualityComputations.inProgress[t.id]
+		if !busy {
+			done = make(chan struct{})
+			qualityComputations.inProgress[t.id] = done
+			qualityComputations.Unlock()
+			break
+		}
+		qualityComputations.Unlock()
+		//wait for the computation in progress, then check its outcome
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	defer func() {
+		qualityComputations.Lock()
+		delete(qualityComputations.inProgress, t.id)
+		close(done)
+		qualityComputations.Unlock()
+	}()
+
+	release, err := acquireVolumeProcessing(ctx, qualityVolumes(t.workdir, qc)...)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	start := time.Now()
+	metrics := computeQualityMetrics(t.workdir, qc)
+	t.updateMetadata(func(m *TaskMetadata) {
+		m.Quality = &metrics
+	})
+	logger := t.logger().WithField("duration_ms", float64(time.Since(start))/float64(time.Millisecond))
+	if len(metrics.Warnings) > 0 {
+		logger = logger.WithField("warnings", strings.Join(metrics.Warnings, "; "))
+	}
+	logger.Info("Quality metrics computed")
+	return &metrics, nil
+}
+
+//compute metrics once the task has finished; if interrupted (e.g. by shutdown), they are computed on request
+func (t *Task) computeQualityMetrics(qc QualityConfig) {
+	if _, err := t.ensureQualityMetrics(context.Background(), qc); err != nil {
+		t.logger().WithError(err).Warn("Could not compute quality metrics")
+	}
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+func (api *TaskApiImpl) getQualityMetrics(w http.ResponseWriter, r *http.Request) {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	metrics := task.getMetadata().Quality
+	if metrics == nil {
+		metadata := task.getMetadata()
+		if status, _ := task.getStatus(); status != StatusFinished || metadata.ParentTaskId != "" {
+			http.Error(w, "Quality metrics not available.", http.StatusNotFound)
+			return
+		}
+		//metrics were not computed once the task finished (e.g. the manager stopped meanwhile)
+		var err error
+		if metrics, err = task.ensureQualityMetrics(r.Context(), api.th.quality); err != nil {
+			requestLogger(r).WithError(err).WithField("task", task.id).Warn("Could not compute quality metrics")
+			http.Error(w, "Quality metrics not available.", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
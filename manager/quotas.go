@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	log "github.com/sirupsen/logrus"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Per-user quotas
+
+Limits apply to each task owner (i.e. authenticated subject, or anonymous user when authentication is disabled):
+	- max_running: tasks processed at same time; further tasks wait in the queue without occupying a worker
+	- max_queued: tasks waiting to be processed; further submissions are rejected
+	- max_submissions_per_hour: submissions within the last hour; further submissions are rejected
+	- max_stored: bytes stored in the working directories of the user's tasks (e.g. "20g"); further submissions are rejected
+
+0 (or empty) means unlimited. Limits specified for a given user replace the default ones entirely.
+Submissions rejected due to a quota get a 429 response explaining which limit was hit.
+
+Limits set at runtime by admins override the configured ones, and are persisted in the base working directory.
+*/
+type QuotaLimits struct {
+	MaxRunning            int    `yaml:"max_running,omitempty" json:"maxRunning"`
+	MaxQueued             int    `yaml:"max_queued,omitempty" json:"maxQueued"`
+	MaxSubmissionsPerHour int    `yaml:"max_submissions_per_hour,omitempty" json:"maxSubmissionsPerHour"`
+	MaxStored             string `yaml:"max_stored,omitempty" json:"maxStored,omitempty"`
+}
+
+type QuotaConfig struct {
+	//default limits
+	QuotaLimits `yaml:",inline"`
+	//limits of specific users
+	Users map[string]QuotaLimits `yaml:"users,omitempty"`
+}
+
+//quota user of tasks without owner
+const anonymousUser = "anonymous"
+
+//file of the base working directory holding limits set at runtime (not a valid task ID, hence not taken for a task)
+const quotaOverridesFileName = ".quota-overrides.json"
+
+//how long the stored bytes computed from the working directories are reused
+const storedUsageTTL = time.Minute
+
+func quotaUser(owner string) string {
+	if owner == "" {
+		return anonymousUser
+	}
+	return owner
+}
+
+func (limits QuotaLimits) validate() error {
+	if limits.MaxRunning < 0 || limits.MaxQueued < 0 || limits.MaxSubmissionsPerHour < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	_, err := limits.maxStoredBytes()
+	return err
+}
+
+func (limits QuotaLimits) maxStoredBytes() (int64, error) {
+	if limits.MaxStored == "" {
+		return 0, nil
+	}
+	maxStored, err := units.RAMInBytes(limits.MaxStored)
+	if err != nil || maxStored < 0 {
+		return 0, fmt.Errorf("invalid max stored size '%s'", limits.MaxStored)
+	}
+	return maxStored, nil
+}
+
+func (qc QuotaConfig) validate() error {
+	if err := qc.QuotaLimits.validate(); err != nil {
+		return err
+	}
+	for user, limits := range qc.Users {
+		if err := limits.validate(); err != nil {
+			return fmt.Errorf("user '%s': %w", user, err)
+		}
+	}
+	return nil
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//QuotaExceededError explains which limit prevents a submission
+type QuotaExceededError struct {
+	//name of the limit (as in configuration)
+	Limit   string `json:"limit"`
+	Max     int64  `json:"max"`
+	Current int64  `json:"current"`
+	//when the limit will allow a new submission, if known
+	ResetAt *time.Time `json:"resetAt,omitempty"`
+	Message string     `json:"message"`
+}
+
+func (e *QuotaExceededError) Error() string {
+	return e.Message
+}
+
+//QuotaUsage reports the usage of a user along with its limits
+type QuotaUsage struct {
+	User                string      `json:"user"`
+	Limits              QuotaLimits `json:"limits"`
+	Running             int         `json:"running"`
+	Queued              int         `json:"queued"`
+	SubmissionsLastHour int         `json:"submissionsLastHour"`
+	StoredBytes         int64       `json:"storedBytes"`
+}
+
+//QuotaManager tracks usage of each user, and checks submissions against their limits
+type QuotaManager struct {
+	baseWorkDir string
+
+	mu       sync.Mutex
+	defaults QuotaLimits
+	//effective limits of specific users: configured ones, replaced by overrides
+	users map[string]QuotaLimits
+	//limits of specific users, as configured
+	configured map[string]QuotaLimits
+	//limits set at runtime (persisted)
+	overrides map[string]QuotaLimits
+	//submission times within the last hour
+	submissions map[string][]time.Time
+	//submissions admitted, but not yet handed over to the task handler
+	pending map[string]int
+	//bytes stored by each user, computed from the working directories
+	stored   map[string]int64
+	storedAt time.Time
+	//incremented whenever stored bytes become outdated
+	storedGen int
+	//serializes computations of stored bytes, which are made without holding mu
+	storedMu sync.Mutex
+}
+
+func newQuotaManager(qc QuotaConfig, baseWorkDir string) *QuotaManager {
+	qm := &QuotaManager{
+		baseWorkDir: baseWorkDir,
+		defaults:    qc.QuotaLimits,
+		users:       make(map[string]QuotaLimits),
+		configured:  make(map[string]QuotaLimits),
+		overrides:   make(map[string]QuotaLimits),
+		submissions: make(map[string][]time.Time),
+		pending:     make(map[string]int),
+	}
+	for user, limits := range qc.Users {
+		qm.configured[user] = limits
+		qm.users[user] = limits
+	}
+	if err := qm.loadOverrides(); err != nil {
+		log.WithError(err).Warn("Could not restore quota limits set at runtime")
+	}
+	return qm
+}
+
+func (qm *QuotaManager) overridesFilePath() string {
+	return path.Join(qm.baseWorkDir, quotaOverridesFileName)
+}
+
+//restore limits set at runtime by a previous run of the manager
+func (qm *QuotaManager) loadOverrides() error {
+	jsonData, err := ioutil.ReadFile(qm.overridesFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	overrides := make(map[string]QuotaLimits)
+	if err := json.Unmarshal(jsonData, &overrides); err != nil {
+		return err
+	}
+	for user, limits := range overrides {
+		if err := limits.validate(); err != nil {
+			log.WithError(err).WithField("quota_user", user).Warn("Ignoring invalid quota limits set at runtime")
+			continue
+		}
+		qm.overrides[user] = limits
+		qm.users[user] = limits
+	}
+	return nil
+}
+
+//persist limits set at runtime, replacing the file at once so that it is never left partially written
+func (qm *QuotaManager) saveOverridesLocked(overrides map[string]QuotaLimits) error {
+	jsonData, err := json.MarshalIndent(overrides, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFilePath := qm.overridesFilePath() + ".tmp"
+	if err := ioutil.WriteFile(tempFilePath, jsonData, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempFilePath, qm.overridesFilePath())
+}
+
+func (qm *QuotaManager) limitsLocked(user string) QuotaLimits {
+	if limits, ok := qm.users[user]; ok {
+		return limits
+	}
+	return qm.defaults
+}
+
+func (qm *QuotaManager) getLimits(user string) QuotaLimits {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	return qm.limitsLocked(user)
+}
+
+//max number of tasks of the user processed at same time (0 means unlimited)
+func (qm *QuotaManager) maxRunning(user string) int {
+	return qm.getLimits(user).MaxRunning
+}
+
+//submissions of the user within the last hour (older ones are forgotten)
+func (qm *QuotaManager) recentSubmissionsLocked(user string, now time.Time) []time.Time {
+	recent := []time.Time{}
+	for _, submittedAt := range qm.submissions[user] {
+		if now.Sub(submittedAt) < time.Hour {
+			recent = append(recent, submittedAt)
+		}
+	}
+	if len(recent) > 0 {
+		qm.submissions[user] = recent
+	} else {
+		delete(qm.submissions, user)
+	}
+	return recent
+}
+
+//size of a directory tree
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+//bytes stored by each user, recomputed from the working directories when outdated
+//(mu must not be held, since computing them may take a while)
+func (qm *QuotaManager) storedUsage() map[string]int64 {
+	cached := func() (map[string]int64, int, bool) {
+		qm.mu.Lock()
+		defer qm.mu.Unlock()
+		return qm.stored, qm.storedGen, qm.stored != nil && time.Since(qm.storedAt) < storedUsageTTL
+	}
+	if stored, _, ok := cached(); ok {
+		return stored
+	}
+	//concurrent callers reuse the result of a single computation
+	qm.storedMu.Lock()
+	defer qm.storedMu.Unlock()
+	stored, gen, ok := cached()
+	if ok {
+		return stored
+	}
+
+	stored = make(map[string]int64)
+	entries, err := ioutil.ReadDir(qm.baseWorkDir)
+	if err != nil {
+		log.WithError(err).Warn("Could not compute stored usage")
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !isValidTaskId(entry.Name()) {
+			continue
+		}
+		taskDir := path.Join(qm.baseWorkDir, entry.Name())
+		metadata, _ := loadTaskMetadata(path.Join(qm.baseWorkDir, taskStateDirName, entry.Name()))
+		stored[quotaUser(metadata.Owner)] += dirSize(taskDir)
+	}
+
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	//not cached if outdated meanwhile
+	if qm.storedGen == gen {
+		qm.stored = stored
+		qm.storedAt = time.Now()
+	}
+	return stored
+}
+
+/*
+Check whether the user may submit a new task, given its currently queued tasks and the size of the upload.
+When admitted, the submission is accounted for, and the returned release function must be called once
+the task has been handed over to the task handler (or has failed).
+*/
+func (qm *QuotaManager) admit(user string, queued int, incomingBytes int64) (func(), *QuotaExceededError) {
+	var stored map[string]int64
+	if maxStored, _ := qm.getLimits(user).maxStoredBytes(); maxStored > 0 {
+		stored = qm.storedUsage()
+	}
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	now := time.Now()
+	limits := qm.limitsLocked(user)
+
+	if limits.MaxQueued > 0 {
+		current := queued + qm.pending[user]
+		if current >= limits.MaxQueued {
+			return nil, &QuotaExceededError{
+				Limit:   "max_queued",
+				Max:     int64(limits.MaxQueued),
+				Current: int64(current),
+				Message: fmt.Sprintf("Quota exceeded: at most %d queued tasks allowed, new tasks can be submitted once some start", limits.MaxQueued),
+			}
+		}
+	}
+
+	recent := qm.recentSubmissionsLocked(user, now)
+	if limits.MaxSubmissionsPerHour > 0 && len(recent) >= limits.MaxSubmissionsPerHour {
+		resetAt := recent[len(recent)-limits.MaxSubmissionsPerHour].Add(time.Hour)
+		return nil, &QuotaExceededError{
+			Limit:   "max_submissions_per_hour",
+			Max:     int64(limits.MaxSubmissionsPerHour),
+			Current: int64(len(recent)),
+			ResetAt: &resetAt,
+			Message: fmt.Sprintf("Quota exceeded: at most %d submissions per hour allowed, next submission allowed at %s", limits.MaxSubmissionsPerHour, resetAt.Format(time.RFC3339)),
+		}
+	}
+
+	if maxStored, _ := limits.maxStoredBytes(); maxStored > 0 {
+		current := stored[user]
+		if current+incomingBytes > maxStored {
+			return nil, &QuotaExceededError{
+				Limit:   "max_stored",
+				Max:     maxStored,
+				Current: current,
+				Message: fmt.Sprintf("Quota exceeded: at most %s of stored data allowed (currently %s), results of previous tasks must be removed first", units.BytesSize(float64(maxStored)), units.BytesSize(float64(current))),
+			}
+		}
+	}
+
+	qm.submissions[user] = append(recent, now)
+	qm.pending[user]++
+	return func() {
+		qm.mu.Lock()
+		defer qm.mu.Unlock()
+		if qm.pending[user]--; qm.pending[user] <= 0 {
+			delete(qm.pending, user)
+		}
+		//stored size has changed
+		qm.stored = nil
+		qm.storedGen++
+	}, nil
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//usage of the user, given its currently running and queued tasks
+func (qm *QuotaManager) getUsage(user string, running int, queued int) QuotaUsage {
+	stored := qm.storedUsage()
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	return QuotaUsage{
+		User:                user,
+		Limits:              qm.limitsLocked(user),
+		Running:             running,
+		Queued:              queued + qm.pending[user],
+		SubmissionsLastHour: len(qm.recentSubmissionsLocked(user, time.Now())),
+		StoredBytes:         stored[user],
+	}
+}
+
+//users having specific limits, or any recorded usage
+func (qm *QuotaManager) knownUsers() []string {
+	stored := qm.storedUsage()
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	known := make(map[string]bool)
+	for user := range qm.users {
+		known[user] = true
+	}
+	for user := range qm.submissions {
+		known[user] = true
+	}
+	for user := range stored {
+		known[user] = true
+	}
+	users := []string{}
+	for user := range known {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+//returned when limits are valid but could not be persisted
+type quotaPersistError struct {
+	err error
+}
+
+func (e *quotaPersistError) Error() string {
+	return fmt.Sprintf("could not persist quota limits: %v", e.err)
+}
+
+func (e *quotaPersistError) Unwrap() error {
+	return e.err
+}
+
+//set specific limits of the user (overriding configured ones)
+func (qm *QuotaManager) setLimits(user string, limits QuotaLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	overrides := make(map[string]QuotaLimits)
+	for other, otherLimits := range qm.overrides {
+		overrides[other] = otherLimits
+	}
+	overrides[user] = limits
+	if err := qm.saveOverridesLocked(overrides); err != nil {
+		return &quotaPersistError{err}
+	}
+	qm.overrides = overrides
+	qm.users[user] = limits
+	return nil
+}
+
+//user gets configured limits back (its specific limits if any, default ones otherwise)
+func (qm *QuotaManager) resetLimits(user string) error {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	if _, ok := qm.overrides[user]; ok {
+		overrides := make(map[string]QuotaLimits)
+		for other, otherLimits := range qm.overrides {
+			if other != user {
+				overrides[other] = otherLimits
+			}
+		}
+		if err := qm.saveOverridesLocked(overrides); err != nil {
+			return &quotaPersistError{err}
+		}
+		qm.overrides = overrides
+	}
+	if limits, ok := qm.configured[user]; ok {
+		qm.users[user] = limits
+	} else {
+		delete(qm.users, user)
+	}
+	return nil
+}
+
+//forget recent submissions of the user
+func (qm *QuotaManager) resetSubmissions(user string) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	delete(qm.submissions, user)
+}
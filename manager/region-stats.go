@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"rikencau/abart-manager/colortable"
+	"rikencau/abart-manager/nifti"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Per-region statistics
+
+	GET /api/tasks/{taskId}/regions?format=json|csv
+
+computes, for each atlas label found in the labels mapped to the input volume (AtlasToUser_labels), its voxel count,
+physical volume (mm³, from voxel size) and the mean and standard deviation of the input volume intensity.
+Names of regions come from the atlas color table.
+*/
+
+type RegionStats struct {
+	Id         int     `json:"id"`
+	Name       string  `json:"name"`
+	VoxelCount int64   `json:"voxelCount"`
+	VolumeMm3  float64 `json:"volumeMm3"`
+	//intensity of the input volume within the region (omitted if input volume is not available)
+	MeanIntensity *float64 `json:"meanIntensity,omitempty"`
+	StdIntensity  *float64 `json:"stdIntensity,omitempty"`
+}
+
+type RegionStatsResponse struct {
+	TaskId  TaskId `json:"taskId"`
+	AtlasId string `json:"atlasId,omitempty"`
+	//volume of a single voxel (mm³)
+	VoxelVolumeMm3 float64       `json:"voxelVolumeMm3"`
+	Regions        []RegionStats `json:"regions"`
+	//statistics which could not be computed, and why
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+//statistics of each non zero label, with intensities of the volume if any (which must share the grid of labels)
+func computeRegionStats(labels *nifti.Volume, intensities *nifti.Volume, colors *colortable.Table) ([]RegionStats, float64) {
+	type accumulator struct {
+		count      int64
+		sum        float64
+		sumSquares float64
+	}
+	accumulators := make(map[int]*accumulator)
+	maskedVoxels(labels, nil, func(i, j, k int) {
+		label := labels.Label(i, j, k)
+		if label == 0 {
+			return
+		}
+		acc, ok := accumulators[label]
+		if !ok {
+			acc = &accumulator{}
+			accumulators[label] = acc
+		}
+		acc.count++
+		if intensities != nil {
+			value := intensities.At(i, j, k)
+			acc.sum += value
+			acc.sumSquares += value * value
+		}
+	})
+
+	voxelVolume := labels.Spacing[0] * labels.Spacing[1] * labels.Spacing[2]
+	regions := make([]RegionStats, 0, len(accumulators))
+	for label, acc := range accumulators {
+		region := RegionStats{
+			Id:         label,
+			VoxelCount: acc.count,
+			VolumeMm3:  float64(acc.count) * voxelVolume,
+		}
+		if colors != nil {
+			if entry, ok := colors.Lookup(label); ok {
+				region.Name = entry.Name
+			}
+		}
+		if intensities != nil {
+			n := float64(acc.count)
+			mean := acc.sum / n
+			std := math.Sqrt(math.Max(0, acc.sumSquares/n-mean*mean))
+			region.MeanIntensity, region.StdIntensity = &mean, &std
+		}
+		regions = append(regions, region)
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Id < regions[j].Id })
+	return regions, voxelVolume
+}
+
+func writeRegionStatsCsv(w http.ResponseWriter, stats RegionStatsResponse) error {
+	fileName := "regions-" + string(stats.TaskId) + ".csv"
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+
+	formatFloat := func(value *float64) string {
+		if value == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*value, 'g', -1, 64)
+	}
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "name", "voxel_count", "volume_mm3", "mean_intensity", "std_intensity"})
+	for _, region := range stats.Regions {
+		writer.Write([]string{
+			strconv.Itoa(region.Id),
+			region.Name,
+			strconv.FormatInt(region.VoxelCount, 10),
+			formatFloat(&region.VolumeMm3),
+			formatFloat(region.MeanIntensity),
+			formatFloat(region.StdIntensity),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+func (api *TaskApiImpl) getRegionStats(w http.ResponseWriter, r *http.Request) {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	logger := requestLogger(r).WithField("task", task.id)
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = "json"
+		if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			format = "csv"
+		}
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, fmt.Sprintf("Unknown format '%s' (json, csv)", format), http.StatusBadRequest)
+		return
+	}
+
+	labelsPath, _ := getTaskVolumePath(task.workdir, taskVolumeLabels)
+	if !fileExists(labelsPath) {
+		http.Error(w, "Labels not available.", http.StatusNotFound)
+		return
+	}
+	inputPath, err := getTaskVolumePath(task.workdir, taskVolumeInput)
+	if err != nil || !fileExists(inputPath) {
+		inputPath = ""
+	}
+	resultsDir := filepath.Join(task.workdir, resultsDirName)
+	colorTablePath := findColorTable(resultsDir)
+
+	etag, err := derivedETag("regions|"+format, labelsPath, inputPath, colorTablePath)
+	if err != nil {
+		http.Error(w, "Labels not available.", http.StatusNotFound)
+		return
+	}
+	if checkNotModified(w, r, etag) {
+		return
+	}
+
+	release, err := acquireVolumeProcessing(r.Context(), labelsPath, inputPath)
+	if err != nil {
+		return
+	}
+	defer release()
+
+	stats := RegionStatsResponse{
+		TaskId:  task.id,
+		AtlasId: findAtlasId(resultsDir),
+	}
+	labels, err := nifti.Read(labelsPath)
+	if err != nil {
+		logger.WithError(err).Warn("Could not read labels for region statistics")
+		http.Error(w, "Could not read labels: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	var intensities *nifti.Volume
+	if inputPath == "" {
+		stats.Warnings = append(stats.Warnings, "intensities not computed: input volume not available")
+	} else if intensities, err = nifti.Read(inputPath); err != nil {
+		stats.Warnings = append(stats.Warnings, "intensities not computed: could not read input volume: "+err.Error())
+		intensities = nil
+	} else if !intensities.SameGrid(labels) {
+		stats.Warnings = append(stats.Warnings, "intensities not computed: input volume and labels do not share the same grid")
+		intensities = nil
+	}
+	var colors *colortable.Table
+	if colorTablePath == "" {
+		stats.Warnings = append(stats.Warnings, "region names not available: no atlas color table among results")
+	} else if colors, err = colortable.Read(colorTablePath); err != nil {
+		stats.Warnings = append(stats.Warnings, "region names not available: could not read atlas color table: "+err.Error())
+	}
+
+	stats.Regions, stats.VoxelVolumeMm3 = computeRegionStats(labels, intensities, colors)
+
+	if format == "csv" {
+		err = writeRegionStatsCsv(w, stats)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(stats)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Could not send region statistics")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"rikencau/abart-manager/nifti"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+//Volumes read by the manager to process results (previews, statistics...)
+
+//memory (bytes) which may be taken by the voxel values of volumes processed at the same time, since volumes are
+//entirely loaded in memory (a request needing more can only be processed alone)
+const maxVolumeProcessingBytes = 4 << 30
+
+//volumeMemory reserves memory for the volumes processed by requests, which wait in arrival order
+type volumeMemory struct {
+	mu        sync.Mutex
+	available int64
+	waiting   []*volumeMemoryWaiter
+}
+
+type volumeMemoryWaiter struct {
+	size  int64
+	ready chan struct{}
+}
+
+var volumeProcessingMemory = &volumeMemory{available: maxVolumeProcessingBytes}
+
+func (vm *volumeMemory) acquire(ctx context.Context, size int64) error {
+	vm.mu.Lock()
+	if len(vm.waiting) == 0 && size <= vm.available {
+		vm.available -= size
+		vm.mu.Unlock()
+		return nil
+	}
+	waiter := &volumeMemoryWaiter{size, make(chan struct{})}
+	vm.waiting = append(vm.waiting, waiter)
+	vm.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		vm.mu.Lock()
+		defer vm.mu.Unlock()
+		select {
+		case <-waiter.ready:
+			//granted meanwhile
+			vm.available += size
+		default:
+			for i, w := range vm.waiting {
+				if w == waiter {
+					vm.waiting = append(vm.waiting[:i], vm.waiting[i+1:]...)
+					break
+				}
+			}
+		}
+		//next requests may fit now
+		vm.grantLocked()
+		return ctx.Err()
+	}
+}
+
+func (vm *volumeMemory) release(size int64) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.available += size
+	vm.grantLocked()
+}
+
+func (vm *volumeMemory) grantLocked() {
+	for len(vm.waiting) > 0 && vm.waiting[0].size <= vm.available {
+		waiter := vm.waiting[0]
+		vm.waiting = vm.waiting[1:]
+		vm.available -= waiter.size
+		close(waiter.ready)
+	}
+}
+
+//wait until the volumes (unreadable or empty paths being ignored) can be loaded,
+//the returned function must be called once they are not used anymore
+func acquireVolumeProcessing(ctx context.Context, volumePaths ...string) (release func(), err error) {
+	var size int64
+	for _, volumePath := range volumePaths {
+		if volumePath == "" {
+			continue
+		}
+		//only the header is read
+		if geometry, err := nifti.ReadGeometry(volumePath); err == nil {
+			size += geometry.DataSize()
+		}
+	}
+	if size > maxVolumeProcessingBytes {
+		size = maxVolumeProcessingBytes
+	}
+	if err := volumeProcessingMemory.acquire(ctx, size); err != nil {
+		return nil, err
+	}
+	return func() { volumeProcessingMemory.release(size) }, nil
+}
+
+//volumes of a task, either as submitted or produced by the worker
+const (
+	taskVolumeInput      = "input"
+	taskVolumeRegistered = "registered"
+	taskVolumeLabels     = "labels"
+	//atlas labels shipped among results, on the grid of the registered volume
+	taskVolumeAtlasLabels = "atlas-labels"
+)
+
+//full path of the volume of the task (which may not exist)
+func getTaskVolumePath(taskDir string, name string) (string, error) {
+	switch name {
+	case taskVolumeInput:
+		taskConfig, err := loadTaskConfig(taskDir)
+		if err != nil {
+			return "", err
+		}
+		if taskConfig.MovingImage == "" {
+			return "", os.ErrNotExist
+		}
+		return path.Join(taskDir, path.Base(taskConfig.MovingImage)), nil
+	case taskVolumeRegistered:
+		return filepath.Join(taskDir, resultsDirName, filepath.FromSlash(registeredVolumePath)), nil
+	case taskVolumeLabels:
+		return filepath.Join(taskDir, resultsDirName, filepath.FromSlash(labelsVolumePath)), nil
+	case taskVolumeAtlasLabels:
+		return findAtlasLabels(filepath.Join(taskDir, resultsDirName))
+	}
+	return "", fmt.Errorf("unknown volume '%s' (%s, %s, %s, %s)", name, taskVolumeInput, taskVolumeRegistered, taskVolumeLabels, taskVolumeAtlasLabels)
+}
+
+//label volume among the atlas files shipped with the results
+func findAtlasLabels(resultsDir string) (string, error) {
+	files, _ := filepath.Glob(filepath.Join(resultsDir, atlasDirPath, "*.nii*"))
+	for _, file := range files {
+		if artifactType(path.Join(atlasDirPath, filepath.Base(file))) == "labels" {
+			return file, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+func loadTaskVolume(taskDir string, name string) (*nifti.Volume, error) {
+	volumePath, err := getTaskVolumePath(taskDir, name)
+	if err != nil {
+		return nil, err
+	}
+	return nifti.Read(volumePath)
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//validator of content derived from files (e.g. a preview), changing whenever any of them is rewritten
+func derivedETag(variant string, filePaths ...string) (string, error) {
+	hash := sha256.New()
+	fmt.Fprint(hash, variant)
+	for _, filePath := range filePaths {
+		if filePath == "" {
+			continue
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "|%s", fileETag(info))
+	}
+	return "\"" + hex.EncodeToString(hash.Sum(nil))[:32] + "\"", nil
+}
+
+//set the validator of derived content, and answer 304 if the client already has it (so that it is not computed again)
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Archives of results, streamed on demand
+
+	GET /api/tasks/{taskId}/archive?format=zip|tar.gz&path=...&type=...
+
+Artifacts are selected by path (relative to results/) and/or by type (e.g. "labels", "color-table"),
+all artifacts being included if none is selected. Entries are named as in the zip produced by the worker
+(i.e. "results/..."), and the archive is written directly to the response, without temporary file.
+
+When all artifacts are requested as zip, the archive produced by the worker is served if present
+(so that downloads can be resumed).
+*/
+
+const (
+	archiveFormatZip   = "zip"
+	archiveFormatTarGz = "tar.gz"
+)
+
+//artifact selected for the archive, along with its full path
+type selectedArtifact struct {
+	ResultArtifact
+	fullPath string
+}
+
+//artifacts designated by their path or type (all if none), fails if a designated path does not exist
+func selectArtifacts(taskDir string, paths []string, types []string) ([]selectedArtifact, error) {
+	artifacts, err := listResultArtifacts(taskDir)
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]ResultArtifact)
+	for _, artifact := range artifacts {
+		byPath[artifact.Path] = artifact
+	}
+
+	wanted := make(map[string]bool)
+	for _, relPath := range paths {
+		if _, ok := byPath[relPath]; !ok {
+			return nil, fmt.Errorf("unknown artifact '%s'", relPath)
+		}
+		wanted[relPath] = true
+	}
+	for _, kind := range types {
+		for _, artifact := range artifacts {
+			if artifact.Type == kind {
+				wanted[artifact.Path] = true
+			}
+		}
+	}
+	selectAll := len(paths) == 0 && len(types) == 0
+
+	selected := []selectedArtifact{}
+	for _, artifact := range artifacts {
+		if !selectAll && !wanted[artifact.Path] {
+			continue
+		}
+		fullPath, err := resolveArtifactPath(taskDir, artifact.Path)
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, selectedArtifact{artifact, fullPath})
+	}
+	return selected, nil
+}
+
+//name of the archive entry, as in the zip produced by the worker
+func archiveEntryName(artifact selectedArtifact) string {
+	return resultsDirName + "/" + artifact.Path
+}
+
+func copyFileTo(w io.Writer, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+func writeZipArchive(w io.Writer, artifacts []selectedArtifact) error {
+	zw := zip.NewWriter(w)
+	for _, artifact := range artifacts {
+		method := zip.Deflate
+		if artifact.ContentType == "application/gzip" || artifact.ContentType == "application/zip" || artifact.ContentType == "image/png" {
+			//already compressed (e.g. .nii.gz volumes), compressing again would only cost time
+			method = zip.Store
+		}
+		entryWriter, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     archiveEntryName(artifact),
+			Method:   method,
+			Modified: artifact.ModifiedAt,
+		})
+		if err != nil {
+			return err
+		}
+		if err := copyFileTo(entryWriter, artifact.fullPath); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGzArchive(w io.Writer, artifacts []selectedArtifact) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, artifact := range artifacts {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    archiveEntryName(artifact),
+			Mode:    0644,
+			Size:    artifact.Size,
+			ModTime: artifact.ModifiedAt,
+		})
+		if err != nil {
+			return err
+		}
+		if err := copyFileTo(tw, artifact.fullPath); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+func (api *TaskApiImpl) downloadResultsArchive(w http.ResponseWriter, r *http.Request) {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	logger := requestLogger(r).WithField("task", task.id)
+
+	query := r.URL.Query()
+	format := strings.ToLower(query.Get("format"))
+	if format == "" {
+		format = archiveFormatZip
+	}
+	if format != archiveFormatZip && format != archiveFormatTarGz {
+		http.Error(w, fmt.Sprintf("Unknown archive format '%s' (zip, tar.gz)", format), http.StatusBadRequest)
+		return
+	}
+	paths := query["path"]
+	types := query["type"]
+
+	//whole results are available as already built by the worker
+	prebuiltZip := filepath.Join(task.workdir, resultsZipFileName)
+	if format == archiveFormatZip && len(paths) == 0 && len(types) == 0 && fileExists(prebuiltZip) {
+		serveResultFile(w, r, prebuiltZip)
+		return
+	}
+
+	artifacts, err := selectArtifacts(task.workdir, paths, types)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(artifacts) == 0 {
+		http.Error(w, "No result matching the selection.", http.StatusNotFound)
+		return
+	}
+
+	fileName := "abartResults-" + string(task.id) + "." + format
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	w.Header().Set("Content-Type", resultContentType(fileName))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Method == http.MethodHead {
+		//size is not known before the archive is built
+		return
+	}
+
+	if format == archiveFormatZip {
+		err = writeZipArchive(w, artifacts)
+	} else {
+		err = writeTarGzArchive(w, artifacts)
+	}
+	if err != nil {
+		//response is already partially sent, the client gets a truncated archive
+		logger.WithError(err).Error("Could not stream results archive")
+		return
+	}
+	logger.WithFields(log.Fields{"format": format, "artifacts": len(artifacts)}).Debug("Results archive streamed")
+}
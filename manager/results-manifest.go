@@ -0,0 +1,294 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"rikencau/abart-manager/dockerhandler"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Results manifest
+
+Once the worker has completed, the manager records in results/manifest.json which files were produced,
+from which input, with which parameters, atlas and worker image, so that results can be verified and reproduced.
+The manifest is also added to the zip of all results.
+*/
+
+const resultsManifestFileName = "manifest.json"
+
+//name of the zip of all results, produced by the worker
+const resultsZipFileName = "abartResults.zip"
+
+//ManifestFile identifies a file by its content
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type ManifestPreTransform struct {
+	File ManifestFile `json:"file"`
+	//rotation angles (radians) around x, y and z axes, from which the transform was generated
+	Rotation []float64 `json:"rotation,omitempty"`
+}
+
+type ManifestAtlas struct {
+	//identifier of the atlas, derived from its color table (e.g. "sp2_label_512_3dslicer_v1.0.0")
+	Id string `json:"id,omitempty"`
+	//atlas directory within worker containers (image default if empty)
+	Dir string `json:"dir,omitempty"`
+}
+
+type ResultsManifest struct {
+	TaskId TaskId `json:"taskId"`
+	Owner  string `json:"owner,omitempty"`
+	//task whose transforms were applied (derived tasks only)
+	ParentTaskId TaskId `json:"parentTaskId,omitempty"`
+	Status       string `json:"status"`
+	//exit code reported by the worker
+	ExitCode *int `json:"exitCode,omitempty"`
+
+	Input *ManifestFile `json:"input,omitempty"`
+	//images uploaded for derived tasks
+	Inputs       []ManifestFile           `json:"inputs,omitempty"`
+	Params       json.RawMessage          `json:"params,omitempty"`
+	Preset       string                   `json:"preset,omitempty"`
+	PreTransform *ManifestPreTransform    `json:"preTransform,omitempty"`
+	Atlas        ManifestAtlas            `json:"atlas"`
+	WorkerImage  *dockerhandler.ImageInfo `json:"workerImage,omitempty"`
+
+	CreatedAt   time.Time  `json:"createdAt"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	EndedAt     *time.Time `json:"endedAt,omitempty"`
+	GeneratedAt time.Time  `json:"generatedAt"`
+
+	Artifacts []ResultArtifact `json:"artifacts"`
+}
+
+func describeFile(filePath string) (*ManifestFile, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := fileSha256(filePath, info)
+	if err != nil {
+		return nil, err
+	}
+	return &ManifestFile{
+		Name:   path.Base(filePath),
+		Size:   info.Size(),
+		Sha256: sum,
+	}, nil
+}
+
+//exit code written by the worker when it completed (nil if not reported)
+func getWorkerExitCode(taskFullDir string) *int {
+	content, err := ioutil.ReadFile(path.Join(taskFullDir, workerFinishedFileName))
+	if err != nil {
+		return nil
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil
+	}
+	return &code
+}
+
+//configuration the worker was given (see Task.prepare)
+func loadTaskConfig(taskFullDir string) (TaskConfig, error) {
+	var taskConfig TaskConfig
+	content, err := ioutil.ReadFile(path.Join(taskFullDir, "config.json"))
+	if err != nil {
+		return taskConfig, err
+	}
+	err = json.Unmarshal(content, &taskConfig)
+	return taskConfig, err
+}
+
+//color table of the atlas, copied by the worker along with the results (empty if none)
+func findColorTable(resultsDir string) string {
+	tables, _ := filepath.Glob(filepath.Join(resultsDir, atlasDirPath, "*.ctbl"))
+	if len(tables) == 0 {
+		return ""
+	}
+	return tables[0]
+}
+
+//atlas identifier, from the name of its color table
+func findAtlasId(resultsDir string) string {
+	colorTable := findColorTable(resultsDir)
+	if colorTable == "" {
+		return ""
+	}
+	return strings.TrimSuffix(filepath.Base(colorTable), ".ctbl")
+}
+
+func (t *Task) buildResultsManifest(atlasDir string) (ResultsManifest, error) {
+	metadata := t.getMetadata()
+	status, _ := t.getStatus()
+	resultsDir := filepath.Join(t.workdir, resultsDirName)
+
+	manifest := ResultsManifest{
+		TaskId:       t.id,
+		Owner:        metadata.Owner,
+		ParentTaskId: metadata.ParentTaskId,
+		Status:       string(status),
+		ExitCode:     getWorkerExitCode(t.workdir),
+		Params:       metadata.Params,
+		Preset:       metadata.Preset,
+		Atlas:        ManifestAtlas{Id: findAtlasId(resultsDir), Dir: atlasDir},
+		WorkerImage:  metadata.WorkerImage,
+		CreatedAt:    metadata.CreatedAt,
+		StartedAt:    metadata.StartedAt,
+		EndedAt:      metadata.EndedAt,
+		GeneratedAt:  time.Now(),
+	}
+
+	taskConfig, err := loadTaskConfig(t.workdir)
+	if err != nil {
+		return manifest, fmt.Errorf("could not load task config: %w", err)
+	}
+	if taskConfig.MovingImage != "" {
+		if manifest.Input, err = describeFile(path.Join(t.workdir, path.Base(taskConfig.MovingImage))); err != nil {
+			return manifest, fmt.Errorf("could not describe input file: %w", err)
+		}
+	}
+	if inputsDir := path.Join(t.workdir, derivedInputsDirName); dirExists(inputsDir) {
+		entries, err := ioutil.ReadDir(inputsDir)
+		if err != nil {
+			return manifest, fmt.Errorf("could not list input files: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			file, err := describeFile(path.Join(inputsDir, entry.Name()))
+			if err != nil {
+				return manifest, fmt.Errorf("could not describe input file: %w", err)
+			}
+			manifest.Inputs = append(manifest.Inputs, *file)
+		}
+	}
+	if taskConfig.PreTransform != "" {
+		file, err := describeFile(path.Join(t.workdir, taskConfig.PreTransform))
+		if err != nil {
+			return manifest, fmt.Errorf("could not describe pre-transform: %w", err)
+		}
+		var params TaskParams
+		json.Unmarshal(metadata.Params, &params)
+		manifest.PreTransform = &ManifestPreTransform{File: *file, Rotation: params.Rotation}
+	}
+
+	artifacts, err := listResultArtifacts(t.workdir)
+	if err != nil {
+		return manifest, fmt.Errorf("could not list results: %w", err)
+	}
+	//manifest does not describe itself (nor a previous version of itself)
+	manifest.Artifacts = []ResultArtifact{}
+	for _, artifact := range artifacts {
+		if artifact.Path != resultsManifestFileName {
+			manifest.Artifacts = append(manifest.Artifacts, artifact)
+		}
+	}
+	return manifest, nil
+}
+
+//generate the manifest of the results, and add it to the zip of all results
+func (t *Task) writeResultsManifest(atlasDir string) error {
+	manifest, err := t.buildResultsManifest(atlasDir)
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	resultsDir := filepath.Join(t.workdir, resultsDirName)
+	if err := os.MkdirAll(resultsDir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(resultsDir, resultsManifestFileName), jsonData, 0644); err != nil {
+		return err
+	}
+
+	zipPath := filepath.Join(t.workdir, resultsZipFileName)
+	if !fileExists(zipPath) {
+		return nil
+	}
+	return addToZip(zipPath, resultsDirName+"/"+resultsManifestFileName, jsonData, manifest.GeneratedAt)
+}
+
+//add (or replace) an entry in a zip archive, which is rewritten without recompressing existing entries
+func addToZip(zipPath string, entryName string, content []byte, modified time.Time) error {
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(zipPath), ".zip-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	writer := zip.NewWriter(tempFile)
+	for _, entry := range reader.File {
+		if entry.Name == entryName {
+			continue
+		}
+		if err := writer.Copy(entry); err != nil {
+			return err
+		}
+	}
+	entryWriter, err := writer.CreateHeader(&zip.FileHeader{
+		Name:     entryName,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := entryWriter.Write(content); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	//archive may be served concurrently, it is replaced at once
+	return os.Rename(tempFile.Name(), zipPath)
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//manifest of the results, available once the worker has completed
+func (api *TaskApiImpl) getResultsManifest(w http.ResponseWriter, r *http.Request) {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(filepath.Join(task.workdir, resultsDirName, resultsManifestFileName))
+	if err != nil {
+		http.Error(w, "Results manifest not available.", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, file)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"rikencau/abart-manager/colortable"
+	"rikencau/abart-manager/nifti"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Slice previews of result volumes
+
+	GET /api/tasks/{taskId}/preview?plane=axial|coronal|sagittal&slice=...&volume=registered|input&labels=true
+
+renders a PNG image of a slice of the volume (middle one by default), so that a registration can be checked
+without downloading it. With labels, the contours of the atlas labels are overlaid, colored according to the atlas
+color table: labels mapped to the input volume over the input volume (previewed by default), atlas labels shipped
+among results over the registered volume.
+
+Slices are displayed in radiological convention as in 3D Slicer: patient right on the left of axial and coronal
+slices, anterior on the left of sagittal slices, superior (or anterior for axial slices) at the top.
+*/
+
+//max size (pixels) of the larger side of previews
+const maxPreviewSize = 1024
+
+//percentiles of the slice intensities mapped to black and white
+const (
+	previewLowPercentile  = 0.01
+	previewHighPercentile = 0.99
+)
+
+//previewPlane specifies how a slice is extracted and displayed, by world axes (0: R-L, 1: A-P, 2: S-I)
+type previewPlane struct {
+	normal     int
+	horizontal int
+	vertical   int
+}
+
+var previewPlanes = map[string]previewPlane{
+	"axial":    {normal: 2, horizontal: 0, vertical: 1},
+	"coronal":  {normal: 1, horizontal: 0, vertical: 2},
+	"sagittal": {normal: 0, horizontal: 1, vertical: 2},
+}
+
+type previewRequest struct {
+	plane  string
+	slice  *int
+	volume string
+	labels bool
+}
+
+func parsePreviewRequest(r *http.Request) (previewRequest, error) {
+	query := r.URL.Query()
+	req := previewRequest{
+		plane:  strings.ToLower(query.Get("plane")),
+		volume: strings.ToLower(query.Get("volume")),
+	}
+	if req.plane == "" {
+		req.plane = "axial"
+	}
+	if _, ok := previewPlanes[req.plane]; !ok {
+		return req, fmt.Errorf("unknown plane '%s' (axial, coronal, sagittal)", req.plane)
+	}
+	if value := query.Get("slice"); value != "" {
+		slice, err := strconv.Atoi(value)
+		if err != nil {
+			return req, fmt.Errorf("invalid slice index '%s'", value)
+		}
+		req.slice = &slice
+	}
+	if value := query.Get("labels"); value != "" {
+		labels, err := strconv.ParseBool(value)
+		if err != nil {
+			return req, fmt.Errorf("invalid labels flag '%s'", value)
+		}
+		req.labels = labels
+	}
+	if req.volume == "" {
+		//labels are primarily checked on the input volume
+		req.volume = taskVolumeRegistered
+		if req.labels {
+			req.volume = taskVolumeInput
+		}
+	}
+	if req.volume != taskVolumeInput && req.volume != taskVolumeRegistered {
+		return req, fmt.Errorf("unknown volume '%s' (%s, %s)", req.volume, taskVolumeRegistered, taskVolumeInput)
+	}
+	return req, nil
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//sliceSampler maps preview pixels to voxels of the volume
+type sliceSampler struct {
+	//voxel axes along the normal, horizontal and vertical directions of the slice
+	normalAxis, hAxis, vAxis int
+	slice                    int
+	//whether voxel indices are reversed along horizontal and vertical directions
+	hReversed, vReversed bool
+	width, height        int
+	//size of preview pixels (mm)
+	pixelSize float64
+}
+
+func newSliceSampler(v *nifti.Volume, plane previewPlane, slice *int) (*sliceSampler, error) {
+	axes, positive := v.Orientation()
+	axisOf := [3]int{}
+	for axis, world := range axes {
+		axisOf[world] = axis
+	}
+	s := &sliceSampler{
+		normalAxis: axisOf[plane.normal],
+		hAxis:      axisOf[plane.horizontal],
+		vAxis:      axisOf[plane.vertical],
+	}
+	//world coordinates decrease from left to right (R to L, or A to P), and from top to bottom
+	s.hReversed = positive[s.hAxis]
+	s.vReversed = positive[s.vAxis]
+
+	s.slice = v.Dims[s.normalAxis] / 2
+	if slice != nil {
+		s.slice = *slice
+	}
+	if s.slice < 0 || s.slice >= v.Dims[s.normalAxis] {
+		return nil, fmt.Errorf("slice index out of range [0, %d]", v.Dims[s.normalAxis]-1)
+	}
+
+	//preview pixels are square, as small as the smallest voxel side, within the max preview size
+	hExtent := float64(v.Dims[s.hAxis]) * v.Spacing[s.hAxis]
+	vExtent := float64(v.Dims[s.vAxis]) * v.Spacing[s.vAxis]
+	s.pixelSize = math.Max(
+		math.Min(v.Spacing[s.hAxis], v.Spacing[s.vAxis]),
+		math.Max(hExtent, vExtent)/maxPreviewSize,
+	)
+	s.width = int(math.Max(1, math.Round(hExtent/s.pixelSize)))
+	s.height = int(math.Max(1, math.Round(vExtent/s.pixelSize)))
+	return s, nil
+}
+
+//voxel indices at the preview pixel
+func (s *sliceSampler) voxel(v *nifti.Volume, x, y int) (i, j, k int) {
+	h := int(float64(x) * s.pixelSize / v.Spacing[s.hAxis])
+	if h >= v.Dims[s.hAxis] {
+		h = v.Dims[s.hAxis] - 1
+	}
+	if s.hReversed {
+		h = v.Dims[s.hAxis] - 1 - h
+	}
+	vert := int(float64(y) * s.pixelSize / v.Spacing[s.vAxis])
+	if vert >= v.Dims[s.vAxis] {
+		vert = v.Dims[s.vAxis] - 1
+	}
+	if s.vReversed {
+		vert = v.Dims[s.vAxis] - 1 - vert
+	}
+	var ijk [3]int
+	ijk[s.normalAxis] = s.slice
+	ijk[s.hAxis] = h
+	ijk[s.vAxis] = vert
+	return ijk[0], ijk[1], ijk[2]
+}
+
+//color of labels missing from the color table, stable for a given label
+func fallbackLabelColor(label int) color.RGBA {
+	hash := fnv.New32a()
+	fmt.Fprint(hash, label)
+	sum := hash.Sum32()
+	return color.RGBA{uint8(sum>>16) | 0x40, uint8(sum>>8) | 0x40, uint8(sum) | 0x40, 255}
+}
+
+func renderPreview(v *nifti.Volume, s *sliceSampler, labels *nifti.Volume, colors *colortable.Table) *image.RGBA {
+	values := make([]float64, s.width*s.height)
+	for y := 0; y < s.height; y++ {
+		for x := 0; x < s.width; x++ {
+			values[y*s.width+x] = v.At(s.voxel(v, x, y))
+		}
+	}
+
+	//intensity window from the slice content, robust to outliers
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	low := sorted[int(previewLowPercentile*float64(len(sorted)-1))]
+	high := sorted[int(previewHighPercentile*float64(len(sorted)-1))]
+	if high <= low {
+		high = low + 1
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, s.width, s.height))
+	for y := 0; y < s.height; y++ {
+		for x := 0; x < s.width; x++ {
+			gray := (values[y*s.width+x] - low) / (high - low) * 255
+			level := uint8(math.Max(0, math.Min(255, gray)))
+			img.SetRGBA(x, y, color.RGBA{level, level, level, 255})
+		}
+	}
+	if labels == nil {
+		return img
+	}
+
+	//contours are the labeled pixels next to a pixel with another label
+	labelMap := make([]int, s.width*s.height)
+	for y := 0; y < s.height; y++ {
+		for x := 0; x < s.width; x++ {
+			labelMap[y*s.width+x] = labels.Label(s.voxel(labels, x, y))
+		}
+	}
+	for y := 0; y < s.height; y++ {
+		for x := 0; x < s.width; x++ {
+			label := labelMap[y*s.width+x]
+			if label == 0 {
+				continue
+			}
+			onContour := (x > 0 && labelMap[y*s.width+x-1] != label) ||
+				(x < s.width-1 && labelMap[y*s.width+x+1] != label) ||
+				(y > 0 && labelMap[(y-1)*s.width+x] != label) ||
+				(y < s.height-1 && labelMap[(y+1)*s.width+x] != label)
+			if !onContour {
+				continue
+			}
+			labelColor := fallbackLabelColor(label)
+			if colors != nil {
+				if entry, ok := colors.Lookup(label); ok {
+					labelColor = entry.Color
+					labelColor.A = 255
+				}
+			}
+			img.SetRGBA(x, y, labelColor)
+		}
+	}
+	return img
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//variant of the preview, for its validator
+func (req previewRequest) String() string {
+	variant := fmt.Sprintf("preview|%s|%s|%v", req.plane, req.volume, req.labels)
+	if req.slice != nil {
+		variant += fmt.Sprintf("|%d", *req.slice)
+	}
+	return variant
+}
+
+func (api *TaskApiImpl) getPreview(w http.ResponseWriter, r *http.Request) {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	logger := requestLogger(r).WithField("task", task.id)
+
+	req, err := parsePreviewRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	volumePath, err := getTaskVolumePath(task.workdir, req.volume)
+	if err != nil || !fileExists(volumePath) {
+		http.Error(w, "Volume not available.", http.StatusNotFound)
+		return
+	}
+	labelsPath, colorTablePath := "", ""
+	if req.labels {
+		//labels defined on the grid of the previewed volume
+		labelsVolume := taskVolumeLabels
+		if req.volume == taskVolumeRegistered {
+			labelsVolume = taskVolumeAtlasLabels
+		}
+		labelsPath, err = getTaskVolumePath(task.workdir, labelsVolume)
+		if err != nil || !fileExists(labelsPath) {
+			http.Error(w, "Labels not available.", http.StatusNotFound)
+			return
+		}
+		colorTablePath = findColorTable(filepath.Join(task.workdir, resultsDirName))
+	}
+
+	//rendering is avoided when the client already has the preview
+	etag, err := derivedETag(req.String(), volumePath, labelsPath, colorTablePath)
+	if err != nil {
+		http.Error(w, "Volume not available.", http.StatusNotFound)
+		return
+	}
+	if checkNotModified(w, r, etag) {
+		return
+	}
+
+	release, err := acquireVolumeProcessing(r.Context(), volumePath, labelsPath)
+	if err != nil {
+		return
+	}
+	defer release()
+
+	volume, err := nifti.Read(volumePath)
+	if err != nil {
+		logger.WithError(err).Warn("Could not read volume for preview")
+		http.Error(w, "Could not read volume: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	sampler, err := newSliceSampler(volume, previewPlanes[req.plane], req.slice)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var labels *nifti.Volume
+	var colors *colortable.Table
+	if req.labels {
+		if labels, err = nifti.Read(labelsPath); err != nil {
+			logger.WithError(err).Warn("Could not read labels for preview")
+			http.Error(w, "Could not read labels: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if !labels.SameGrid(volume) {
+			http.Error(w, "Labels are not defined on the grid of the "+req.volume+" volume", http.StatusUnprocessableEntity)
+			return
+		}
+		if colorTablePath != "" {
+			if colors, err = colortable.Read(colorTablePath); err != nil {
+				//labels are still displayed, with arbitrary colors
+				logger.WithError(err).Warn("Could not read color table")
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderPreview(volume, sampler, labels, colors)); err != nil {
+		logger.WithError(err).Error("Could not encode preview")
+		http.Error(w, "Could not render preview", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
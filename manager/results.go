@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+//Serving of result files
+
+//content types of the files produced by tasks, by extension (longest extensions first)
+var resultContentTypes = []struct {
+	ext         string
+	contentType string
+}{
+	{".nii.gz", "application/gzip"},
+	{".tar.gz", "application/gzip"},
+	{".nii", "application/x-nifti"},
+	{".zip", "application/zip"},
+	{".ctbl", "text/plain; charset=utf-8"},
+	{".txt", "text/plain; charset=utf-8"},
+	{".tfm", "text/plain; charset=utf-8"},
+	{".json", "application/json"},
+	{".csv", "text/csv; charset=utf-8"},
+	{".png", "image/png"},
+	{".mat", "application/octet-stream"},
+}
+
+//content type of a result file according to its name (rather than sniffed from its content)
+func resultContentType(fileName string) string {
+	lowerName := strings.ToLower(fileName)
+	for _, ct := range resultContentTypes {
+		if strings.HasSuffix(lowerName, ct.ext) {
+			return ct.contentType
+		}
+	}
+	if contentType := mime.TypeByExtension(path.Ext(lowerName)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+//validator of the file content, changing whenever the file is rewritten
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+}
+
+/*
+Serve the file as an attachment, supporting HEAD and byte-range requests (e.g. to resume a download),
+as well as conditional requests (If-None-Match, If-Modified-Since), so that files already downloaded
+are not transferred again.
+*/
+func serveResultFile(w http.ResponseWriter, r *http.Request, filePath string) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		http.Error(w, "File not found.", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "File not found.", http.StatusNotFound)
+		return
+	}
+
+	fileName := path.Base(filePath)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	w.Header().Set("Content-Type", resultContentType(fileName))
+	w.Header().Set("ETag", fileETag(info))
+	//results are private to the task owner, and must be revalidated since a task may be processed again
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	http.ServeContent(w, r, fileName, info.ModTime(), file)
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+//Result artifacts, i.e. files produced by the worker under the results/ directory of the task
+
+const resultsDirName = "results"
+
+//well-known artifacts, relative to the results directory
+const (
+	registeredVolumePath = "registered/UserToAtlas_Warped.nii.gz"
+	labelsVolumePath     = "labels/AtlasToUser_labels.nii.gz"
+	//directory of the atlas color table (.ctbl)
+	atlasDirPath = "atlas"
+)
+
+//ResultArtifact describes a file produced by a task
+type ResultArtifact struct {
+	//path relative to the results directory, e.g. "registered/UserToAtlas_Warped.nii.gz"
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	Sha256      string    `json:"sha256"`
+	Type        string    `json:"type"`
+	ContentType string    `json:"contentType"`
+	Description string    `json:"description,omitempty"`
+	ModifiedAt  time.Time `json:"modifiedAt"`
+}
+
+type ResultsListResponse struct {
+	TaskId    TaskId           `json:"taskId"`
+	Artifacts []ResultArtifact `json:"artifacts"`
+}
+
+//descriptions of well-known artifacts, by path relative to the results directory
+var artifactDescriptions = map[string]string{
+	registeredVolumePath:    "Input volume registered to atlas space",
+	labelsVolumePath:        "Atlas labels mapped to input volume space",
+	resultsManifestFileName: "Manifest of the results (artifacts checksums, input, parameters, worker image)",
+}
+
+//descriptions of artifacts found in well-known directories, by type
+var artifactDirDescriptions = map[string]map[string]string{
+	"atlas": {
+		"color-table": "Color table of atlas labels (3D Slicer format)",
+		"volume":      "Atlas volume",
+		"labels":      "Atlas labels in atlas space",
+	},
+	"labels": {
+		"labels": "Atlas labels mapped to input volume space",
+	},
+	"registered": {
+		"volume": "Volume registered to atlas space",
+	},
+	transformedDirPath: {
+		"volume": "Additional image mapped to atlas space",
+		"labels": "Additional label map mapped to atlas space",
+	},
+}
+
+//kind of artifact, according to its name
+func artifactType(relPath string) string {
+	name := strings.ToLower(path.Base(relPath))
+	stem := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".nii")
+	switch {
+	case strings.HasSuffix(name, ".ctbl"):
+		return "color-table"
+	case strings.HasSuffix(name, ".tfm"), strings.HasSuffix(name, ".mat"), strings.HasSuffix(name, ".h5"):
+		return "transform"
+	case strings.HasSuffix(name, ".nii"), strings.HasSuffix(name, ".nii.gz"):
+		if strings.HasSuffix(stem, "warp") {
+			//displacement field (e.g. "1Warp.nii.gz", "1InverseWarp.nii.gz")
+			return "transform"
+		}
+		if strings.Contains(stem, "label") || strings.HasPrefix(relPath, "labels/") {
+			return "labels"
+		}
+		return "volume"
+	case strings.HasSuffix(name, ".zip"), strings.HasSuffix(name, ".tar.gz"):
+		return "archive"
+	case strings.HasSuffix(name, ".json"):
+		return "metadata"
+	case strings.HasSuffix(name, ".png"):
+		return "image"
+	case strings.HasSuffix(name, ".txt"), strings.HasSuffix(name, ".log"), strings.HasSuffix(name, ".csv"):
+		return "text"
+	}
+	return "other"
+}
+
+func artifactDescription(relPath string, kind string) string {
+	if description, ok := artifactDescriptions[relPath]; ok {
+		return description
+	}
+	dir := strings.SplitN(relPath, "/", 2)[0]
+	return artifactDirDescriptions[dir][kind]
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//checksums are cached as long as files are not modified, since computing them for large volumes takes a while
+type checksumEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+//max number of cached checksums (cache is reset when reached)
+const maxCachedChecksums = 10000
+
+var checksumCache = struct {
+	mu      sync.Mutex
+	entries map[string]checksumEntry
+}{entries: make(map[string]checksumEntry)}
+
+//SHA-256 of the file content (hex encoded)
+func fileSha256(filePath string, info os.FileInfo) (string, error) {
+	checksumCache.mu.Lock()
+	entry, ok := checksumCache.entries[filePath]
+	checksumCache.mu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.sum, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	checksumCache.mu.Lock()
+	if len(checksumCache.entries) >= maxCachedChecksums {
+		checksumCache.entries = make(map[string]checksumEntry)
+	}
+	checksumCache.entries[filePath] = checksumEntry{info.Size(), info.ModTime(), sum}
+	checksumCache.mu.Unlock()
+	return sum, nil
+}
+
+//all artifacts found under the results directory of the task (regular files only, symbolic links are ignored)
+func listResultArtifacts(taskDir string) ([]ResultArtifact, error) {
+	resultsDir := filepath.Join(taskDir, resultsDirName)
+	artifacts := []ResultArtifact{}
+	if !dirExists(resultsDir) {
+		return artifacts, nil
+	}
+	err := filepath.Walk(resultsDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(resultsDir, filePath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		sum, err := fileSha256(filePath, info)
+		if err != nil {
+			return err
+		}
+		kind := artifactType(relPath)
+		artifacts = append(artifacts, ResultArtifact{
+			Path:        relPath,
+			Size:        info.Size(),
+			Sha256:      sum,
+			Type:        kind,
+			ContentType: resultContentType(relPath),
+			Description: artifactDescription(relPath, kind),
+			ModifiedAt:  info.ModTime(),
+		})
+		return nil
+	})
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Path < artifacts[j].Path })
+	return artifacts, err
+}
+
+//full path of the artifact designated by a path relative to the results directory,
+//provided it does not lead outside of it (e.g. by ".." segments, or symbolic links)
+func resolveArtifactPath(taskDir string, relPath string) (string, error) {
+	invalid := fmt.Errorf("invalid artifact path '%s'", relPath)
+	if relPath == "" || strings.ContainsAny(relPath, "\\\x00") || path.IsAbs(relPath) {
+		return "", invalid
+	}
+	for _, segment := range strings.Split(relPath, "/") {
+		if segment == ".." {
+			return "", invalid
+		}
+	}
+
+	resultsDir, err := filepath.EvalSymlinks(filepath.Join(taskDir, resultsDirName))
+	if err != nil {
+		return "", err
+	}
+	fullPath, err := filepath.EvalSymlinks(filepath.Join(resultsDir, filepath.FromSlash(path.Clean(relPath))))
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(fullPath, resultsDir+string(filepath.Separator)) {
+		return "", invalid
+	}
+	return fullPath, nil
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//list the artifacts produced by the task
+func (api *TaskApiImpl) listResults(w http.ResponseWriter, r *http.Request) {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	artifacts, err := listResultArtifacts(task.workdir)
+	if err != nil {
+		requestLogger(r).WithField("task", task.id).WithError(err).Error("Could not list results")
+		http.Error(w, "Could not list results", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ResultsListResponse{
+		TaskId:    task.id,
+		Artifacts: artifacts,
+	})
+}
+
+//download an artifact by its path relative to the results directory
+func (api *TaskApiImpl) downloadArtifact(w http.ResponseWriter, r *http.Request) {
+	task, ok := api.getRequestedTask(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	relPath := mux.Vars(r)["path"]
+	fullPath, err := resolveArtifactPath(task.workdir, relPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			requestLogger(r).WithField("task", task.id).WithError(err).Warn("Rejected artifact path")
+		}
+		http.Error(w, "File not found.", http.StatusNotFound)
+		return
+	}
+	serveResultFile(w, r, fullPath)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Graceful shutdown and drain mode
+
+When draining, the manager stops accepting new tasks and stops starting queued ones (which remain queued),
+while running tasks go on. Drain mode is entered on demand (admin endpoint), or when SIGINT/SIGTERM is received.
+
+On shutdown, the manager then:
+	- lets in-flight requests (e.g. uploads) complete, for up to request_timeout
+	- closes websockets of log streaming,
+	- waits for running tasks to end, for up to task_wait;
+	  tasks still running are left as is, and re-attached to their worker container at next start.
+
+Queued tasks are persisted as such, and processed after next start.
+*/
+type ShutdownConfig struct {
+	//maximum time given to in-flight requests (e.g. uploads) to complete
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	//maximum time waiting for running tasks to end (0 means not waiting)
+	TaskWait time.Duration `yaml:"task_wait"`
+}
+
+func defaultShutdownConfig() ShutdownConfig {
+	return ShutdownConfig{
+		RequestTimeout: 5 * time.Minute,
+	}
+}
+
+//interval at which running tasks are checked when waiting for them to end
+const taskWaitPollInterval = time.Second
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//socketRegistry keeps track of open websockets, which are not handled by http.Server.Shutdown
+type socketRegistry struct {
+	mu    sync.Mutex
+	conns map[*websocket.Conn]bool
+}
+
+func newSocketRegistry() *socketRegistry {
+	return &socketRegistry{conns: make(map[*websocket.Conn]bool)}
+}
+
+func (sr *socketRegistry) add(conn *websocket.Conn) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.conns[conn] = true
+}
+
+func (sr *socketRegistry) remove(conn *websocket.Conn) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	delete(sr.conns, conn)
+}
+
+//send a close message to every client, and close the connections
+func (sr *socketRegistry) closeAll(reason string) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for conn := range sr.conns {
+		//clients are expected to reconnect later
+		message := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+		conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		conn.Close()
+		delete(sr.conns, conn)
+	}
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//DrainStatus reports whether the manager is draining, and its remaining active tasks
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+	Running  int  `json:"running"`
+	Queued   int  `json:"queued"`
+}
+
+//stop accepting new tasks and starting queued ones
+func (th *TaskHandler) startDrain() {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if !th.draining {
+		log.Info("Draining: no more tasks are accepted nor started")
+	}
+	th.draining = true
+}
+
+//accept and start tasks again
+func (th *TaskHandler) stopDrain() {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if th.draining {
+		log.Info("Drain mode ended: tasks are accepted and started again")
+	}
+	th.draining = false
+	for user := range th.deferred {
+		th.releaseDeferredLocked(user)
+	}
+}
+
+func (th *TaskHandler) isDraining() bool {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	return th.draining
+}
+
+func (th *TaskHandler) getDrainStatus() DrainStatus {
+	running, queued := th.countAllActiveTasks()
+	return DrainStatus{
+		Draining: th.isDraining(),
+		Running:  running,
+		Queued:   queued,
+	}
+}
+
+//wait for running tasks to end, for up to the specified duration
+func (th *TaskHandler) waitRunningTasks(maxWait time.Duration) {
+	deadline := time.Now().Add(maxWait)
+	for {
+		running, _ := th.countAllActiveTasks()
+		if running == 0 || !time.Now().Before(deadline) {
+			return
+		}
+		time.Sleep(taskWaitPollInterval)
+	}
+}
+
+//rebuild the tasks which were active when the manager stopped, and enqueue them:
+//running ones are re-attached to their worker container (if it still exists), queued ones are processed again
+func (th *TaskHandler) recoverTasks(baseWorkDir string) {
+	entries, err := ioutil.ReadDir(baseWorkDir)
+	if err != nil {
+		log.WithError(err).Warn("Could not recover tasks")
+		return
+	}
+	running := []*Task{}
+	queued := []*Task{}
+	for _, entry := range entries {
+		taskId := entry.Name()
+		if !entry.IsDir() || !isValidTaskId(taskId) {
+			continue
+		}
+		status, _, _ := getTaskExistingStatus(getTaskStateDir(taskId), StatusUnknown)
+		if status != StatusRunning && status != StatusPrepared {
+			continue
+		}
+		t, err := th.recoverTask(taskId, status)
+		if err != nil {
+			log.WithError(err).WithField("task", taskId).Warn("Could not recover task")
+			continue
+		}
+		if status == StatusRunning {
+			exists, err := th.docker.ContainerExists(t.ctx, t.getWorkerContainerName())
+			if err != nil || !exists {
+				//worker is gone, task will be reported as interrupted
+				t.logger().WithError(err).Warn("Worker container of running task not found, task can not be recovered")
+				t.cancel()
+				continue
+			}
+			running = append(running, t)
+		} else {
+			queued = append(queued, t)
+		}
+	}
+	if len(running)+len(queued) == 0 {
+		return
+	}
+	log.WithFields(log.Fields{"running": len(running), "queued": len(queued)}).Info("Recovered tasks")
+
+	th.mu.Lock()
+	for _, t := range append(running, queued...) {
+		th.m[t.id] = t
+	}
+	th.mu.Unlock()
+	//running tasks first, so that they get back their execution slot
+	go func() {
+		for _, t := range append(running, queued...) {
+			th.c <- t.id
+		}
+	}()
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//serve requests until SIGINT or SIGTERM is received, then shut down gracefully
+func serveUntilSignaled(server *http.Server, th *TaskHandler, sockets *socketRegistry, sc ShutdownConfig) {
+	//websockets are not handled by server shutdown, they must be closed explicitly
+	server.RegisterOnShutdown(func() {
+		sockets.closeAll("manager shutting down")
+	})
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.WithField("signal", sig.String()).Info("Shutting down")
+	}
+	//a second signal stops the manager immediately
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+
+	th.startDrain()
+
+	//stop listening, and let in-flight requests complete
+	ctx, cancel := context.WithTimeout(context.Background(), sc.RequestTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("In-flight requests did not complete in time")
+	}
+
+	if running, _ := th.countAllActiveTasks(); running > 0 && sc.TaskWait > 0 {
+		log.WithField("task_wait", sc.TaskWait.String()).Info("Waiting for running tasks to end")
+		th.waitRunningTasks(sc.TaskWait)
+	}
+	status := th.getDrainStatus()
+	log.WithFields(log.Fields{
+		"running": status.Running,
+		"queued":  status.Queued,
+	}).Info("Manager stopped, remaining tasks will be resumed at next start")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"rikencau/abart-manager/dockerhandler"
+)
+
+const taskMetadataFileName = "metadata.json"
+
+//TaskMetadata records how a task was processed, for reproducibility
+type TaskMetadata struct {
+	TaskId TaskId `json:"taskId"`
+	//subject of the authenticated user who created the task (empty if authentication is disabled)
+	Owner string `json:"owner,omitempty"`
+	//task whose transforms are applied by this one (derived tasks only)
+	ParentTaskId TaskId `json:"parentTaskId,omitempty"`
+	//worker settings preset (deployment defaults if empty)
+	Preset string `json:"preset,omitempty"`
+	//parameters submitted with the task
+	Params json.RawMessage `json:"params,omitempty"`
+	//exact worker image used to process the task
+	WorkerImage *dockerhandler.ImageInfo `json:"workerImage,omitempty"`
+
+	CreatedAt time.Time  `json:"createdAt"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+
+	//registration quality, computed once the task has finished
+	Quality *QualityMetrics `json:"quality,omitempty"`
+}
+
+func loadTaskMetadata(taskStateDir string) (TaskMetadata, error) {
+	var metadata TaskMetadata
+	content, err := ioutil.ReadFile(path.Join(taskStateDir, taskMetadataFileName))
+	if err != nil {
+		return metadata, err
+	}
+	err = json.Unmarshal(content, &metadata)
+	return metadata, err
+}
+
+//serializes updates of metadata files, since several instances of a task may update them
+//(e.g. the one being processed, and one rebuilt to serve a request)
+var metadataFilesMu sync.Mutex
+
+//apply changes to the task metadata, and persist it in the task state directory
+func (t *Task) updateMetadata(update func(m *TaskMetadata)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	metadataFilesMu.Lock()
+	defer metadataFilesMu.Unlock()
+
+	//changes persisted by other instances since the metadata was loaded are kept
+	if stored, err := loadTaskMetadata(t.statedir); err == nil {
+		t.metadata = stored
+	}
+	update(&t.metadata)
+
+	metadataPath := path.Join(t.statedir, taskMetadataFileName)
+	jsonData, err := json.MarshalIndent(t.metadata, "", "  ")
+	if err == nil {
+		//replaced at once, so that readers never get a partially written file
+		err = ioutil.WriteFile(metadataPath+".tmp", jsonData, 0644)
+	}
+	if err == nil {
+		err = os.Rename(metadataPath+".tmp", metadataPath)
+	}
+	if err != nil {
+		t.logger().WithError(err).Error("Could not persist task metadata")
+	}
+}
+
+func (t *Task) getMetadata() TaskMetadata {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.metadata
+}
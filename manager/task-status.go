@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Task status vocabulary
+
+Lifecycle of a task, as emitted from API version 2 onward:
+
+	created  -> prepared -> running -> finished
+	                 |          |  |--> failed
+	                 |          |  \--> timed-out
+	                 |          \-----> stopping -> canceled
+	                 \----------------> canceled
+
+	failed       preparation or worker execution went wrong (see reason and message)
+	timed-out    worker exceeded the maximum allowed duration, and was stopped
+	interrupted  task was ongoing when the manager stopped, its outcome is unknown
+	unknown      no task exists with the requested ID
+
+Clients using API version 1 (i.e. not specifying any version) receive the
+legacy vocabulary instead (see TaskStatus.Legacy).
+*/
+type TaskStatus string
+
+const (
+	StatusUnknown     TaskStatus = "unknown"
+	StatusCreated     TaskStatus = "created"
+	StatusPrepared    TaskStatus = "prepared"
+	StatusRunning     TaskStatus = "running"
+	StatusStopping    TaskStatus = "stopping"
+	StatusFinished    TaskStatus = "finished"
+	StatusFailed      TaskStatus = "failed"
+	StatusTimedOut    TaskStatus = "timed-out"
+	StatusCanceled    TaskStatus = "canceled"
+	StatusInterrupted TaskStatus = "interrupted"
+)
+
+//true if the task has not reached a final state yet
+func (s TaskStatus) IsOngoing() bool {
+	switch s {
+	case StatusCreated, StatusPrepared, StatusRunning, StatusStopping:
+		return true
+	default:
+		return false
+	}
+}
+
+//legacy status strings, as expected by API version 1 clients
+func (s TaskStatus) Legacy() string {
+	switch s {
+	case StatusCreated, StatusPrepared:
+		return "pending"
+	case StatusRunning:
+		return "started"
+	case StatusStopping:
+		return "canceling"
+	case StatusFinished:
+		return "done"
+	case StatusTimedOut:
+		//legacy clients only know about failure
+		return string(StatusFailed)
+	default:
+		//failed, canceled, interrupted and unknown are unchanged
+		return string(s)
+	}
+}
+
+//status string to be emitted for the given API version
+func (s TaskStatus) ForApiVersion(version int) string {
+	if version < ApiVersionStatusEnum {
+		return s.Legacy()
+	}
+	return string(s)
+}
+
+//convert a status read from persisted storage, also accepting legacy strings
+func parseTaskStatus(value string) TaskStatus {
+	switch strings.TrimSpace(value) {
+	case "pending":
+		return StatusPrepared
+	case "started":
+		return StatusRunning
+	case "canceling":
+		return StatusStopping
+	case "done":
+		return StatusFinished
+	}
+	s := TaskStatus(strings.TrimSpace(value))
+	switch s {
+	case StatusCreated, StatusPrepared, StatusRunning, StatusStopping,
+		StatusFinished, StatusFailed, StatusTimedOut, StatusCanceled, StatusInterrupted:
+		return s
+	default:
+		return StatusCreated
+	}
+}
+
+//FailureReason qualifies why a task ended in failed status
+type FailureReason string
+
+const (
+	ReasonNone FailureReason = ""
+	//task could not be prepared (e.g. invalid parameters, config could not be written)
+	ReasonPreparation FailureReason = "preparation-error"
+	//worker container could not be created, started or waited for
+	ReasonExecution FailureReason = "execution-error"
+	//worker ended with a non-zero exit code
+	ReasonWorkerError FailureReason = "worker-error"
+	//worker was killed by the kernel for exceeding its memory limit
+	ReasonOOMKilled FailureReason = "oom-killed"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* API version negotiation
+
+Clients indicate the highest API version they support, either with the
+X-Abart-Api-Version request header, or with the apiVersion query parameter
+(e.g. for websockets, which can not carry custom headers from a browser).
+The manager answers using the highest version it supports that is not
+greater than the requested one, and echoes it in the response header.
+Requests without version are served as version 1.
+*/
+const (
+	ApiVersionHeader     = "X-Abart-Api-Version"
+	ApiVersionQueryParam = "apiVersion"
+
+	//original API, with legacy status strings
+	ApiVersionLegacy = 1
+	//documented status enum (see TaskStatus)
+	ApiVersionStatusEnum = 2
+
+	ApiVersionCurrent = ApiVersionStatusEnum
+)
+
+//return the API version to be used to answer the request, or an error if the requested version is invalid
+func negotiateApiVersion(r *http.Request) (int, error) {
+	requested := strings.TrimSpace(r.Header.Get(ApiVersionHeader))
+	if requested == "" {
+		requested = strings.TrimSpace(r.URL.Query().Get(ApiVersionQueryParam))
+	}
+	if requested == "" {
+		return ApiVersionLegacy, nil
+	}
+	version, err := strconv.Atoi(requested)
+	if err != nil || version < ApiVersionLegacy {
+		return 0, fmt.Errorf("invalid API version '%s'", requested)
+	}
+	if version > ApiVersionCurrent {
+		version = ApiVersionCurrent
+	}
+	return version, nil
+}
+
+//negotiate API version and set the corresponding response header; returns false (after sending an error response) if the requested version is invalid
+func withApiVersion(w http.ResponseWriter, r *http.Request) (int, bool) {
+	version, err := negotiateApiVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+	w.Header().Set(ApiVersionHeader, strconv.Itoa(version))
+	return version, true
+}
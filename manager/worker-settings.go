@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+
+	"rikencau/abart-manager/dockerhandler"
+)
+
+//- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+/* Resource limits and isolation settings of worker containers
+
+Deployment-wide settings are specified in the worker section of the configuration
+(or by ABART_WORKER_* environment variables, see config.go).
+Named presets (e.g. for large volumes) may be defined in the configuration, or in
+a JSON file pointed by ABART_WORKER_PRESETS, each preset overriding only the
+settings it specifies:
+
+	{
+		"large": { "cpus": "8", "memory": "32g", "memory_swap": "32g" }
+	}
+
+A preset is selected by the "preset" field of the task parameters.
+
+Extra read-only mounts and atlas location (see makeWorkerEnv) are deployment-wide only.
+*/
+type WorkerSettings struct {
+	//number of CPUs (fractional value allowed, e.g. "2.5")
+	Cpus string `json:"cpus,omitempty" yaml:"cpus,omitempty"`
+	//CPUs in which execution is allowed (e.g. "0-3", "0,1")
+	Cpuset string `json:"cpuset,omitempty" yaml:"cpuset,omitempty"`
+	//memory limit (e.g. "8g")
+	Memory string `json:"memory,omitempty" yaml:"memory,omitempty"`
+	//total memory + swap limit (e.g. "8g" to disable swap, "-1" for unlimited swap)
+	MemorySwap string `json:"memory_swap,omitempty" yaml:"memory_swap,omitempty"`
+	//max number of processes
+	PidsLimit int64 `json:"pids_limit,omitempty" yaml:"pids_limit,omitempty"`
+	//ulimits (e.g. "nofile=1024:2048")
+	Ulimits []string `json:"ulimits,omitempty" yaml:"ulimits,omitempty"`
+	//mount root filesystem read-only
+	ReadonlyRootfs *bool `json:"readonly_rootfs,omitempty" yaml:"readonly_rootfs,omitempty"`
+	//kernel capabilities to drop (e.g. "ALL")
+	CapDrop []string `json:"cap_drop,omitempty" yaml:"cap_drop,omitempty"`
+	//user the worker process runs as, numeric "uid[:gid]" (e.g. "1000:1000")
+	User string `json:"user,omitempty" yaml:"user,omitempty"`
+	//number of threads used by the registration process (defaults to the number of CPUs allowed, if limited)
+	Threads int `json:"threads,omitempty" yaml:"threads,omitempty"`
+}
+
+//named worker settings presets, defined in the configuration and in the presets JSON file (if any)
+func getWorkerPresets(wc WorkerConfig) (map[string]WorkerSettings, error) {
+	presets := make(map[string]WorkerSettings)
+	for name, preset := range wc.Presets {
+		presets[name] = preset
+	}
+
+	presetsPath := strings.TrimSpace(wc.PresetsFile)
+	if presetsPath == "" {
+		return presets, nil
+	}
+	content, err := ioutil.ReadFile(presetsPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read worker presets file: %w", err)
+	}
+	if err := json.Unmarshal(content, &presets); err != nil {
+		return nil, fmt.Errorf("invalid worker presets file '%s': %w", presetsPath, err)
+	}
+	return presets, nil
+}
+
+//split a comma separated list, ignoring empty items
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+//return settings where the ones specified by the preset override the current ones
+func (s WorkerSettings) merge(preset WorkerSettings) WorkerSettings {
+	merged := s
+	if preset.Cpus != "" {
+		merged.Cpus = preset.Cpus
+	}
+	if preset.Cpuset != "" {
+		merged.Cpuset = preset.Cpuset
+	}
+	if preset.Memory != "" {
+		merged.Memory = preset.Memory
+	}
+	if preset.MemorySwap != "" {
+		merged.MemorySwap = preset.MemorySwap
+	}
+	if preset.PidsLimit != 0 {
+		merged.PidsLimit = preset.PidsLimit
+	}
+	if len(preset.Ulimits) > 0 {
+		merged.Ulimits = preset.Ulimits
+	}
+	if preset.ReadonlyRootfs != nil {
+		merged.ReadonlyRootfs = preset.ReadonlyRootfs
+	}
+	if len(preset.CapDrop) > 0 {
+		merged.CapDrop = preset.CapDrop
+	}
+	if preset.User != "" {
+		merged.User = preset.User
+	}
+	if preset.Threads != 0 {
+		merged.Threads = preset.Threads
+	}
+	return merged
+}
+
+//convert settings to the limits applied to the worker container
+func (s WorkerSettings) toLimits() (dockerhandler.WorkerLimits, error) {
+	var limits dockerhandler.WorkerLimits
+
+	if s.Cpus != "" {
+		cpus, err := strconv.ParseFloat(s.Cpus, 64)
+		if err != nil || cpus <= 0 {
+			return limits, fmt.Errorf("invalid cpus value: '%s'", s.Cpus)
+		}
+		limits.NanoCPUs = int64(cpus * 1e9)
+	}
+	limits.CpusetCpus = s.Cpuset
+
+	if s.Memory != "" {
+		memory, err := units.RAMInBytes(s.Memory)
+		if err != nil || memory <= 0 {
+			return limits, fmt.Errorf("invalid memory value: '%s'", s.Memory)
+		}
+		limits.Memory = memory
+	}
+	if s.MemorySwap == "-1" {
+		limits.MemorySwap = -1
+	} else if s.MemorySwap != "" {
+		memorySwap, err := units.RAMInBytes(s.MemorySwap)
+		if err != nil || memorySwap <= 0 {
+			return limits, fmt.Errorf("invalid memory_swap value: '%s'", s.MemorySwap)
+		}
+		if limits.Memory == 0 || memorySwap < limits.Memory {
+			return limits, fmt.Errorf("memory_swap value '%s' requires a memory limit lower or equal to it", s.MemorySwap)
+		}
+		limits.MemorySwap = memorySwap
+	}
+
+	if s.PidsLimit < 0 {
+		return limits, fmt.Errorf("invalid pids_limit value: %d", s.PidsLimit)
+	}
+	limits.PidsLimit = s.PidsLimit
+
+	for _, ulimitStr := range s.Ulimits {
+		ulimit, err := units.ParseUlimit(ulimitStr)
+		if err != nil {
+			return limits, fmt.Errorf("invalid ulimit value: '%s': %w", ulimitStr, err)
+		}
+		limits.Ulimits = append(limits.Ulimits, ulimit)
+	}
+
+	limits.ReadonlyRootfs = s.ReadonlyRootfs != nil && *s.ReadonlyRootfs
+	limits.CapDrop = s.CapDrop
+	if s.User != "" {
+		if _, _, err := parseWorkerUser(s.User); err != nil {
+			return limits, err
+		}
+	}
+	limits.User = s.User
+
+	return limits, nil
+}
+
+//WorkerProfile is the resolved configuration of a worker container
+type WorkerProfile struct {
+	Limits dockerhandler.WorkerLimits
+	//number of threads used by the registration process (0 means not specified)
+	Threads int
+}
+
+//resolve settings to the configuration applied to the worker container
+func (s WorkerSettings) toProfile() (WorkerProfile, error) {
+	limits, err := s.toLimits()
+	if err != nil {
+		return WorkerProfile{}, err
+	}
+
+	if s.Threads < 0 {
+		return WorkerProfile{}, fmt.Errorf("invalid threads value: %d", s.Threads)
+	}
+	threads := s.Threads
+	if threads == 0 && limits.NanoCPUs > 0 {
+		//use as many threads as allowed CPUs
+		threads = int(math.Ceil(float64(limits.NanoCPUs) / 1e9))
+	}
+	return WorkerProfile{limits, threads}, nil
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+
+//WorkerProfiles resolves the configuration to be applied to a worker, according to the requested preset
+type WorkerProfiles struct {
+	defaults WorkerSettings
+	presets  map[string]WorkerSettings
+}
+
+//load deployment settings and presets, and check that they are all valid
+func initWorkerProfiles(wc WorkerConfig) (WorkerProfiles, error) {
+	defaults := wc.Settings
+	presets, err := getWorkerPresets(wc)
+	if err != nil {
+		return WorkerProfiles{}, err
+	}
+
+	wp := WorkerProfiles{defaults, presets}
+	if _, err := wp.getProfile(""); err != nil {
+		return wp, fmt.Errorf("invalid worker settings: %w", err)
+	}
+	for name := range presets {
+		if _, err := wp.getProfile(name); err != nil {
+			return wp, fmt.Errorf("invalid worker preset '%s': %w", name, err)
+		}
+	}
+	return wp, nil
+}
+
+//configuration for the given preset (deployment-wide settings if preset is empty)
+func (wp *WorkerProfiles) getProfile(preset string) (WorkerProfile, error) {
+	if preset == "" {
+		return wp.defaults.toProfile()
+	}
+	presetSettings, ok := wp.presets[preset]
+	if !ok {
+		return WorkerProfile{}, fmt.Errorf("unknown worker preset '%s'", preset)
+	}
+	return wp.defaults.merge(presetSettings).toProfile()
+}
+
+//numeric uid and gid (-1 if not specified) of the worker user "uid[:gid]"
+func parseWorkerUser(user string) (int, int, error) {
+	ids := strings.SplitN(user, ":", 2)
+	uid, err := strconv.Atoi(ids[0])
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("invalid user value '%s': numeric uid[:gid] expected, so that the task directory can be granted to the worker", user)
+	}
+	gid := -1
+	if len(ids) == 2 {
+		if gid, err = strconv.Atoi(ids[1]); err != nil || gid < 0 {
+			return 0, 0, fmt.Errorf("invalid user value '%s': numeric uid[:gid] expected, so that the task directory can be granted to the worker", user)
+		}
+	}
+	return uid, gid, nil
+}
+
+//give the worker user write access to the task directory (which is not opened to other users)
+func grantWorkdirAccess(workdir string, user string) error {
+	if user == "" {
+		//image default user (root)
+		return nil
+	}
+	uid, gid, err := parseWorkerUser(user)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(workdir, uid, gid); err != nil {
+		return fmt.Errorf("could not give task directory to worker user '%s': %w", user, err)
+	}
+	return os.Chmod(workdir, 0770)
+}
+
+//. . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . . .
+/* Environment contract between manager and worker
+
+Variables set by the manager in every worker container:
+
+	ABART_TASK_ID                         ID of the task being processed
+	ABART_TASK_DIR                        task directory (also the container working directory)
+	ABART_PRESET                          name of the worker settings preset (empty for deployment defaults)
+	ABART_ATLAS_DIR                       directory holding the atlas, only if specified by ABART_WORKER_ATLAS_DIR
+	ABART_THREADS                         number of threads to use, only if known (see WorkerSettings.Threads)
+	ITK_GLOBAL_DEFAULT_NUMBER_OF_THREADS  same as ABART_THREADS, honored by ITK/ANTs tools
+*/
+func makeWorkerEnv(taskId TaskId, taskDir string, preset string, profile WorkerProfile, atlasDir string) []string {
+	env := []string{
+		"ABART_TASK_ID=" + string(taskId),
+		"ABART_TASK_DIR=" + taskDir,
+		"ABART_PRESET=" + preset,
+	}
+	if atlasDir != "" {
+		env = append(env, "ABART_ATLAS_DIR="+atlasDir)
+	}
+	if profile.Threads > 0 {
+		threads := strconv.Itoa(profile.Threads)
+		env = append(env,
+			"ABART_THREADS="+threads,
+			"ITK_GLOBAL_DEFAULT_NUMBER_OF_THREADS="+threads,
+		)
+	}
+	return env
+}
+
+//directory holding the atlas within worker containers (image default if empty)
+func (wc WorkerConfig) atlasDir() (string, error) {
+	atlasDir := strings.TrimSpace(wc.AtlasDir)
+	if atlasDir != "" && !path.IsAbs(atlasDir) {
+		return "", fmt.Errorf("'%s' is not an absolute path", atlasDir)
+	}
+	return atlasDir, nil
+}
+
+//extra read-only mounts of worker containers, specified as "source:target"
+//(source being either a volume name or a host absolute path)
+func (wc WorkerConfig) extraMounts() ([]dockerhandler.Mount, error) {
+	mounts := []dockerhandler.Mount{}
+	for _, mountStr := range wc.ExtraMounts {
+		parts := strings.Split(mountStr, ":")
+		if len(parts) != 2 || parts[0] == "" || !path.IsAbs(parts[1]) {
+			return nil, fmt.Errorf("invalid item '%s' (expected 'source:/absolute/target')", mountStr)
+		}
+		mounts = append(mounts, dockerhandler.Mount{Source: parts[0], Target: parts[1]})
+	}
+	return mounts, nil
+}
@@ -10,6 +10,18 @@ type StartTaskResponse = {
     message: string
 }
 
+/* Task status, as emitted by the Manager API version 2
+   (see manager/task-status.go for the documented lifecycle) */
+export type TaskStatus =
+    'created' | 'prepared' | 'running' | 'stopping'
+    | 'finished' | 'failed' | 'timed-out' | 'canceled' | 'interrupted' | 'unknown';
+
+type TaskStatusResponse = {
+    taskId: string,
+    status: TaskStatus,
+    message?: string
+}
+
 
 export class RegistrationTask {
 
@@ -35,6 +47,14 @@ export class RegistrationTask {
     static ApiPrefix = "/abart/api";
     */
 
+    //version of the Manager API this client is built for
+    static ApiVersion = 2;
+    static ApiVersionHeader = "X-Abart-Api-Version";
+
+    static getApiHeaders(): Record<string, string> {
+        return { [RegistrationTask.ApiVersionHeader]: String(RegistrationTask.ApiVersion) };
+    }
+
     static getApiUrlPrefix(protocol: string = "") {
         return (
             (protocol ? protocol : RegistrationTask.ApiProtocol)
@@ -63,6 +83,7 @@ export class RegistrationTask {
         const connectSocketAndStream = () => {
             const logMsgSocket = new WebSocket(
                 RegistrationTask.getApiUrlPrefix(window.location.protocol === "https:" ? "wss://" : "ws://") + '/tasks/' + task.taskId + '/logs'
+                + '?apiVersion=' + RegistrationTask.ApiVersion
             );
             logMsgSocket.onopen = function (event) {
                 //reset retry count after connection is (re)established
@@ -90,8 +111,8 @@ export class RegistrationTask {
                                 setTimeout(connectSocketAndStream, RetryInterval);
 
                             } else {
-                                const finishedInError = !task.hasFinished();
-                                onDone(finishedInError, event)
+                                const finishedInError = !task.hasSucceeded();
+                                onDone(finishedInError, event, finishedInError ? task.taskMessage : undefined)
                             }
 
                         }
@@ -133,7 +154,7 @@ export class RegistrationTask {
 
 
     static getApiVersion() {
-        axios.get<string>(RegistrationTask.getApiUrlPrefix() + '/version')
+        axios.get<string>(RegistrationTask.getApiUrlPrefix() + '/version', { headers: RegistrationTask.getApiHeaders() })
             .then(function (response) {
                 console.log(response);
             })
@@ -155,6 +176,7 @@ export class RegistrationTask {
             formData,
             {
                 headers: {
+                    ...RegistrationTask.getApiHeaders(),
                     'Content-Type': 'multipart/form-data'
                 }
             }
@@ -183,7 +205,8 @@ export class RegistrationTask {
 
     //-------------------------------------------------------------------------
     taskId: string | null = null;
-    taskStatus: string = 'pending';
+    taskStatus: TaskStatus = 'created';
+    taskMessage: string | undefined;
     taskParams: TaskParams;
 
     hasStarted() {
@@ -191,20 +214,30 @@ export class RegistrationTask {
     };
 
     isOngoing() {
-        return this.taskStatus === 'pending' || this.taskStatus === 'started';
+        return this.taskStatus === 'created'
+            || this.taskStatus === 'prepared'
+            || this.taskStatus === 'running'
+            || this.taskStatus === 'stopping';
     };
 
+    //task reached a final state (whatever the outcome)
     hasFinished() {
-        return this.taskStatus.startsWith('done');
+        return !this.isOngoing();
+    };
+
+    hasSucceeded() {
+        return this.taskStatus === 'finished';
     };
 
     isCanceled() {
-        return this.taskStatus.startsWith('cancel');
+        return this.taskStatus === 'stopping' || this.taskStatus === 'canceled';
     };
 
     cancel(onDone: () => void) {
-        axios.put(
-            RegistrationTask.getApiUrlPrefix() + '/tasks/' + this.taskId + '/cancel'
+        axios.put<TaskStatusResponse>(
+            RegistrationTask.getApiUrlPrefix() + '/tasks/' + this.taskId + '/cancel',
+            undefined,
+            { headers: RegistrationTask.getApiHeaders() }
         )
             .then((response) => {
                 this.taskStatus = response.data.status;
@@ -214,16 +247,18 @@ export class RegistrationTask {
                 console.log(error);
                 onDone();
             });
-        this.taskStatus = 'canceling';
+        this.taskStatus = 'stopping';
         return this;
     };
 
     refreshStatus() {
-        return axios.get(
-            RegistrationTask.getApiUrlPrefix() + '/tasks/' + this.taskId + '/status'
+        return axios.get<TaskStatusResponse>(
+            RegistrationTask.getApiUrlPrefix() + '/tasks/' + this.taskId + '/status',
+            { headers: RegistrationTask.getApiHeaders() }
         )
             .then((response) => {
                 this.taskStatus = response.data.status;
+                this.taskMessage = response.data.message;
             })
     };
 
@@ -65,14 +65,14 @@ const ActionControls = (props: ActionControlsProps) => {
                                                 Registration aborted!
                                                 {error ? <pre>{error}</pre> : null}
                                             </p>);
-                                        task.taskStatus = 'aborted';
+                                        task.taskStatus = 'failed';
                                         setRemoteTask(undefined);
                                     } else {
                                         setAlertMessage(
                                             <p>
                                                 Registration done!
                                             </p>);
-                                        task.taskStatus = 'done';
+                                        task.taskStatus = 'finished';
                                     }
                                     setShowLogs(false);
                                 },
@@ -102,7 +102,7 @@ const ActionControls = (props: ActionControlsProps) => {
                     null
                 }
 
-                {remoteTask && remoteTask.hasFinished() && remoteTask.taskStatus === 'done'
+                {remoteTask && remoteTask.hasSucceeded()
                     ?
                     <Button
                         icon="eye-open"
@@ -111,7 +111,7 @@ const ActionControls = (props: ActionControlsProps) => {
                     null
                 }
 
-                {remoteTask && remoteTask.hasFinished() && remoteTask.taskStatus === 'done'
+                {remoteTask && remoteTask.hasSucceeded()
                     ?
                     <AnchorButton
                         icon="archive"
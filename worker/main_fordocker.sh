@@ -1,20 +1,55 @@
 #!/bin/bash
 
 #registration script invoked from Docker container
-reference_dir='/abart'
-moving_image=`cat config.json | jq -r '.moving_image'`
-pre_transform=`cat config.json | jq -r '.pre_transform'`
-overrride_fixed_image=`cat config.json | jq -r '.fixed_image'`
-
-# ANTs transformation
-echo "ANTs transformation"
-${reference_dir}/do_registration.sh ${reference_dir} ${moving_image} ${pre_transform} ${overrride_fixed_image}
-
-ret=$?
-if [ ! $ret -eq 0 ]; then
-	echo "ANTs transformation failed"
+#(environment variables set by the manager are listed in manager/README.md)
+script_dir='/abart'
+#atlas directory (containing template/) may be provided by a shared mount
+reference_dir=${ABART_ATLAS_DIR:-/abart}
+
+if [ "`jq -r '.apply_transforms != null' config.json`" = "true" ]; then
+	#derived task: transforms of a previous registration are applied to additional images
+	echo "ANTs apply transforms"
+	reference_image=`jq -r '.apply_transforms.reference_image' config.json`
+	transforms=()
+	while IFS= read -r transform; do
+		transforms+=(-t "${transform}")
+	done < <(jq -r '.apply_transforms.transforms[]' config.json)
+
+	ret=0
+	image_count=`jq '.apply_transforms.images | length' config.json`
+	for ((i = 0; i < image_count; i++)); do
+		input=`jq -r ".apply_transforms.images[$i].input" config.json`
+		output=`jq -r ".apply_transforms.images[$i].output" config.json`
+		interpolation=`jq -r ".apply_transforms.images[$i].interpolation" config.json`
+		echo "Applying transforms to ${input} (${interpolation} interpolation)"
+		mkdir -p `dirname "${output}"`
+		antsApplyTransforms -d 3 -i "${input}" -r "${reference_image}" -o "${output}" -n "${interpolation}" "${transforms[@]}"
+		ret=$?
+		if [ ! $ret -eq 0 ]; then
+			break
+		fi
+	done
+
+	if [ ! $ret -eq 0 ]; then
+		echo "ANTs apply transforms failed"
+	else
+		echo "ANTs apply transforms completed successfully"
+	fi
 else
-	echo "ANTs transformation completed successfully"
+	moving_image=`cat config.json | jq -r '.moving_image'`
+	pre_transform=`cat config.json | jq -r '.pre_transform'`
+	overrride_fixed_image=`cat config.json | jq -r '.fixed_image'`
+
+	# ANTs transformation
+	echo "ANTs transformation"
+	${script_dir}/do_registration.sh ${reference_dir} ${moving_image} ${pre_transform} ${overrride_fixed_image}
+
+	ret=$?
+	if [ ! $ret -eq 0 ]; then
+		echo "ANTs transformation failed"
+	else
+		echo "ANTs transformation completed successfully"
+	fi
 fi
 echo $ret > finished
 